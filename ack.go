@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// writers pick how far a write must get before it is acknowledged with the
+// X-Ack-Level header, and the response carries the level actually reached.
+// A write is stored synchronously either way, so the achieved level is the
+// best the backend offers and can be higher than requested.
+const ackLevelHeader = "X-Ack-Level"
+
+type ackLevel int
+
+const (
+	ackMemory ackLevel = iota
+	ackPersisted
+	ackQuorum
+)
+
+var ackLevelNames = map[ackLevel]string{
+	ackMemory:    "memory",
+	ackPersisted: "persisted",
+	ackQuorum:    "quorum",
+}
+
+func (l ackLevel) String() string {
+	return ackLevelNames[l]
+}
+
+func parseAckLevel(v string) (ackLevel, error) {
+	for l, name := range ackLevelNames {
+		if name == v {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown ack level %q, expected memory, persisted or quorum", v)
+}
+
+// storeAckLevel is the level a write to s reaches. There is no replication,
+// so quorum is never reached.
+func storeAckLevel(s Store) ackLevel {
+	if d, ok := s.(DurableStore); ok && d.Durable() {
+		return ackPersisted
+	}
+	return ackMemory
+}
+
+// requestedAckLevel returns the level asked for by r, memory if none was
+func requestedAckLevel(r *http.Request) (ackLevel, error) {
+	v := r.Header.Get(ackLevelHeader)
+	if v == "" {
+		return ackMemory, nil
+	}
+	return parseAckLevel(v)
+}
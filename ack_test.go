@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestUpdateAckLevel(t *testing.T) {
+	defer func(s Store) { th = s }(th)
+	durable := newFileStore(filepath.Join(t.TempDir(), "state"))
+
+	tests := []struct {
+		description        string
+		store              Store
+		requested          string
+		expectedStatusCode int
+		expectedLevel      string
+	}{
+		{"default in memory", &dataStore{}, "", http.StatusOK, "memory"},
+		{"memory in memory", &dataStore{}, "memory", http.StatusOK, "memory"},
+		{"persisted in memory", &dataStore{}, "persisted", http.StatusPreconditionFailed, ""},
+		{"memory on disk", durable, "memory", http.StatusOK, "persisted"},
+		{"persisted on disk", durable, "persisted", http.StatusOK, "persisted"},
+		{"quorum", durable, "quorum", http.StatusPreconditionFailed, ""},
+		{"unknown", durable, "fsync", http.StatusBadRequest, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			th = test.store
+			th.Set(nil)
+			req := httptest.NewRequest(http.MethodPut, getStorePath(), bytes.NewReader([]byte("42")))
+			req.Header.Set("Content-Type", "text/plain")
+			if test.requested != "" {
+				req.Header.Set(ackLevelHeader, test.requested)
+			}
+			w := httptest.NewRecorder()
+			update(w, req)
+			if w.Code != test.expectedStatusCode {
+				t.Errorf("expected status code to be %d, got: %d", test.expectedStatusCode, w.Code)
+			}
+			if got := w.Header().Get(ackLevelHeader); got != test.expectedLevel {
+				t.Errorf("expected ack level %q, got: %q", test.expectedLevel, got)
+			}
+			if w.Code != http.StatusOK && mustGet(t, th).Unix() == 42 {
+				t.Error("rejected write was stored")
+			}
+		})
+	}
+}
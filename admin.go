@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+// The admin listener serves the pprof profiles under /debug/pprof/, on an
+// address of its own so they are never reachable through the API. It has no
+// authentication and so only binds to loopback addresses unless
+// -admin-allow-remote is given.
+var (
+	adminAddr        = flag.String("admin-addr", "", "address serving pprof under /debug/pprof/, like 127.0.0.1:6060, disabled if empty")
+	adminAllowRemote = flag.Bool("admin-allow-remote", false, "allow -admin-addr to listen on other than loopback addresses")
+)
+
+// checkAdminAddr refuses addresses reachable from other hosts, including
+// those without a host, which listen on every interface
+func checkAdminAddr(addr string, allowRemote bool) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if allowRemote {
+		return nil
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("%s is not a loopback address, use -admin-allow-remote to listen on it", addr)
+}
+
+func newAdminServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	// CPU profiles and traces take ?seconds= to record, so responses get no
+	// write timeout
+	return &http.Server{
+		Handler:     mux,
+		Addr:        addr,
+		ReadTimeout: defaultTimeout,
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckAdminAddr(t *testing.T) {
+	tests := []struct {
+		addr        string
+		allowRemote bool
+		expectErr   bool
+	}{
+		{"127.0.0.1:6060", false, false},
+		{"[::1]:6060", false, false},
+		{"localhost:6060", false, false},
+		{":6060", false, true},
+		{"0.0.0.0:6060", false, true},
+		{"10.0.0.5:6060", false, true},
+		{"10.0.0.5:6060", true, false},
+		{"6060", true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.addr, func(t *testing.T) {
+			err := checkAdminAddr(test.addr, test.allowRemote)
+			if (err != nil) != test.expectErr {
+				t.Errorf("expected error %v, got: %v", test.expectErr, err)
+			}
+		})
+	}
+}
+
+func TestAdminServer(t *testing.T) {
+	h := newAdminServer("127.0.0.1:0").Handler
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/pprof/goroutine?debug=1", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "goroutine profile") {
+		t.Errorf("expected a goroutine profile, got: %d %.100s", w.Code, w.Body.String())
+	}
+	// the API routes are not served
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, apiPrefix+getPath, nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected %d, got: %d", http.StatusNotFound, w.Code)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// time-based rotating tokens (RFC 6238) derived from a pre-shared secret, for
+// writers that can't do client certificates or token exchange flows
+const (
+	totpScheme = "TOTP"
+	totpStep   = 30 * time.Second
+	totpDigits = 8
+	// accept the previous and next step to tolerate clock drift
+	totpDriftSteps = 1
+)
+
+// The secrets are read from a file, or from the environment when no file is
+// given, so they don't show up in the process list. The built-in client
+// talks to this server, so it uses the write secret unless given its own.
+const (
+	writeSecretEnv  = "TS_STORE_WRITE_SECRET"
+	clientSecretEnv = "TS_STORE_CLIENT_SECRET"
+)
+
+var (
+	writeSecretFile  = flag.String("write-secret-file", "", "file holding the TOTP secret of routes requiring a token, "+writeSecretEnv+" can hold the secret instead")
+	clientSecretFile = flag.String("client-secret-file", "", "file holding the TOTP secret the built-in client authenticates with, "+clientSecretEnv+" can hold the secret instead, defaults to the write secret")
+
+	// writeSecret enables token auth on writes when set
+	writeSecret []byte
+	// clientSecret makes the client attach a token to its writes
+	clientSecret []byte
+)
+
+// loadSecret reads the secret in file, or in the environment variable env
+// when file is empty. Trailing whitespace, like the newline editors add, is
+// not part of the secret. A file or variable that is there but empty is an
+// error, as it most likely means the secret was lost on the way.
+func loadSecret(file, env string) ([]byte, error) {
+	if file == "" {
+		value, ok := os.LookupEnv(env)
+		secret := strings.TrimRight(value, " \t\r\n")
+		if ok && secret == "" {
+			return nil, fmt.Errorf("%s is empty", env)
+		}
+		return []byte(secret), nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	secret := bytes.TrimRight(data, " \t\r\n")
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("%s is empty", file)
+	}
+	return secret, nil
+}
+
+// configureAuth loads the secrets. Without a write secret token routes are
+// open to anyone, which is what the defaults have always done, but routes
+// asked to require a token in -route-auth (requested) are refused then.
+func configureAuth(requested map[string]authLevel) error {
+	var err error
+	if writeSecret, err = loadSecret(*writeSecretFile, writeSecretEnv); err != nil {
+		return fmt.Errorf("could not read the write secret: %w", err)
+	}
+	if clientSecret, err = loadSecret(*clientSecretFile, clientSecretEnv); err != nil {
+		return fmt.Errorf("could not read the client secret: %w", err)
+	}
+	if len(clientSecret) == 0 {
+		clientSecret = writeSecret
+	}
+	if len(writeSecret) > 0 {
+		return nil
+	}
+	var protected []string
+	for route, level := range requested {
+		if level == authToken {
+			protected = append(protected, route)
+		}
+	}
+	if len(protected) == 0 {
+		return nil
+	}
+	sort.Strings(protected)
+	return fmt.Errorf("-route-auth requires a token on %s but no write secret is configured, set -write-secret-file or %s", strings.Join(protected, ", "), writeSecretEnv)
+}
+
+func totp(secret []byte, t time.Time) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(t.Unix()/int64(totpStep/time.Second)))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, code%mod)
+}
+
+func validTOTP(secret []byte, token string, at time.Time) bool {
+	valid := false
+	for i := -totpDriftSteps; i <= totpDriftSteps; i++ {
+		expected := totp(secret, at.Add(time.Duration(i)*totpStep))
+		// check every step so timing doesn't reveal which one matched
+		if hmac.Equal([]byte(expected), []byte(token)) {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// requireTOTP rejects requests without a valid "Authorization: TOTP <code>"
+// header when writeSecret is set
+func requireTOTP(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(writeSecret) == 0 {
+			h(w, r)
+			return
+		}
+		if !hasValidTOTP(r) {
+			log(os.Stderr, "rejected unauthenticated request to %s from writer %q\n", r.URL.Path, writer(r))
+			if isValueWrite(r) {
+				metrics.reject(rejectUnauthorized)
+			}
+			w.Header().Set("WWW-Authenticate", totpScheme)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// hasValidTOTP reports whether r carries a valid "Authorization: TOTP <code>"
+// header for writeSecret
+func hasValidTOTP(r *http.Request) bool {
+	token := requestTOTP(r)
+	return token != "" && validTOTP(writeSecret, token, now())
+}
+
+// requestTOTP returns the code in the "Authorization: TOTP <code>" header of
+// r, "" if there is none
+func requestTOTP(r *http.Request) string {
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if scheme != totpScheme {
+		return ""
+	}
+	return token
+}
+
+// authLevel is what a route requires from callers. Token routes only
+// enforce anything while writeSecret is set, which configureAuth ensures for
+// the routes listed in -route-auth.
+type authLevel string
+
+const (
+	authAnonymous authLevel = "anonymous"
+	authToken     authLevel = "token"
+	// allRoutes in -route-auth sets the level of every route not listed
+	allRoutes = "*"
+)
+
+var routeAuthSpec = flag.String("route-auth", "", "comma-separated route=level pairs, level being anonymous or token, e.g. *=token to lock everything down or /status=anonymous; replaces the defaults when * is given")
+
+// routeAuth defaults to anonymous reads and authenticated writes
+var routeAuth = defaultRouteAuth()
+
+func defaultRouteAuth() map[string]authLevel {
+	return map[string]authLevel{
+		allRoutes: authAnonymous,
+		putPath:   authToken,
+		lockPath:  authToken,
+		// registered URLs can carry credentials, so listing them is protected too
+		webhooksPath: authToken,
+	}
+}
+
+// parseRouteAuth builds the route policy from a -route-auth value. Listed
+// routes override the defaults, and listing * drops the defaults entirely.
+func parseRouteAuth(spec string) (map[string]authLevel, error) {
+	requested, err := parseRouteAuthPairs(spec)
+	if err != nil {
+		return nil, err
+	}
+	return withDefaultRouteAuth(requested), nil
+}
+
+// parseRouteAuthPairs returns the route=level pairs listed in a -route-auth
+// value, without the defaults
+func parseRouteAuthPairs(spec string) (map[string]authLevel, error) {
+	parsed := map[string]authLevel{}
+	if strings.TrimSpace(spec) == "" {
+		return parsed, nil
+	}
+	for _, pair := range strings.Split(spec, ",") {
+		route, level, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || (route != allRoutes && !strings.HasPrefix(route, "/")) {
+			return nil, fmt.Errorf("invalid route auth %q, expected route=level", pair)
+		}
+		// routes are served under the versioned prefix but keyed without it
+		if route != allRoutes {
+			if strings.HasPrefix(route, apiPrefix+"/") {
+				route = strings.TrimPrefix(route, apiPrefix)
+			}
+			if _, ok := serverRoutes()[route]; !ok {
+				return nil, fmt.Errorf("unknown route %q in route auth", route)
+			}
+		}
+		switch l := authLevel(level); l {
+		case authAnonymous, authToken:
+			parsed[route] = l
+		default:
+			return nil, fmt.Errorf("invalid auth level %q for %s, expected anonymous or token", level, route)
+		}
+	}
+	return parsed, nil
+}
+
+// withDefaultRouteAuth lays the requested levels over the defaults, or
+// replaces them when * is requested
+func withDefaultRouteAuth(requested map[string]authLevel) map[string]authLevel {
+	levels := defaultRouteAuth()
+	if _, ok := requested[allRoutes]; ok {
+		levels = map[string]authLevel{}
+	}
+	for route, level := range requested {
+		levels[route] = level
+	}
+	return levels
+}
+
+func authFor(route string) authLevel {
+	if level, ok := routeAuth[route]; ok {
+		return level
+	}
+	return routeAuth[allRoutes]
+}
+
+// withAuth applies the level configured for route when a request comes in,
+// so the policy can be set after the routes are built
+func withAuth(route string, h http.HandlerFunc) http.HandlerFunc {
+	protected := requireTOTP(h)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if authFor(route) == authToken {
+			protected(w, r)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func setTOTPHeader(req *http.Request) {
+	if len(clientSecret) == 0 {
+		return
+	}
+	req.Header.Set("Authorization", totpScheme+" "+totp(clientSecret, time.Now()))
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTOTP(t *testing.T) {
+	// SHA1 test vectors from RFC 6238 appendix B
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		unix     int64
+		expected string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+	}
+	for _, test := range tests {
+		if got := totp(secret, time.Unix(test.unix, 0)); got != test.expected {
+			t.Errorf("at %d expected %s, got: %s", test.unix, test.expected, got)
+		}
+	}
+}
+
+func TestRequireTOTP(t *testing.T) {
+	defer func() { writeSecret = nil }()
+	secret := []byte("shared with the writer")
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+
+	type tc struct {
+		description        string
+		secret             []byte
+		authorization      string
+		expectedStatusCode int
+	}
+	testCases := []tc{
+		{"disabled", nil, "", http.StatusOK},
+		{"missing token", secret, "", http.StatusUnauthorized},
+		{"current token", secret, "TOTP " + totp(secret, time.Now()), http.StatusOK},
+		{"previous step", secret, "TOTP " + totp(secret, time.Now().Add(-totpStep)), http.StatusOK},
+		{"expired token", secret, "TOTP " + totp(secret, time.Now().Add(-5*totpStep)), http.StatusUnauthorized},
+		{"wrong scheme", secret, "Bearer " + totp(secret, time.Now()), http.StatusUnauthorized},
+		{"wrong secret", secret, "TOTP " + totp([]byte("other"), time.Now()), http.StatusUnauthorized},
+	}
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			writeSecret = test.secret
+			req := httptest.NewRequest(http.MethodPut, getStorePath(), nil)
+			if test.authorization != "" {
+				req.Header.Set("Authorization", test.authorization)
+			}
+			w := httptest.NewRecorder()
+			requireTOTP(ok)(w, req)
+			if w.Code != test.expectedStatusCode {
+				t.Errorf("expected status code to be %d, got: %d", test.expectedStatusCode, w.Code)
+			}
+		})
+	}
+}
+
+func TestParseRouteAuth(t *testing.T) {
+	tests := []struct {
+		description string
+		spec        string
+		expected    map[string]authLevel
+		expectErr   bool
+	}{
+		{"defaults", "", map[string]authLevel{getPath: authAnonymous, statusPath: authAnonymous, putPath: authToken, lockPath: authToken}, false},
+		{"authenticated read", "/retrieve=token", map[string]authLevel{getPath: authToken, statusPath: authAnonymous, putPath: authToken}, false},
+		{"locked down", "*=token", map[string]authLevel{getPath: authToken, statusPath: authToken, putPath: authToken}, false},
+		{"locked down except status", "*=token, /status=anonymous", map[string]authLevel{getPath: authToken, statusPath: authAnonymous, putPath: authToken}, false},
+		{"open", "*=anonymous", map[string]authLevel{getPath: authAnonymous, putPath: authAnonymous, lockPath: authAnonymous}, false},
+		{"missing level", "/retrieve", nil, true},
+		{"unknown level", "/retrieve=admin", nil, true},
+		{"relative route", "retrieve=token", nil, true},
+		{"versioned route", "/v1/retrieve=token", map[string]authLevel{getPath: authToken, putPath: authToken}, false},
+		{"versioned write route", "/v1/update=anonymous", map[string]authLevel{putPath: authAnonymous}, false},
+		{"unknown route", "/updte=token", nil, true},
+		{"unknown versioned route", "/v1/updte=token", nil, true},
+		{"prefix only", "/v1=token", nil, true},
+	}
+	defer func() { routeAuth = defaultRouteAuth() }()
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			levels, err := parseRouteAuth(test.spec)
+			if test.expectErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			routeAuth = levels
+			for route, expected := range test.expected {
+				if got := authFor(route); got != expected {
+					t.Errorf("expected %s to need %s, got: %s", route, expected, got)
+				}
+			}
+		})
+	}
+}
+
+func TestWithAuth(t *testing.T) {
+	defer func() { writeSecret = nil }()
+	defer func() { routeAuth = defaultRouteAuth() }()
+	writeSecret = []byte("shared with the writer")
+	handler := newMux(map[string]http.HandlerFunc{
+		getPath: func(w http.ResponseWriter, r *http.Request) {},
+		putPath: func(w http.ResponseWriter, r *http.Request) {},
+	})
+
+	tests := []struct {
+		description        string
+		spec               string
+		path               string
+		expectedStatusCode int
+	}{
+		{"anonymous read", "", apiPrefix + getPath, http.StatusOK},
+		{"authenticated write", "", apiPrefix + putPath, http.StatusUnauthorized},
+		{"legacy alias", "", putPath, http.StatusUnauthorized},
+		{"locked down read", "*=token", apiPrefix + getPath, http.StatusUnauthorized},
+		{"open write", "/update=anonymous", apiPrefix + putPath, http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			levels, err := parseRouteAuth(test.spec)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			routeAuth = levels
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, test.path, nil))
+			if w.Code != test.expectedStatusCode {
+				t.Errorf("expected status code to be %d, got: %d", test.expectedStatusCode, w.Code)
+			}
+		})
+	}
+}
+
+func TestConfigureAuth(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "secret")
+	if err := os.WriteFile(secretFile, []byte("file-secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	emptyFile := filepath.Join(dir, "empty")
+	if err := os.WriteFile(emptyFile, []byte("\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name         string
+		env          map[string]string
+		args         []string
+		wantErr      bool
+		writeSecret  string
+		clientSecret string
+	}{
+		{"default routes without a secret", nil, nil, false, "", ""},
+		{"requested token route without a secret", nil, []string{"-route-auth", "/status=token"}, true, "", ""},
+		{"requested token routes without a secret", nil, []string{"-route-auth", "*=token"}, true, "", ""},
+		{"anonymous routes without a secret", nil, []string{"-route-auth", "*=anonymous"}, false, "", ""},
+		{"requested token route with a secret", map[string]string{writeSecretEnv: "env-secret"}, []string{"-route-auth", "*=token"}, false, "env-secret", "env-secret"},
+		{"secret file", nil, []string{"-write-secret-file", secretFile}, false, "file-secret", "file-secret"},
+		{"secret env", map[string]string{writeSecretEnv: "env-secret"}, nil, false, "env-secret", "env-secret"},
+		{"file wins over env", map[string]string{writeSecretEnv: "env-secret"}, []string{"-write-secret-file", secretFile}, false, "file-secret", "file-secret"},
+		{"own client secret", map[string]string{writeSecretEnv: "env-secret", clientSecretEnv: "client-secret"}, nil, false, "env-secret", "client-secret"},
+		{"client secret alone", map[string]string{clientSecretEnv: "client-secret"}, nil, false, "", "client-secret"},
+		{"empty secret env", map[string]string{writeSecretEnv: "\n"}, nil, true, "", ""},
+		{"empty client secret env", map[string]string{clientSecretEnv: ""}, nil, true, "", ""},
+		{"missing secret file", nil, []string{"-write-secret-file", filepath.Join(dir, "missing")}, true, "", ""},
+		{"empty secret file", nil, []string{"-write-secret-file", emptyFile}, true, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// t.Setenv restores the variables, which are then unset for
+			// the cases that don't set them
+			t.Setenv(writeSecretEnv, "")
+			t.Setenv(clientSecretEnv, "")
+			os.Unsetenv(writeSecretEnv)
+			os.Unsetenv(clientSecretEnv)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			err := configureForTest(t, tt.args...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("configure(%q) = %v, want error %t", tt.args, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if string(writeSecret) != tt.writeSecret {
+				t.Errorf("write secret %q, want %q", writeSecret, tt.writeSecret)
+			}
+			if string(clientSecret) != tt.clientSecret {
+				t.Errorf("client secret %q, want %q", clientSecret, tt.clientSecret)
+			}
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The benchmarks in bench_test.go cover the backends, the handler hot path
+// and serialization. testdata/bench/baseline.txt holds a run of them made
+// with
+//
+//	go test -run '^$' -bench . -benchmem -count 5 > testdata/bench/baseline.txt
+//
+// and "ts_store bench compare" checks a new run against it, so a release
+// can't quietly allocate more. Allocations don't depend on the machine, the
+// time per operation does: it is only reported, unless -gate-time is given
+// for two runs made on the same host, e.g. of the base and the head of a
+// change in one CI job.
+
+// benchResult holds the runs of one benchmark
+type benchResult struct {
+	nsPerOp     []float64
+	bytesPerOp  []float64
+	allocsPerOp []float64
+}
+
+// the -N GOMAXPROCS suffix is dropped so runs on different machines compare
+var benchLine = regexp.MustCompile(`^(Benchmark\S+?)(?:-\d+)?\s+\d+\s+(.*)$`)
+
+// parseBench reads `go test -bench` output, ignoring everything that isn't a
+// benchmark result
+func parseBench(r io.Reader) (map[string]*benchResult, error) {
+	results := map[string]*benchResult{}
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		m := benchLine.FindStringSubmatch(sc.Text())
+		if m == nil {
+			continue
+		}
+		res := results[m[1]]
+		if res == nil {
+			res = &benchResult{}
+			results[m[1]] = res
+		}
+		fields := strings.Fields(m[2])
+		for i := 0; i+1 < len(fields); i += 2 {
+			v, err := strconv.ParseFloat(fields[i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid benchmark line %q", sc.Text())
+			}
+			switch fields[i+1] {
+			case "ns/op":
+				res.nsPerOp = append(res.nsPerOp, v)
+			case "B/op":
+				res.bytesPerOp = append(res.bytesPerOp, v)
+			case "allocs/op":
+				res.allocsPerOp = append(res.allocsPerOp, v)
+			}
+		}
+	}
+	return results, sc.Err()
+}
+
+// median is robust against the odd slow run, it returns 0 for no values
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+// benchBytesSlack is the growth in B/op tolerated, amortized allocations like
+// a buffer growing now and then move it by a few bytes between runs
+const benchBytesSlack = 0.05
+
+type benchDelta struct {
+	name                 string
+	oldNs, newNs         float64
+	oldBytes, newBytes   float64
+	oldAllocs, newAllocs float64
+	// slower is set when the time per operation grew by more than the
+	// threshold, the others when the benchmark allocates more
+	slower, bytesGrown, allocsGrown bool
+}
+
+// regressed reports whether d fails the comparison, slowdowns only counting
+// with gateTime
+func (d benchDelta) regressed(gateTime bool) bool {
+	return d.allocsGrown || d.bytesGrown || (gateTime && d.slower)
+}
+
+// compareBench compares the medians of every benchmark present in both runs.
+// A benchmark is slower when its time per operation grew by more than
+// threshold, a fraction.
+func compareBench(baseline, current map[string]*benchResult, threshold float64) []benchDelta {
+	var deltas []benchDelta
+	for name, old := range baseline {
+		cur, ok := current[name]
+		if !ok {
+			continue
+		}
+		d := benchDelta{
+			name:      name,
+			oldNs:     median(old.nsPerOp),
+			newNs:     median(cur.nsPerOp),
+			oldBytes:  median(old.bytesPerOp),
+			newBytes:  median(cur.bytesPerOp),
+			oldAllocs: median(old.allocsPerOp),
+			newAllocs: median(cur.allocsPerOp),
+		}
+		d.slower = d.oldNs > 0 && d.newNs > d.oldNs*(1+threshold)
+		d.bytesGrown = len(old.bytesPerOp) > 0 && len(cur.bytesPerOp) > 0 && d.newBytes > d.oldBytes*(1+benchBytesSlack)
+		d.allocsGrown = len(old.allocsPerOp) > 0 && len(cur.allocsPerOp) > 0 && d.newAllocs > d.oldAllocs
+		deltas = append(deltas, d)
+	}
+	sort.Slice(deltas, func(i, j int) bool { return deltas[i].name < deltas[j].name })
+	return deltas
+}
+
+func readBenchFile(path string) (map[string]*benchResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseBench(f)
+}
+
+// runBench implements "ts_store bench compare -baseline old.txt new.txt". It
+// prints how every benchmark changed and fails if any allocates more, or with
+// -gate-time got slower.
+func runBench(args []string, out io.Writer) error {
+	if len(args) == 0 || args[0] != "compare" {
+		return errors.New("usage: bench compare [-baseline file] [-threshold fraction] [-gate-time] results")
+	}
+	flags := flag.NewFlagSet("bench compare", flag.ContinueOnError)
+	baselineFile := flags.String("baseline", "testdata/bench/baseline.txt", "benchmark results to compare against")
+	threshold := flags.Float64("threshold", 0.1, "slowdown tolerated before a benchmark counts as slower, 0.1 is 10%")
+	gateTime := flags.Bool("gate-time", false, "fail on slower benchmarks too, only meaningful when both runs were made on the same host")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("bench compare needs exactly one results file")
+	}
+	baseline, err := readBenchFile(*baselineFile)
+	if err != nil {
+		return fmt.Errorf("could not read baseline: %w", err)
+	}
+	current, err := readBenchFile(flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("could not read results: %w", err)
+	}
+
+	deltas := compareBench(baseline, current, *threshold)
+	if len(deltas) == 0 {
+		return errors.New("no benchmarks in common with the baseline")
+	}
+	regressions := 0
+	for _, d := range deltas {
+		verdict := ""
+		if d.slower {
+			verdict = "  SLOWER"
+		}
+		if d.bytesGrown {
+			verdict += fmt.Sprintf("  B/OP %g -> %g", d.oldBytes, d.newBytes)
+		}
+		if d.allocsGrown {
+			verdict += fmt.Sprintf("  ALLOCS %g -> %g", d.oldAllocs, d.newAllocs)
+		}
+		if d.regressed(*gateTime) {
+			verdict += "  REGRESSED"
+			regressions++
+		}
+		fmt.Fprintf(out, "%-50s %12.1f ns/op %12.1f ns/op %+7.1f%%%s\n", d.name, d.oldNs, d.newNs, (d.newNs/d.oldNs-1)*100, verdict)
+	}
+	if regressions > 0 {
+		return fmt.Errorf("%d of %d benchmarks regressed", regressions, len(deltas))
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func BenchmarkStore(b *testing.B) {
+	for _, name := range []string{"memory", "file", "bolt", "sqlite", "wal"} {
+		b.Run(name, func(b *testing.B) {
+			s, err := OpenStore(name, filepath.Join(b.TempDir(), "data"))
+			if err != nil {
+				b.Fatalf("could not open %s: %v", name, err)
+			}
+			if c, ok := s.(io.Closer); ok {
+				defer c.Close()
+			}
+			b.Run("Set", func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					ts := time.Unix(int64(i), 0)
+					if err := s.Set(&ts); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+			b.Run("Get", func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					if _, err := s.Get(); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkUpdateHandler(b *testing.B) {
+	defer resetStore()
+	defer silenceStdout(b)()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		req := httptest.NewRequest(http.MethodPut, apiPrefix+putPath, strings.NewReader("1700000000"))
+		req.Header.Set("Content-Type", contentTypeText)
+		w := httptest.NewRecorder()
+		update(w, req)
+		if w.Code != http.StatusOK {
+			b.Fatalf("unexpected status: %d", w.Code)
+		}
+	}
+}
+
+// silenceStdout discards the per-write log lines, which would otherwise end
+// up in the middle of the benchmark results, until the returned function
+// is called
+func silenceStdout(b *testing.B) func() {
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = devNull
+	return func() {
+		os.Stdout = stdout
+		devNull.Close()
+	}
+}
+
+func BenchmarkRetrieveHandler(b *testing.B) {
+	defer resetStore()
+	ts := time.Unix(1700000000, 0)
+	th.Set(&ts)
+	for _, accept := range []string{contentTypeText, contentTypeJSON} {
+		b.Run(accept, func(b *testing.B) {
+			req := httptest.NewRequest(http.MethodGet, apiPrefix+getPath, nil)
+			req.Header.Set("Accept", accept)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				retrieve(httptest.NewRecorder(), req)
+			}
+		})
+	}
+}
+
+func BenchmarkParseTimestamp(b *testing.B) {
+	for _, test := range []struct{ contentType, body string }{
+		{contentTypeText, "1700000000"},
+		{contentTypeText, "2023-11-14T22:13:20Z"},
+		{contentTypeJSON, `{"timestamp":1700000000}`},
+	} {
+		b.Run(test.body, func(b *testing.B) {
+			data := []byte(test.body)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := parseTimestamp(test.contentType, data, time.Second); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkEncodeState(b *testing.B) {
+	ts := time.Unix(1700000000, 123456789)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := decodeState(encodeState(ts, time.Time{})); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestCompareBench(t *testing.T) {
+	baseline, err := parseBench(strings.NewReader(`goos: linux
+BenchmarkA-8   	 1000	      100 ns/op	      16 B/op	       1 allocs/op
+BenchmarkA-8   	 1000	      300 ns/op	      16 B/op	       1 allocs/op
+BenchmarkA-8   	 1000	      110 ns/op	      16 B/op	       1 allocs/op
+BenchmarkB/sub-8 	 1000	      100 ns/op
+BenchmarkC-8   	 1000	      100 ns/op	      16 B/op	       1 allocs/op
+BenchmarkD-8   	 1000	      100 ns/op	     100 B/op	       1 allocs/op
+BenchmarkE-8   	 1000	      100 ns/op	     100 B/op	       1 allocs/op
+BenchmarkGone-8	 1000	      100 ns/op
+PASS
+`))
+	if err != nil {
+		t.Fatalf("could not parse baseline: %v", err)
+	}
+	if got := median(baseline["BenchmarkA"].nsPerOp); got != 110 {
+		t.Errorf("expected the median to ignore the outlier, got: %g", got)
+	}
+	current, err := parseBench(strings.NewReader(`BenchmarkA-16	 1000	      115 ns/op	      16 B/op	       1 allocs/op
+BenchmarkB/sub-16	 1000	      150 ns/op
+BenchmarkC-16	 1000	      100 ns/op	      32 B/op	       2 allocs/op
+BenchmarkD-16	 1000	      100 ns/op	     128 B/op	       1 allocs/op
+BenchmarkE-16	 1000	      100 ns/op	     104 B/op	       1 allocs/op
+BenchmarkNew-16	 1000	      100 ns/op
+`))
+	if err != nil {
+		t.Fatalf("could not parse results: %v", err)
+	}
+
+	deltas := compareBench(baseline, current, 0.1)
+	expected := []struct {
+		name                            string
+		slower, bytesGrown, allocsGrown bool
+	}{
+		{"BenchmarkA", false, false, false},
+		{"BenchmarkB/sub", true, false, false},
+		{"BenchmarkC", false, true, true},
+		{"BenchmarkD", false, true, false},
+		// within benchBytesSlack
+		{"BenchmarkE", false, false, false},
+	}
+	if len(deltas) != len(expected) {
+		t.Fatalf("expected %d benchmarks compared, got: %+v", len(expected), deltas)
+	}
+	for i, e := range expected {
+		d := deltas[i]
+		if d.name != e.name || d.slower != e.slower || d.bytesGrown != e.bytesGrown || d.allocsGrown != e.allocsGrown {
+			t.Errorf("expected %+v, got: %+v", e, d)
+		}
+	}
+}
+
+func TestRunBench(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	baseline := write("baseline.txt", "BenchmarkA-8	1000	100 ns/op	16 B/op	1 allocs/op\n")
+	same := write("same.txt", "BenchmarkA-8	1000	105 ns/op	16 B/op	1 allocs/op\n")
+	slower := write("slower.txt", "BenchmarkA-8	1000	200 ns/op	16 B/op	1 allocs/op\n")
+	allocating := write("allocating.txt", "BenchmarkA-8	1000	100 ns/op	32 B/op	2 allocs/op\n")
+
+	var out bytes.Buffer
+	if err := runBench([]string{"compare", "-baseline", baseline, same}, &out); err != nil {
+		t.Errorf("expected no regression, got: %v", err)
+	}
+	if !strings.Contains(out.String(), "BenchmarkA") {
+		t.Errorf("expected a report, got: %s", out.String())
+	}
+	out.Reset()
+	if err := runBench([]string{"compare", "-baseline", baseline, slower}, &out); err != nil {
+		t.Errorf("expected a slowdown to be reported only, got: %v", err)
+	}
+	if !strings.Contains(out.String(), "SLOWER") {
+		t.Errorf("expected the slowdown in the report, got: %s", out.String())
+	}
+	if err := runBench([]string{"compare", "-baseline", baseline, "-gate-time", slower}, io.Discard); err == nil {
+		t.Error("expected a slowdown to fail the comparison with -gate-time")
+	}
+	if err := runBench([]string{"compare", "-baseline", baseline, "-gate-time", "-threshold", "1.5", slower}, io.Discard); err != nil {
+		t.Errorf("expected the threshold to tolerate the slowdown, got: %v", err)
+	}
+	if err := runBench([]string{"compare", "-baseline", baseline, allocating}, io.Discard); err == nil {
+		t.Error("expected more allocations to fail the comparison")
+	}
+	if err := runBench([]string{"run"}, io.Discard); err == nil {
+		t.Error("expected an unknown bench command to fail")
+	}
+}
+
+// the committed baseline must stay readable by bench compare
+func TestBenchBaseline(t *testing.T) {
+	results, err := readBenchFile(filepath.Join("testdata", "bench", "baseline.txt"))
+	if err != nil {
+		t.Fatalf("could not read baseline: %v", err)
+	}
+	if len(results) == 0 {
+		t.Error("baseline holds no benchmarks")
+	}
+	// bench compare gates on allocations, which the baseline must record
+	for name, res := range results {
+		if len(res.bytesPerOp) == 0 || len(res.allocsPerOp) == 0 {
+			t.Errorf("baseline has no allocations for %s, run it with -benchmem", name)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	boltNamespace    = "default"
+	boltTimestampKey = "timestamp"
+	// the deadline of a value with a TTL, absent for none
+	boltExpiresAtKey = "expires_at"
+	boltOpenTimeout  = time.Second
+)
+
+func init() {
+	RegisterBackend("bolt", func(location string) (Store, error) {
+		if location == "" {
+			return nil, errors.New("bolt backend requires a database file")
+		}
+		return openBoltStore(location, boltNamespace)
+	})
+}
+
+// boltStore keeps values in a bbolt database, one bucket per namespace with
+// the value stored under its name. Every write is its own transaction.
+type boltStore struct {
+	db        *bolt.DB
+	namespace []byte
+}
+
+func openBoltStore(path, namespace string) (*boltStore, error) {
+	// the timeout stops a second instance from hanging on the file lock
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: boltOpenTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("could not open bolt database: %w", err)
+	}
+	s := &boltStore{db: db, namespace: []byte(namespace)}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(s.namespace)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not create bucket %s: %w", namespace, err)
+	}
+	return s, nil
+}
+
+func (s *boltStore) Set(ts *time.Time) error {
+	return s.SetExpiring(ts, time.Time{})
+}
+
+// SetExpiring writes the value and its deadline in one transaction
+func (s *boltStore) SetExpiring(ts *time.Time, expiresAt time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.namespace)
+		if ts == nil || expiresAt.IsZero() {
+			if err := b.Delete([]byte(boltExpiresAtKey)); err != nil {
+				return err
+			}
+		} else if err := b.Put([]byte(boltExpiresAtKey), encodeBoltValue(expiresAt)); err != nil {
+			return err
+		}
+		if ts == nil {
+			return b.Delete([]byte(boltTimestampKey))
+		}
+		return b.Put([]byte(boltTimestampKey), encodeBoltValue(*ts))
+	})
+}
+
+func (s *boltStore) Expiry() (time.Time, error) {
+	var expiresAt time.Time
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(s.namespace).Get([]byte(boltExpiresAtKey))
+		if v == nil {
+			return nil
+		}
+		var err error
+		expiresAt, err = decodeBoltValue(v)
+		return err
+	})
+	return expiresAt, err
+}
+
+func (s *boltStore) Get() (time.Time, error) {
+	ts := time.Unix(0, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(s.namespace).Get([]byte(boltTimestampKey))
+		if v == nil {
+			return nil
+		}
+		var err error
+		ts, err = decodeBoltValue(v)
+		return err
+	})
+	return ts, err
+}
+
+// values are the seconds as 8 bytes big-endian, followed by 4 bytes of
+// nanoseconds only when the value has sub-second precision
+func encodeBoltValue(ts time.Time) []byte {
+	v := make([]byte, 8, 12)
+	binary.BigEndian.PutUint64(v, uint64(ts.Unix()))
+	if ts.Nanosecond() != 0 {
+		v = binary.BigEndian.AppendUint32(v, uint32(ts.Nanosecond()))
+	}
+	return v
+}
+
+func decodeBoltValue(v []byte) (time.Time, error) {
+	switch len(v) {
+	case 8:
+		return time.Unix(int64(binary.BigEndian.Uint64(v)), 0), nil
+	case 12:
+		return time.Unix(int64(binary.BigEndian.Uint64(v)), int64(binary.BigEndian.Uint32(v[8:]))), nil
+	default:
+		return time.Time{}, fmt.Errorf("corrupt value for %s: %d bytes", boltTimestampKey, len(v))
+	}
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *boltStore) Durable() bool {
+	return true
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestBoltStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ts.db")
+	s, err := openBoltStore(path, boltNamespace)
+	if err != nil {
+		t.Fatalf("could not open bolt store: %v", err)
+	}
+	if got := mustGet(t, s).Unix(); got != 0 {
+		t.Errorf("empty store should return 0, got: %d", got)
+	}
+	ts := time.Unix(1234567, 0)
+	if err := s.Set(&ts); err != nil {
+		t.Fatalf("could not store: %v", err)
+	}
+	s.Close()
+
+	s, err = openBoltStore(path, boltNamespace)
+	if err != nil {
+		t.Fatalf("could not reopen bolt store: %v", err)
+	}
+	if got := mustGet(t, s).Unix(); got != 1234567 {
+		t.Errorf("value was not persisted, got: %d", got)
+	}
+
+	// namespaces don't see each other's values
+	other, err := openBoltStore(filepath.Join(t.TempDir(), "other.db"), "other")
+	if err != nil {
+		t.Fatalf("could not open bolt store: %v", err)
+	}
+	defer other.Close()
+	if got := mustGet(t, other).Unix(); got != 0 {
+		t.Errorf("expected empty namespace, got: %d", got)
+	}
+
+	precise := time.Unix(1234567, 890)
+	if err := s.Set(&precise); err != nil {
+		t.Fatalf("could not store: %v", err)
+	}
+	if got := mustGet(t, s); !got.Equal(precise) {
+		t.Errorf("expected sub-second precision to be kept, got: %s", got)
+	}
+
+	if err := s.Set(nil); err != nil {
+		t.Fatalf("could not reset: %v", err)
+	}
+	if got := mustGet(t, s).Unix(); got != 0 {
+		t.Errorf("expected reset value, got: %d", got)
+	}
+
+	// a corrupt value is reported instead of served
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.namespace).Put([]byte(boltTimestampKey), []byte("x"))
+	})
+	if err != nil {
+		t.Fatalf("could not corrupt value: %v", err)
+	}
+	if _, err := s.Get(); err == nil {
+		t.Error("expected an error for a corrupt value")
+	}
+	s.Close()
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultUserAgent = "ts_store-client"
+	writerIDHeader   = "X-Writer-Id"
+)
+
+// writerID identifies this client instance on every write. It defaults to
+// hostname/pid/random-instance-id and can be overridden for stable names.
+var writerID = defaultWriterID()
+
+func defaultWriterID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	instance := make([]byte, 4)
+	if _, err := rand.Read(instance); err != nil {
+		log(os.Stderr, "could not generate instance id: %s\n", err.Error())
+	}
+	return fmt.Sprintf("%s/%d/%s", host, os.Getpid(), hex.EncodeToString(instance))
+}
+
+// doRequest sends req with the shared client. When the request's context has
+// a deadline it replaces the client's timeout, so a caller can give a request
+// more or less time than the default, and running out of it is reported as
+// the context's error rather than the client's timeout error.
+func doRequest(req *http.Request) (*http.Response, error) {
+	c := client
+	if _, ok := req.Context().Deadline(); ok {
+		withoutTimeout := *client
+		withoutTimeout.Timeout = 0
+		c = &withoutTimeout
+	}
+	rsp, err := c.Do(req)
+	if err != nil && req.Context().Err() != nil {
+		return nil, req.Context().Err()
+	}
+	return rsp, err
+}
+
+// roundTripFunc lets a function act as an http.RoundTripper
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// headerTransport sets the configured User-Agent and default headers on every
+// outgoing request, so the server can tell callers apart
+type headerTransport struct {
+	base      http.RoundTripper
+	userAgent string
+	headers   http.Header
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// a RoundTripper must not modify the caller's request
+	req = req.Clone(req.Context())
+	for k, v := range t.headers {
+		if _, ok := req.Header[k]; !ok {
+			req.Header[k] = v
+		}
+	}
+	if t.userAgent != "" && req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", t.userAgent)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// configureClientHeaders sets the User-Agent (e.g. "billing-agent/1.4.2") and
+// the headers sent with every request made by client. Headers set on a
+// request explicitly take precedence over the defaults.
+func configureClientHeaders(userAgent string, headers http.Header) {
+	if userAgent == "" {
+		userAgent = defaultUserAgent
+	}
+	client.Transport = &headerTransport{
+		base:      http.DefaultTransport,
+		userAgent: userAgent,
+		headers:   headers.Clone(),
+	}
+}
+
+// offline write buffering
+//
+// When writeBufferFile is set, writes that fail because the server is
+// unreachable or erroring are kept on disk and replayed later. Only the latest
+// value is kept, as any later write supersedes an earlier one. main enables
+// it with -write-buffer and replays every -write-buffer-interval.
+var (
+	writeBufferFile string
+	writeBufferMu   sync.Mutex
+
+	writeBufferPath     = flag.String("write-buffer", "", "file keeping the client's last write the server was unavailable for, replayed until delivered, disabled if empty")
+	writeBufferInterval = flag.Duration("write-buffer-interval", 10*time.Second, "how often the write kept in -write-buffer is replayed")
+)
+
+var errServerUnavailable = errors.New("server unavailable")
+
+func enableWriteBuffer(path string) {
+	writeBufferMu.Lock()
+	defer writeBufferMu.Unlock()
+	writeBufferFile = path
+}
+
+// keepForReplay buffers ts if the buffer is enabled, and reports whether it is
+func keepForReplay(ts string) bool {
+	writeBufferMu.Lock()
+	defer writeBufferMu.Unlock()
+	if writeBufferFile == "" {
+		return false
+	}
+	bufferWrite(ts)
+	return true
+}
+
+// writeDelivered drops the buffered write superseded by a delivered one
+func writeDelivered() {
+	writeBufferMu.Lock()
+	defer writeBufferMu.Unlock()
+	discardBufferedWrite()
+}
+
+// bufferWrite must be called with writeBufferMu held
+func bufferWrite(ts string) {
+	if writeBufferFile == "" {
+		return
+	}
+	tmp := writeBufferFile + ".tmp"
+	if err := os.WriteFile(tmp, []byte(ts), 0o600); err != nil {
+		log(os.Stderr, "could not buffer write: %s\n", err.Error())
+		return
+	}
+	if err := os.Rename(tmp, writeBufferFile); err != nil {
+		log(os.Stderr, "could not buffer write: %s\n", err.Error())
+	}
+}
+
+// discardBufferedWrite must be called with writeBufferMu held
+func discardBufferedWrite() {
+	if writeBufferFile == "" {
+		return
+	}
+	if err := os.Remove(writeBufferFile); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log(os.Stderr, "could not remove buffered write: %s\n", err.Error())
+	}
+}
+
+// replayBufferedWrite delivers the buffered write, if there is one. The buffer
+// is kept if the server is still unavailable, and dropped once the server has
+// answered, even if it rejected the value, since it would never be accepted.
+func replayBufferedWrite(ctx context.Context) error {
+	writeBufferMu.Lock()
+	defer writeBufferMu.Unlock()
+	if writeBufferFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(writeBufferFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	rsp, err := doPut(ctx, string(data))
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("%w: %s", errServerUnavailable, rsp.Status)
+	}
+	if rsp.StatusCode != http.StatusOK {
+		log(os.Stderr, "dropping buffered write rejected by server: %s\n", rsp.Status)
+	}
+	discardBufferedWrite()
+	return nil
+}
+
+// replayWriteBuffer retries the buffered write every interval until ctx is done
+func replayWriteBuffer(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := replayBufferedWrite(ctx); err != nil && ctx.Err() == nil {
+				log(os.Stderr, "could not replay buffered write: %s\n", err.Error())
+			}
+		}
+	}
+}
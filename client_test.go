@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigureClientHeaders(t *testing.T) {
+	defer initClient(defaultTimeout)
+
+	var got http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	defer srv.Close()
+
+	doReq := func(set map[string]string) {
+		req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+		if err != nil {
+			t.Fatalf("could not create request: %v", err)
+		}
+		for k, v := range set {
+			req.Header.Set(k, v)
+		}
+		rsp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		rsp.Body.Close()
+	}
+
+	doReq(nil)
+	if ua := got.Get("User-Agent"); ua != defaultUserAgent {
+		t.Errorf("expected default user agent, got: %s", ua)
+	}
+
+	configureClientHeaders("billing-agent/1.4.2", http.Header{"X-Team": []string{"payments"}})
+	doReq(nil)
+	if ua := got.Get("User-Agent"); ua != "billing-agent/1.4.2" {
+		t.Errorf("unexpected user agent: %s", ua)
+	}
+	if team := got.Get("X-Team"); team != "payments" {
+		t.Errorf("default header not sent, got: %s", team)
+	}
+
+	doReq(map[string]string{"X-Team": "search"})
+	if team := got.Get("X-Team"); team != "search" {
+		t.Errorf("explicit header should win over default, got: %s", team)
+	}
+
+	doReq(map[string]string{"User-Agent": "probe/2.0"})
+	if ua := got.Get("User-Agent"); ua != "probe/2.0" {
+		t.Errorf("explicit user agent should win over default, got: %s", ua)
+	}
+}
+
+func TestWriteBuffer(t *testing.T) {
+	defer resetStore()
+	path := filepath.Join(t.TempDir(), "pending")
+	enableWriteBuffer(path)
+	defer enableWriteBuffer("")
+
+	// nothing is listening yet, so the write has to be buffered
+	makePutReq("41")
+	makePutReq("42")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("write was not buffered: %v", err)
+	}
+	if string(data) != "42" {
+		t.Errorf("expected only the latest write to be buffered, got: %s", string(data))
+	}
+
+	initServer(defaultTimeout)
+	defer initServer(defaultTimeout)
+	go startHTTPServer()
+	defer stopHttpServer()
+	waitForServer(t)
+
+	if err := replayBufferedWrite(context.Background()); err != nil {
+		t.Fatalf("could not replay buffered write: %v", err)
+	}
+	if mustGet(t, th).Unix() != 42 {
+		t.Errorf("buffered write was not delivered, stored: %d", mustGet(t, th).Unix())
+	}
+	if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("buffer should be removed after replay, stat: %v", err)
+	}
+}
+
+func waitForServer(t *testing.T) {
+	t.Helper()
+	for i := 0; i < 50; i++ {
+		rsp, err := http.Get(getRetrievePath())
+		if err == nil {
+			rsp.Body.Close()
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("server did not come up")
+}
+
+func TestWriterID(t *testing.T) {
+	defer initClient(defaultTimeout)
+
+	host, _ := os.Hostname()
+	prefix := fmt.Sprintf("%s/%d/", host, os.Getpid())
+	id := defaultWriterID()
+	if !strings.HasPrefix(id, prefix) {
+		t.Errorf("expected writer id to start with %s, got: %s", prefix, id)
+	}
+	if id == defaultWriterID() {
+		t.Error("instance part of writer id should differ between instances")
+	}
+
+	var got string
+	client.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		got = req.Header.Get(writerIDHeader)
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(""))}, nil
+	})
+	makePutReq("1")
+	if got != writerID {
+		t.Errorf("expected writer id %s to be sent, got: %s", writerID, got)
+	}
+}
+
+func TestContextDeadline(t *testing.T) {
+	defer initClient(defaultTimeout)
+
+	tests := []struct {
+		description   string
+		clientTimeout time.Duration
+		ctxTimeout    time.Duration
+		expectOK      bool
+		expectCtxErr  bool
+	}{
+		{"deadline shorter than client timeout", 5 * time.Second, 50 * time.Millisecond, false, true},
+		{"deadline longer than client timeout", 50 * time.Millisecond, 5 * time.Second, true, false},
+		{"no deadline", 50 * time.Millisecond, 0, false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			initClient(test.clientTimeout)
+			client.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				select {
+				case <-time.After(200 * time.Millisecond):
+					return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("42"))}, nil
+				case <-req.Context().Done():
+					return nil, req.Context().Err()
+				}
+			})
+			ctx := context.Background()
+			if test.ctxTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, test.ctxTimeout)
+				defer cancel()
+			}
+			ts, err := getTimestamp(ctx)
+			if test.expectOK {
+				if err != nil || ts != "42" {
+					t.Errorf("expected 42, got: %q, %v", ts, err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if test.expectCtxErr && !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("expected context.DeadlineExceeded, got: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+const (
+	maxDecompressionRatio = 20
+	// small payloads compress poorly or not at all, the ratio is only
+	// meaningful once a body has grown past this size
+	ratioCheckFloor = 256
+)
+
+var errDecompressionLimit = errors.New("decompressed body exceeds limits")
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// boundedReader stops decompression as soon as the output grows past
+// maxReqBytes or the compression ratio becomes suspicious
+type boundedReader struct {
+	compressed *countingReader
+	r          io.Reader
+	n          int64
+}
+
+func (b *boundedReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.n += int64(n)
+	if b.n > maxReqBytes {
+		return n, errDecompressionLimit
+	}
+	if b.n > ratioCheckFloor && b.compressed.n > 0 && b.n/b.compressed.n > maxDecompressionRatio {
+		return n, errDecompressionLimit
+	}
+	return n, err
+}
+
+// decodeBody wraps r.Body according to its Content-Encoding
+func decodeBody(r *http.Request) (io.Reader, error) {
+	switch enc := r.Header.Get("Content-Encoding"); enc {
+	case "", "identity":
+		return r.Body, nil
+	case "gzip":
+		compressed := &countingReader{r: r.Body}
+		zr, err := gzip.NewReader(compressed)
+		if err != nil {
+			return nil, err
+		}
+		return &boundedReader{compressed: compressed, r: zr}, nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding: %s", enc)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func gzipped(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		t.Fatalf("could not compress: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("could not compress: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestCompressedUpdate(t *testing.T) {
+	defer resetStore()
+
+	type tc struct {
+		description        string
+		encoding           string
+		body               []byte
+		expectedStatusCode int
+	}
+	testCases := []tc{
+		{"gzip OK", "gzip", gzipped(t, []byte("1234567")), http.StatusOK},
+		{"identity OK", "identity", []byte("1234567"), http.StatusOK},
+		{"gzip bomb", "gzip", gzipped(t, make([]byte, 64*maxReqBytes)), http.StatusRequestEntityTooLarge},
+		{"just over the limit", "gzip", gzipped(t, bytes.Repeat([]byte("1"), int(maxReqBytes)+1)), http.StatusRequestEntityTooLarge},
+		{"corrupt gzip", "gzip", []byte("1234567"), http.StatusUnsupportedMediaType},
+		{"unsupported encoding", "br", []byte("1234567"), http.StatusUnsupportedMediaType},
+	}
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPut, getStorePath(), bytes.NewReader(test.body))
+			req.Header.Set("Content-Type", "text/plain")
+			req.Header.Set("Content-Encoding", test.encoding)
+			w := httptest.NewRecorder()
+			update(w, req)
+			if w.Code != test.expectedStatusCode {
+				t.Errorf("expected status code to be %d, got: %d", test.expectedStatusCode, w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Destructive admin actions, resetting the value and removing a webhook, can
+// be previewed with ?dry_run=true. The dry run changes nothing and answers
+// what the request would do along with a single-use token; repeating the
+// request with the token in X-Confirm-Token carries it out. A token only
+// confirms the action it was issued for, so if the value changed since the
+// dry run the reset is refused rather than clearing something the operator
+// never saw. With -confirm-destructive the token is required.
+const (
+	dryRunParam      = "dry_run"
+	confirmHeader    = "X-Confirm-Token"
+	confirmTokenTTL  = time.Minute
+	confirmTokenSize = 16
+)
+
+var requireConfirm = flag.Bool("confirm-destructive", false, "require a token from a ?dry_run=true request before resetting the value or removing a webhook")
+
+var errInvalidConfirmToken = errors.New("confirm token is invalid, expired or was issued for another action, do a new dry run")
+
+type dryRun struct {
+	Action    string    `json:"action"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type confirmTokens struct {
+	mu      sync.Mutex
+	pending map[string]dryRun
+}
+
+var confirmations = &confirmTokens{pending: make(map[string]dryRun)}
+
+func (c *confirmTokens) issue(action string, at time.Time) (dryRun, error) {
+	b := make([]byte, confirmTokenSize)
+	if _, err := rand.Read(b); err != nil {
+		return dryRun{}, err
+	}
+	d := dryRun{Action: action, Token: hex.EncodeToString(b), ExpiresAt: at.Add(confirmTokenTTL)}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for token, p := range c.pending {
+		if !at.Before(p.ExpiresAt) {
+			delete(c.pending, token)
+		}
+	}
+	c.pending[d.Token] = d
+	return d, nil
+}
+
+// take uses up token, reporting whether it was issued for action and is
+// still valid
+func (c *confirmTokens) take(token, action string, at time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d, ok := c.pending[token]
+	if !ok {
+		return false
+	}
+	delete(c.pending, token)
+	return d.Action == action && at.Before(d.ExpiresAt)
+}
+
+// confirmDestructive answers dry runs of action and checks confirm tokens. It
+// reports whether the handler should carry out the action; if not, the
+// response has been written.
+func confirmDestructive(w http.ResponseWriter, r *http.Request, action string) bool {
+	if v := queryParam(r, dryRunParam); v != "" {
+		dry, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, dryRunParam+" must be true or false", http.StatusBadRequest)
+			return false
+		}
+		if dry {
+			d, err := confirmations.issue(action, now())
+			if err != nil {
+				http.Error(w, "could not issue confirm token", http.StatusInternalServerError)
+				return false
+			}
+			w.Header().Set("Content-Type", contentTypeJSON)
+			json.NewEncoder(w).Encode(d)
+			return false
+		}
+	}
+	if token := r.Header.Get(confirmHeader); token != "" {
+		if !confirmations.take(token, action, now()) {
+			http.Error(w, errInvalidConfirmToken.Error(), http.StatusConflict)
+			return false
+		}
+		return true
+	}
+	if *requireConfirm {
+		http.Error(w, "this action must be confirmed with the "+confirmHeader+" of a ?"+dryRunParam+"=true request", http.StatusPreconditionRequired)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConfirmedReset(t *testing.T) {
+	defer resetStore()
+	defer func(v bool) { *requireConfirm = v }(*requireConfirm)
+	*requireConfirm = true
+
+	store := func(v int64) {
+		ts := time.Unix(v, 0)
+		th.Set(&ts)
+	}
+	dryRunReset := func() dryRun {
+		w := httptest.NewRecorder()
+		update(w, httptest.NewRequest(http.MethodDelete, getStorePath()+"?dry_run=true", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected dry run to succeed, got: %d %s", w.Code, w.Body.String())
+		}
+		var d dryRun
+		if err := json.Unmarshal(w.Body.Bytes(), &d); err != nil {
+			t.Fatalf("invalid dry run response %q: %v", w.Body.String(), err)
+		}
+		return d
+	}
+	deleteWith := func(token string) int {
+		req := httptest.NewRequest(http.MethodDelete, getStorePath(), nil)
+		if token != "" {
+			req.Header.Set(confirmHeader, token)
+		}
+		w := httptest.NewRecorder()
+		update(w, req)
+		return w.Code
+	}
+
+	store(42)
+	d := dryRunReset()
+	if d.Action != "clear stored timestamp 42" {
+		t.Errorf("unexpected action: %q", d.Action)
+	}
+	if mustGet(t, th).Unix() != 42 {
+		t.Fatal("expected the dry run to leave the value")
+	}
+	if code := deleteWith(""); code != http.StatusPreconditionRequired {
+		t.Errorf("expected %d without a token, got: %d", http.StatusPreconditionRequired, code)
+	}
+	if code := deleteWith(d.Token); code != http.StatusNoContent {
+		t.Fatalf("expected the confirmed reset to succeed, got: %d", code)
+	}
+	if mustGet(t, th).Unix() != 0 {
+		t.Error("expected the value to be cleared")
+	}
+	if code := deleteWith(d.Token); code != http.StatusConflict {
+		t.Errorf("expected a used token to be refused with %d, got: %d", http.StatusConflict, code)
+	}
+
+	// the value changed since the dry run, which no longer describes the reset
+	store(42)
+	d = dryRunReset()
+	store(43)
+	if code := deleteWith(d.Token); code != http.StatusConflict {
+		t.Errorf("expected %d, got: %d", http.StatusConflict, code)
+	}
+	if mustGet(t, th).Unix() != 43 {
+		t.Error("expected the newer value to be kept")
+	}
+}
+
+func TestConfirmTokens(t *testing.T) {
+	c := &confirmTokens{pending: make(map[string]dryRun)}
+	at := time.Unix(100, 0)
+	d, err := c.issue("remove webhook a", at)
+	if err != nil {
+		t.Fatalf("could not issue token: %v", err)
+	}
+	if c.take(d.Token, "remove webhook b", at) {
+		t.Error("expected the token to only confirm its own action")
+	}
+	d, _ = c.issue("remove webhook a", at)
+	if c.take(d.Token, "remove webhook a", at.Add(confirmTokenTTL)) {
+		t.Error("expected an expired token to be refused")
+	}
+	d, _ = c.issue("remove webhook a", at)
+	if !c.take(d.Token, "remove webhook a", at.Add(time.Second)) {
+		t.Error("expected the token to confirm its action")
+	}
+}
+
+func TestConfirmedWebhookRemoval(t *testing.T) {
+	defer func(reg *webhookRegistry) { webhooks = reg }(webhooks)
+	defer func(v bool) { *requireConfirm = v }(*requireConfirm)
+	*requireConfirm = true
+	webhooks = newWebhookRegistry(nil, time.Millisecond)
+	defer webhooks.start()()
+	if err := webhooks.add("http://example.com/hook"); err != nil {
+		t.Fatalf("could not add webhook: %v", err)
+	}
+
+	target := apiPrefix + webhooksPath + "?url=http://example.com/hook"
+	w := httptest.NewRecorder()
+	webhooksHandler(w, httptest.NewRequest(http.MethodDelete, target+"&dry_run=true", nil))
+	var d dryRun
+	if err := json.Unmarshal(w.Body.Bytes(), &d); err != nil || d.Action != "remove webhook http://example.com/hook" {
+		t.Fatalf("unexpected dry run response: %d %s", w.Code, w.Body.String())
+	}
+	if !webhooks.has("http://example.com/hook") {
+		t.Fatal("expected the dry run to keep the webhook")
+	}
+	req := httptest.NewRequest(http.MethodDelete, target, nil)
+	req.Header.Set(confirmHeader, d.Token)
+	w = httptest.NewRecorder()
+	webhooksHandler(w, req)
+	if w.Code != http.StatusNoContent || webhooks.has("http://example.com/hook") {
+		t.Errorf("expected the webhook to be removed, got: %d %s", w.Code, w.Body.String())
+	}
+}
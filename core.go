@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// The core applies writes independently of the protocol they arrived over:
+// it validates, authorizes, stores and notifies. A frontend only decodes its
+// requests into a writeOp and maps the result back, so every protocol gets
+// the same rules. HTTP is the only frontend so far; a gRPC or MQTT one would
+// map onto storeWrite and storeReset the same way.
+
+// writeOp is a decoded write
+type writeOp struct {
+	Value  time.Time
+	TTL    time.Duration
+	Writer string
+	// Fence is the fencing token sent with the write, "" for none
+	Fence string
+	// Monotonic rejects the write if it is older than the stored value
+	Monotonic bool
+	Ack       ackLevel
+}
+
+// writeErrorKind classifies why the core refused a write, frontends map it
+// to their own status codes
+type writeErrorKind int
+
+const (
+	writeUnavailableAck writeErrorKind = iota
+	writeConflict
+	writeOutdated
+	writeUnprocessable
+	writeDenied
+	writeUnavailable
+	writeInternal
+	// the request ran out of time before the write was applied
+	writeTimedOut
+)
+
+type writeError struct {
+	kind writeErrorKind
+	msg  string
+	// current is the stored value an outdated write lost to
+	current time.Time
+}
+
+func (e *writeError) Error() string {
+	return e.msg
+}
+
+func newWriteError(kind writeErrorKind, format string, a ...any) *writeError {
+	return &writeError{kind: kind, msg: fmt.Sprintf(format, a...)}
+}
+
+// storeWrite applies op and returns its write ID. Errors are *writeError.
+func storeWrite(ctx context.Context, op writeOp) (string, error) {
+	id, err := applyWrite(ctx, op)
+	countRejection(err)
+	return id, err
+}
+
+// countRejection records why a write was refused for /metrics
+func countRejection(err error) {
+	var we *writeError
+	if errors.As(err, &we) {
+		metrics.reject(rejectionReasons[we.kind])
+	}
+}
+
+func applyWrite(ctx context.Context, op writeOp) (string, error) {
+	// refuse up front rather than store a write the writer won't accept
+	if achievable := storeAckLevel(th); op.Ack > achievable {
+		return "", newWriteError(writeUnavailableAck, "ack level %s is not available, writes reach %s", op.Ack, achievable)
+	}
+	if op.TTL > 0 && !supportsTTL(th) {
+		return "", newWriteError(writeUnprocessable, "ttl is not supported by this backend, it can't keep the deadline across a restart")
+	}
+	value := op.Value
+	if ahead := value.Sub(now()); *maxFuture > 0 && ahead > *maxFuture {
+		log(os.Stderr, "write rejected: timestamp %d is %s ahead of server time\n", value.Unix(), ahead.Round(time.Second))
+		return "", newWriteError(writeUnprocessable, "timestamp is %s ahead of server time, at most %s is allowed", ahead.Round(time.Second), *maxFuture)
+	}
+	value, err := hooks.transformWrite(value, op.Writer)
+	if err != nil {
+		log(os.Stderr, "%s\n", err.Error())
+		return "", newWriteError(writeUnprocessable, "write rejected by script")
+	}
+	if err := validateWrite(ctx, value, op.Writer); err != nil {
+		log(os.Stderr, "write rejected: %s\n", err.Error())
+		if errors.Is(err, errWriteDenied) {
+			return "", newWriteError(writeDenied, "write denied by policy")
+		}
+		return "", newWriteError(writeUnavailable, "could not validate write")
+	}
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	if err := checkFence(op.Fence); err != nil {
+		log(os.Stderr, "write rejected: %s\n", err.Error())
+		return "", newWriteError(writeConflict, "%s", err.Error())
+	}
+	if err := expireIfDue(); err != nil {
+		log(os.Stderr, "could not expire timestamp: %s\n", err.Error())
+	}
+	if op.Monotonic {
+		current, err := th.Get()
+		if err != nil {
+			log(os.Stderr, "could not read timestamp: %s\n", err.Error())
+			return "", newWriteError(writeInternal, "could not read timestamp")
+		}
+		if value.Before(current) {
+			log(os.Stderr, "write rejected: %d is older than the stored %d\n", value.Unix(), current.Unix())
+			return "", &writeError{kind: writeOutdated, msg: "timestamp is older than the stored value", current: current}
+		}
+	}
+	// the client may already have been told the write timed out
+	if !beginCommit(ctx) {
+		log(os.Stderr, "write abandoned, the request timed out\n")
+		return "", newWriteError(writeTimedOut, "request timed out before the write was applied")
+	}
+	if err := storeValue(&value, op.TTL); err != nil {
+		log(os.Stderr, "could not store timestamp: %s\n", err.Error())
+		return "", newWriteError(writeInternal, "could not store timestamp")
+	}
+	updateCadence.observe(now())
+	updateGaps.observe(now())
+	id := newWriteID(now())
+	log(os.Stdout, "stored timestamp %d from writer %q as write %s\n", value.Unix(), op.Writer, id)
+	events.publish(Event{Type: EventValueChanged, ID: id, Value: value, Writer: op.Writer, At: now()})
+	history.record(newHistoryEntry(id, value, op.Writer, now()))
+	totalWrites.Add(1)
+	return id, nil
+}
+
+// storeReset puts the value back to -reset-value, clearing it when that is 0,
+// and returns the write ID. Errors are *writeError.
+func storeReset(ctx context.Context, writer, fence string) (string, error) {
+	id, err := applyReset(ctx, writer, fence)
+	countRejection(err)
+	return id, err
+}
+
+func applyReset(ctx context.Context, writer, fence string) (string, error) {
+	var ts *time.Time
+	if *resetValue > 0 {
+		v := time.Unix(*resetValue, 0)
+		ts = &v
+	}
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	if err := checkFence(fence); err != nil {
+		log(os.Stderr, "reset rejected: %s\n", err.Error())
+		return "", newWriteError(writeConflict, "%s", err.Error())
+	}
+	if !beginCommit(ctx) {
+		log(os.Stderr, "reset abandoned, the request timed out\n")
+		return "", newWriteError(writeTimedOut, "request timed out before the reset was applied")
+	}
+	if err := storeValue(ts, 0); err != nil {
+		log(os.Stderr, "could not reset timestamp: %s\n", err.Error())
+		return "", newWriteError(writeInternal, "could not reset timestamp")
+	}
+	value := time.Unix(*resetValue, 0)
+	id := newWriteID(now())
+	log(os.Stdout, "reset timestamp to %d by writer %q as write %s\n", value.Unix(), writer, id)
+	events.publish(Event{Type: EventDeleted, ID: id, Value: value, Writer: writer, At: now()})
+	history.record(newHistoryEntry(id, value, writer, now()))
+	totalWrites.Add(1)
+	return id, nil
+}
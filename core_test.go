@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestStoreWrite(t *testing.T) {
+	defer resetStore()
+	defer func(d time.Duration) { *maxFuture = d }(*maxFuture)
+	*maxFuture = time.Hour
+
+	tests := []struct {
+		description  string
+		op           writeOp
+		expectedKind writeErrorKind
+		expectErr    bool
+		expected     int64
+	}{
+		{"stored", writeOp{Value: time.Unix(200, 0), Writer: "w"}, 0, false, 200},
+		{"older without monotonic", writeOp{Value: time.Unix(100, 0)}, 0, false, 100},
+		{"older with monotonic", writeOp{Value: time.Unix(50, 0), Monotonic: true}, writeOutdated, true, 100},
+		{"too far ahead", writeOp{Value: time.Now().Add(2 * time.Hour)}, writeUnprocessable, true, 100},
+		{"unavailable ack level", writeOp{Value: time.Unix(300, 0), Ack: ackQuorum}, writeUnavailableAck, true, 100},
+		{"invalid fencing token", writeOp{Value: time.Unix(300, 0), Fence: "x"}, writeConflict, true, 100},
+	}
+	resetStore()
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			id, err := storeWrite(context.Background(), test.op)
+			if test.expectErr {
+				var we *writeError
+				if !errors.As(err, &we) || we.kind != test.expectedKind {
+					t.Fatalf("expected error kind %d, got: %v", test.expectedKind, err)
+				}
+				if we.kind == writeOutdated && we.current.Unix() != test.expected {
+					t.Errorf("expected the stored %d with the error, got: %d", test.expected, we.current.Unix())
+				}
+			} else if err != nil || len(id) != 26 {
+				t.Fatalf("expected a write ID, got %q and: %v", id, err)
+			}
+			if ts := mustGet(t, th); ts.Unix() != test.expected {
+				t.Errorf("expected stored %d, got: %d", test.expected, ts.Unix())
+			}
+		})
+	}
+}
+
+func TestTimedOutWriteNotApplied(t *testing.T) {
+	defer resetStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var we *writeError
+	if _, err := storeWrite(ctx, writeOp{Value: time.Unix(100, 0)}); !errors.As(err, &we) || we.kind != writeTimedOut {
+		t.Errorf("expected the write to time out, got: %v", err)
+	}
+	if _, err := storeReset(ctx, "agent", ""); !errors.As(err, &we) || we.kind != writeTimedOut {
+		t.Errorf("expected the reset to time out, got: %v", err)
+	}
+	if ts, _ := th.Get(); ts.Unix() != 0 {
+		t.Errorf("expected the timed out write not to be applied, got: %d", ts.Unix())
+	}
+}
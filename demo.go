@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"time"
+)
+
+// With -demo the binary exercises its own API once the server is up: it
+// writes the demo payload and reads it back. It is off by default, as the
+// write replaces whatever value the backend restored.
+var (
+	demo           = flag.Bool("demo", false, "write -demo-payload and read it back after startup")
+	demoPayload    = flag.String("demo-payload", "123456789", "timestamp written by -demo")
+	demoRetries    = flag.Int("demo-retries", 0, "how often -demo retries a failed write")
+	demoRetryDelay = flag.Duration("demo-retry-delay", time.Second, "wait between -demo retries")
+	demoFailRate   = flag.Float64("demo-fail-rate", 0, "fraction of -demo writes failed on purpose before they are sent, from 0 to 1")
+)
+
+var errInjectedFailure = errors.New("injected failure")
+
+type demoConfig struct {
+	payload    string
+	retries    int
+	retryDelay time.Duration
+	// fail decides whether an attempt is failed on purpose
+	fail func() bool
+}
+
+func demoConfigFromFlags() (demoConfig, error) {
+	if *demoRetries < 0 {
+		return demoConfig{}, errors.New("-demo-retries must not be negative")
+	}
+	if *demoFailRate < 0 || *demoFailRate > 1 {
+		return demoConfig{}, errors.New("-demo-fail-rate must be between 0 and 1")
+	}
+	rate := *demoFailRate
+	return demoConfig{
+		payload:    *demoPayload,
+		retries:    *demoRetries,
+		retryDelay: *demoRetryDelay,
+		fail:       func() bool { return rand.Float64() < rate },
+	}, nil
+}
+
+// runDemo writes the payload, retrying failed attempts, and reads the stored
+// value back
+func runDemo(c demoConfig) error {
+	var err error
+	for attempt := 0; attempt <= c.retries; attempt++ {
+		if attempt > 0 {
+			log(os.Stderr, "demo write failed, retrying in %s: %s\n", c.retryDelay, err.Error())
+			time.Sleep(c.retryDelay)
+		}
+		if err = demoPut(c); err == nil {
+			break
+		}
+	}
+	if errors.Is(err, errServerUnavailable) && keepForReplay(c.payload) {
+		return fmt.Errorf("demo write failed after %d attempts, kept in -write-buffer: %w", c.retries+1, err)
+	}
+	if err != nil {
+		return fmt.Errorf("demo write failed after %d attempts: %w", c.retries+1, err)
+	}
+	ts, err := getTimestamp(context.Background())
+	if err != nil {
+		return err
+	}
+	log(os.Stdout, "recieved timestamp from server: %s\n", ts)
+	return nil
+}
+
+func demoPut(c demoConfig) error {
+	if c.fail != nil && c.fail() {
+		return errInjectedFailure
+	}
+	rsp, err := doPut(context.Background(), c.payload)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errServerUnavailable, err.Error())
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(rsp.Body, maxReqBytes))
+		if rsp.StatusCode >= http.StatusInternalServerError {
+			return fmt.Errorf("%w: server returned %s: %s", errServerUnavailable, rsp.Status, msg)
+		}
+		return fmt.Errorf("server returned %s: %s", rsp.Status, msg)
+	}
+	log(os.Stdout, "write %s accepted\n", rsp.Header.Get(writeIDHeader))
+	writeDelivered()
+	return nil
+}
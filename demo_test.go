@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunDemo(t *testing.T) {
+	defer initClient(defaultTimeout)
+
+	tests := []struct {
+		description  string
+		retries      int
+		injected     int // attempts failed on purpose
+		serverErrors int // attempts failed by the server
+		expectedPuts int
+		expectErr    error
+	}{
+		{"succeeds", 0, 0, 0, 1, nil},
+		{"injected failure without retries", 0, 1, 0, 0, errInjectedFailure},
+		{"injected failure retried", 2, 2, 0, 1, nil},
+		{"server error retried", 1, 0, 1, 2, nil},
+		{"retries exhausted", 1, 1, 1, 1, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			var puts, gets int
+			stored := ""
+			serverErrors := test.serverErrors
+			client.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				rsp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(""))}
+				switch req.Method {
+				case http.MethodPut:
+					puts++
+					if serverErrors > 0 {
+						serverErrors--
+						rsp.StatusCode = http.StatusServiceUnavailable
+						return rsp, nil
+					}
+					data, _ := io.ReadAll(req.Body)
+					stored = string(data)
+				case http.MethodGet:
+					gets++
+					rsp.Body = io.NopCloser(strings.NewReader(stored))
+				}
+				return rsp, nil
+			})
+			injected := test.injected
+			err := runDemo(demoConfig{payload: "42", retries: test.retries, fail: func() bool {
+				injected--
+				return injected >= 0
+			}})
+			exhausted := test.injected+test.serverErrors > test.retries
+			if exhausted != (err != nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if test.expectErr != nil && !errors.Is(err, test.expectErr) {
+				t.Errorf("expected %v, got: %v", test.expectErr, err)
+			}
+			if puts != test.expectedPuts {
+				t.Errorf("expected %d writes, got: %d", test.expectedPuts, puts)
+			}
+			if !exhausted && (stored != "42" || gets != 1) {
+				t.Errorf("expected the payload to be written and read back, got %q after %d reads", stored, gets)
+			}
+		})
+	}
+}
+
+func TestRunDemoWriteBuffer(t *testing.T) {
+	defer initClient(defaultTimeout)
+	path := filepath.Join(t.TempDir(), "pending")
+	if err := configureForTest(t, "-write-buffer", path); err != nil {
+		t.Fatalf("could not configure: %v", err)
+	}
+
+	status := http.StatusServiceUnavailable
+	client.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: status, Header: http.Header{}, Body: io.NopCloser(strings.NewReader("42"))}, nil
+	})
+	if err := runDemo(demoConfig{payload: "42"}); !errors.Is(err, errServerUnavailable) {
+		t.Fatalf("expected the server to be unavailable, got: %v", err)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "42" {
+		t.Fatalf("expected the write to be kept for replay, got %q: %v", data, err)
+	}
+
+	status = http.StatusOK
+	if err := runDemo(demoConfig{payload: "43"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected the delivered write to supersede the kept one, stat: %v", err)
+	}
+}
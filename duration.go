@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+)
+
+// Durations are written the same way everywhere, as Go durations like 500ms,
+// 2m30s or 1h: in flags, and in the query parameters, headers and JSON
+// fields of requests. Request values are parsed with parseDuration, so they
+// are all refused with the same kind of message.
+
+// Duration flags need a positive value, except those where 0 turns off what
+// they configure, which just can't be negative. The dev flags simulating
+// clock skew are not checked, as skew goes both ways.
+var (
+	positiveDurationFlags = []string{
+		"read-timeout", "write-timeout", "shutdown-timeout",
+		"status-warning", "status-stale", "stream-heartbeat",
+		"s3-checkpoint", "watchdog-interval", "write-buffer-interval",
+		"startup-recover-timeout", "startup-listen-timeout",
+	}
+	optionalDurationFlags = []string{
+		"max-future", "max-request-age", "hsts-max-age", "history-max-age",
+		"watchdog-max-staleness", "demo-retry-delay", "dev-latency",
+	}
+)
+
+// checkDurationFlags refuses duration flags out of range, which would
+// otherwise only fail once used, some of them by panicking
+func checkDurationFlags() error {
+	for _, name := range positiveDurationFlags {
+		if durationFlag(name) <= 0 {
+			return fmt.Errorf("-%s must be a positive duration like 30s or 2m30s", name)
+		}
+	}
+	for _, name := range optionalDurationFlags {
+		if durationFlag(name) < 0 {
+			return fmt.Errorf("-%s must be a positive duration like 30s or 2m30s, or 0", name)
+		}
+	}
+	return nil
+}
+
+func durationFlag(name string) time.Duration {
+	return flag.Lookup(name).Value.(flag.Getter).Get().(time.Duration)
+}
+
+// durationError is a request duration that is not a positive duration within
+// bounds
+type durationError struct {
+	name string
+	max  time.Duration
+}
+
+func (e *durationError) Error() string {
+	if e.max > 0 {
+		return fmt.Sprintf("%s must be a positive duration like 30s or 2m30s, at most %s", e.name, e.max)
+	}
+	return e.name + " must be a positive duration like 30s or 2m30s"
+}
+
+// parseDuration parses v, called name in the error, as a positive duration of
+// at most max, which 0 leaves unbounded
+func parseDuration(name, v string, max time.Duration) (time.Duration, error) {
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 || (max > 0 && d > max) {
+		return 0, &durationError{name: name, max: max}
+	}
+	return d, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		value       string
+		max         time.Duration
+		expected    time.Duration
+		expectedErr string
+	}{
+		{"500ms", 0, 500 * time.Millisecond, ""},
+		{"2m30s", 0, 150 * time.Second, ""},
+		{"1h", 0, time.Hour, ""},
+		{"5m", 5 * time.Minute, 5 * time.Minute, ""},
+		{"30", 0, 0, "ttl must be a positive duration like 30s or 2m30s"},
+		{"0s", 0, 0, "ttl must be a positive duration like 30s or 2m30s"},
+		{"-1m", 0, 0, "ttl must be a positive duration like 30s or 2m30s"},
+		{"6m", 5 * time.Minute, 0, "ttl must be a positive duration like 30s or 2m30s, at most 5m0s"},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			got, err := parseDuration("ttl", test.value, test.max)
+			if test.expectedErr != "" {
+				if err == nil || err.Error() != test.expectedErr {
+					t.Errorf("expected %q, got: %v", test.expectedErr, err)
+				}
+				return
+			}
+			if err != nil || got != test.expected {
+				t.Errorf("expected %s, got: %s %v", test.expected, got, err)
+			}
+		})
+	}
+}
+
+func TestCheckDurationFlags(t *testing.T) {
+	tests := []struct {
+		args        []string
+		expectedErr string
+	}{
+		{nil, ""},
+		{[]string{"-s3-checkpoint", "0s"}, "-s3-checkpoint must be a positive duration like 30s or 2m30s"},
+		{[]string{"-stream-heartbeat", "-1s"}, "-stream-heartbeat must be a positive duration like 30s or 2m30s"},
+		{[]string{"-watchdog-interval", "0s"}, "-watchdog-interval must be a positive duration like 30s or 2m30s"},
+		{[]string{"-write-timeout", "0s"}, "-write-timeout must be a positive duration like 30s or 2m30s"},
+		{[]string{"-max-future", "0s"}, ""},
+		{[]string{"-history-max-age", "-1h"}, "-history-max-age must be a positive duration like 30s or 2m30s, or 0"},
+		{[]string{"-dev-clock-skew", "-90s"}, ""},
+	}
+	for _, test := range tests {
+		t.Run(strings.Join(test.args, " "), func(t *testing.T) {
+			err := configureForTest(t, test.args...)
+			if test.expectedErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != test.expectedErr {
+				t.Errorf("expected %q, got: %v", test.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestDurationFlagsChecked(t *testing.T) {
+	checked := map[string]bool{"dev-clock-skew": true}
+	for _, name := range append(positiveDurationFlags, optionalDurationFlags...) {
+		checked[name] = true
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		g, ok := f.Value.(flag.Getter)
+		if !ok || strings.HasPrefix(f.Name, "test.") {
+			return
+		}
+		if _, ok := g.Get().(time.Duration); ok && !checked[f.Name] {
+			t.Errorf("-%s is not checked by checkDurationFlags", f.Name)
+		}
+	})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// internal event bus, notification and integration features subscribe to it
+// instead of being wired into the handlers. Embedders subscribe with
+// SubscribeEvents.
+
+// EventType tells what an Event reports
+type EventType string
+
+const (
+	// a write stored Value
+	EventValueChanged EventType = "value_changed"
+	// the TTL of the value passed and it was cleared, Value is Unix(0, 0)
+	EventExpired EventType = "expired"
+	// a reset cleared the value, Value is what reads return from now on
+	EventDeleted EventType = "deleted"
+	// the configuration was applied again while serving. The server itself
+	// doesn't reload its flags, embedders that do announce it with
+	// PublishEvent.
+	EventConfigReloaded EventType = "config_reloaded"
+	// the backend couldn't be read and reads are answered from history, Value
+	// is the value served
+	EventRepairNeeded EventType = "repair_needed"
+)
+
+// changesValue reports whether reads return Value after e, which is what
+// watchers and streams pass on
+func (e Event) changesValue() bool {
+	switch e.Type {
+	case EventValueChanged, EventExpired, EventDeleted:
+		return true
+	}
+	return false
+}
+
+// Event is published on the bus
+type Event struct {
+	Type   EventType
+	ID     string // write ID, for events caused by a write
+	Value  time.Time
+	Writer string
+	At     time.Time
+}
+
+type eventBus struct {
+	mu   sync.RWMutex
+	subs map[int]chan Event
+	next int
+	// filter drops events it returns false for, set before serving
+	filter func(Event) bool
+}
+
+var events = newEventBus()
+
+func newEventBus() *eventBus {
+	return &eventBus{subs: make(map[int]chan Event)}
+}
+
+// subscribe returns a channel receiving every published event and a function
+// ending the subscription. A subscriber that falls more than buffer events
+// behind misses events rather than blocking writers.
+func (b *eventBus) subscribe(buffer int) (<-chan Event, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := b.next
+	b.next++
+	ch := make(chan Event, buffer)
+	b.subs[id] = ch
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			delete(b.subs, id)
+			close(ch)
+		})
+	}
+}
+
+func (b *eventBus) publish(e Event) {
+	if b.filter != nil && !b.filter(e) {
+		return
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for id, ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			log(os.Stderr, "event subscriber %d is too slow, dropping %s event\n", id, e.Type)
+		}
+	}
+}
+
+// SubscribeEvents returns a channel receiving every event the server
+// publishes and a function ending the subscription, which closes the
+// channel. A subscriber that falls more than buffer events behind misses
+// events rather than blocking writers.
+func SubscribeEvents(buffer int) (<-chan Event, func()) {
+	return events.subscribe(buffer)
+}
+
+// PublishEvent delivers e to every subscriber, webhooks and notifiers
+// included
+func PublishEvent(e Event) {
+	events.publish(e)
+}
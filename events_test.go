@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestEventBus(t *testing.T) {
+	bus := newEventBus()
+	first, cancelFirst := bus.subscribe(1)
+	second, cancelSecond := bus.subscribe(1)
+	defer cancelSecond()
+
+	bus.publish(Event{Type: EventValueChanged, Value: time.Unix(1, 0)})
+	for _, ch := range []<-chan Event{first, second} {
+		e := <-ch
+		if e.Type != EventValueChanged || e.Value.Unix() != 1 {
+			t.Errorf("unexpected event: %+v", e)
+		}
+	}
+
+	cancelFirst()
+	cancelFirst()
+	if _, ok := <-first; ok {
+		t.Error("channel should be closed after unsubscribing")
+	}
+
+	// a full subscriber must not block publishing
+	bus.publish(Event{Type: EventValueChanged, Value: time.Unix(2, 0)})
+	bus.publish(Event{Type: EventValueChanged, Value: time.Unix(3, 0)})
+	if e := <-second; e.Value.Unix() != 2 {
+		t.Errorf("expected the first event to be kept, got: %d", e.Value.Unix())
+	}
+}
+
+func TestUpdatePublishesEvent(t *testing.T) {
+	defer resetStore()
+	ch, cancel := events.subscribe(1)
+	defer cancel()
+
+	req := httptest.NewRequest(http.MethodPut, getStorePath(), bytes.NewReader([]byte("42")))
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set(writerIDHeader, "agent-1")
+	w := httptest.NewRecorder()
+	update(w, req)
+
+	select {
+	case e := <-ch:
+		if e.Type != EventValueChanged || e.Value.Unix() != 42 || e.Writer != "agent-1" {
+			t.Errorf("unexpected event: %+v", e)
+		}
+		// the writer gets the ID the event carries
+		if id := w.Result().Header.Get(writeIDHeader); len(id) != 26 || e.ID != id {
+			t.Errorf("expected event ID %q to match write ID %q", e.ID, id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no event published for update")
+	}
+}
+
+func TestExpiryAndResetPublishEvents(t *testing.T) {
+	defer resetStore()
+	defer func(v time.Duration) { *devClockSkew = v }(*devClockSkew)
+	ch, cancel := SubscribeEvents(4)
+	defer cancel()
+
+	next := func() Event {
+		t.Helper()
+		select {
+		case e := <-ch:
+			return e
+		case <-time.After(time.Second):
+			t.Fatal("no event published")
+		}
+		return Event{}
+	}
+
+	if _, err := storeWrite(context.Background(), writeOp{Value: time.Unix(100, 0), TTL: time.Second, Writer: "agent"}); err != nil {
+		t.Fatal(err)
+	}
+	if e := next(); e.Type != EventValueChanged || !e.changesValue() {
+		t.Errorf("unexpected event for the write: %+v", e)
+	}
+	*devClockSkew = time.Minute
+	if _, err := readValue(); err != nil {
+		t.Fatal(err)
+	}
+	if e := next(); e.Type != EventExpired || e.Value.Unix() != 0 || !e.changesValue() {
+		t.Errorf("unexpected event for the expiry: %+v", e)
+	}
+	if _, err := storeReset(context.Background(), "agent", ""); err != nil {
+		t.Fatal(err)
+	}
+	if e := next(); e.Type != EventDeleted || e.Writer != "agent" || !e.changesValue() {
+		t.Errorf("unexpected event for the reset: %+v", e)
+	}
+
+	PublishEvent(Event{Type: EventConfigReloaded})
+	if e := next(); e.Type != EventConfigReloaded || e.changesValue() {
+		t.Errorf("unexpected event for the reload: %+v", e)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+)
+
+const (
+	exportPath = "/export"
+	// entries written between flushes of a streamed export
+	exportFlushEvery = 1000
+)
+
+// exportHandler streams the write history as NDJSON, one entry per line,
+// with the same optional from and to as /history. It reads a snapshot
+// without holding the history lock and flushes as it goes, so neither
+// writers nor memory suffer from a large export. It is not run under a
+// timeout budget, which would buffer the whole response, but the server's
+// write timeout still applies.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if history == nil {
+		http.Error(w, "history is not enabled", http.StatusNotFound)
+		return
+	}
+	from, to, err := historyRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	n := 0
+	for _, e := range history.snapshot() {
+		if e.At < from.Unix() || e.At > to.Unix() {
+			continue
+		}
+		if err := enc.Encode(e); err != nil {
+			log(os.Stderr, "error while streaming export: %s\n", err.Error())
+			return
+		}
+		if n++; n%exportFlushEvery == 0 {
+			if r.Context().Err() != nil {
+				return
+			}
+			if err := bw.Flush(); err != nil {
+				log(os.Stderr, "error while streaming export: %s\n", err.Error())
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		log(os.Stderr, "error while streaming export: %s\n", err.Error())
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExportHandler(t *testing.T) {
+	defer func(h *writeHistory) { history = h }(history)
+	history = &writeHistory{}
+	const n = 2*exportFlushEvery + 10
+	for i := 0; i < n; i++ {
+		history.record(historyEntry{Value: int64(i), At: int64(i)})
+	}
+
+	tests := []struct {
+		description string
+		query       string
+		expected    int
+	}{
+		{"everything", "", n},
+		{"range", "?from=10&to=19", 10},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			srv := httptest.NewServer(newMux(map[string]http.HandlerFunc{exportPath: exportHandler}))
+			defer srv.Close()
+			res, err := http.Get(srv.URL + apiPrefix + exportPath + test.query)
+			if err != nil {
+				t.Fatalf("could not export: %v", err)
+			}
+			defer res.Body.Close()
+			if res.Header.Get("Content-Type") != "application/x-ndjson" {
+				t.Errorf("expected NDJSON, got: %s", res.Header.Get("Content-Type"))
+			}
+			lines := 0
+			sc := bufio.NewScanner(res.Body)
+			for sc.Scan() {
+				var e historyEntry
+				if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+					t.Fatalf("could not decode line %d: %v", lines, err)
+				}
+				lines++
+			}
+			if lines != test.expected {
+				t.Errorf("expected %d entries, got: %d", test.expected, lines)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// Subscribers to /watch, /stream and /ws can ask with ?min_delta= (the
+// "min_delta" field of a WebSocket subscribe) to only hear about changes
+// that move the value by at least that much from the last one they were
+// sent, so a client interested in coarse progress isn't sent every write.
+// The filter runs per subscriber on the server. Resets move the value back
+// to the epoch and so always pass.
+const minDeltaParam = "min_delta"
+
+func parseMinDelta(v string) (time.Duration, error) {
+	if v == "" {
+		return 0, nil
+	}
+	return parseDuration(minDeltaParam, v, 0)
+}
+
+func requestMinDelta(r *http.Request) (time.Duration, error) {
+	return parseMinDelta(queryParam(r, minDeltaParam))
+}
+
+// deltaFilter passes values at least min away from the last one it passed
+type deltaFilter struct {
+	min  time.Duration
+	last time.Time
+}
+
+// pass reports whether ts is to be sent, and if so remembers it. Without a
+// minimum every value passes.
+func (f *deltaFilter) pass(ts time.Time) bool {
+	if f.min <= 0 {
+		return true
+	}
+	d := ts.Sub(f.last)
+	if d < 0 {
+		d = -d
+	}
+	if d < f.min {
+		return false
+	}
+	f.last = ts
+	return true
+}
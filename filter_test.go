@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDeltaFilter(t *testing.T) {
+	f := deltaFilter{min: time.Minute, last: time.Unix(1000, 0)}
+	tests := []struct {
+		value    int64
+		expected bool
+	}{
+		{1030, false},
+		{1060, true},
+		// measured from the last value passed, not the last one seen
+		{1100, false},
+		{1120, true},
+		{1060, true},
+		// a reset
+		{0, true},
+	}
+	for _, test := range tests {
+		if got := f.pass(time.Unix(test.value, 0)); got != test.expected {
+			t.Errorf("expected %d to pass %v, got: %v", test.value, test.expected, got)
+		}
+	}
+
+	// without a minimum every value passes, including repeats
+	f = deltaFilter{last: time.Unix(1000, 0)}
+	if !f.pass(time.Unix(1000, 0)) {
+		t.Error("expected every value to pass without a minimum")
+	}
+}
+
+func TestParseMinDelta(t *testing.T) {
+	for v, expected := range map[string]time.Duration{"": 0, "90s": 90 * time.Second} {
+		if got, err := parseMinDelta(v); err != nil || got != expected {
+			t.Errorf("expected %q to be %s, got: %s %v", v, expected, got, err)
+		}
+	}
+	for _, v := range []string{"0s", "-1m", "soon"} {
+		var de *durationError
+		if _, err := parseMinDelta(v); !errors.As(err, &de) {
+			t.Errorf("expected %q to be invalid, got: %v", v, err)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the API speaks plain text by default, JSON is negotiated with Content-Type
+// on writes and Accept on reads
+const (
+	contentTypeText = "text/plain"
+	contentTypeJSON = "application/json"
+)
+
+var errUnsupportedContentType = errors.New("only text/plain and application/json content-types are allowed")
+
+type timestampBody struct {
+	Timestamp *int64 `json:"timestamp"`
+	// TTL is a duration like "90s", see requestTTL
+	TTL string `json:"ttl,omitempty"`
+}
+
+// mediaType returns the media type of a Content-Type header without its
+// parameters, or "" if it can't be parsed
+func mediaType(contentType string) string {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return mt
+}
+
+// parseTimestamp decodes a request body of the given content type, epoch
+// values being counts of unit
+func parseTimestamp(contentType string, data []byte, unit time.Duration) (time.Time, error) {
+	switch mediaType(contentType) {
+	case contentTypeText:
+		if ts, err := time.Parse(time.RFC3339Nano, string(data)); err == nil {
+			return fromRFC3339(ts, unit)
+		}
+		return timestamp(data).toTime(unit)
+	case contentTypeJSON:
+		var body timestampBody
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&body); err != nil {
+			return time.Time{}, errors.New("invalid JSON body")
+		}
+		if body.Timestamp == nil {
+			return time.Time{}, errors.New("timestamp is missing")
+		}
+		return timestamp(strconv.FormatInt(*body.Timestamp, 10)).toTime(unit)
+	default:
+		return time.Time{}, errUnsupportedContentType
+	}
+}
+
+// fromRFC3339 applies the same rules as epoch values: nothing before 1970 and
+// nothing finer than the requested precision
+func fromRFC3339(ts time.Time, unit time.Duration) (time.Time, error) {
+	if ts.Unix() < 0 {
+		return time.Time{}, errors.New("timestamp supplied is negative")
+	}
+	return truncate(ts, unit), nil
+}
+
+// truncate drops the part of ts finer than unit, which is at most a second
+func truncate(ts time.Time, unit time.Duration) time.Time {
+	nsec := int64(ts.Nanosecond())
+	return time.Unix(ts.Unix(), nsec-nsec%int64(unit))
+}
+
+// epoch values are seconds unless a finer precision is configured with
+// -precision or requested with ?precision=
+const precisionParam = "precision"
+
+var precisions = map[string]time.Duration{
+	"s":  time.Second,
+	"ms": time.Millisecond,
+	"ns": time.Nanosecond,
+}
+
+var (
+	defaultPrecision        = flag.String("precision", "s", "unit of epoch timestamps unless a request asks otherwise: s, ms or ns")
+	errUnsupportedPrecision = errors.New("precision must be s, ms or ns")
+)
+
+// queryParam is r.URL.Query().Get(name) without parsing the query when
+// there is none, which is the common case on the hot read path
+func queryParam(r *http.Request, name string) string {
+	if r.URL.RawQuery == "" {
+		return ""
+	}
+	return r.URL.Query().Get(name)
+}
+
+// requestPrecision returns the epoch unit requested by r
+func requestPrecision(r *http.Request) (time.Duration, error) {
+	p := queryParam(r, precisionParam)
+	if p == "" {
+		p = *defaultPrecision
+	}
+	unit, ok := precisions[p]
+	if !ok {
+		return 0, errUnsupportedPrecision
+	}
+	return unit, nil
+}
+
+// epochValue returns ts as a count of unit since the epoch
+func epochValue(ts time.Time, unit time.Duration) string {
+	return string(appendEpoch(nil, ts, unit))
+}
+
+func appendEpoch(dst []byte, ts time.Time, unit time.Duration) []byte {
+	switch unit {
+	case time.Millisecond:
+		return strconv.AppendInt(dst, ts.UnixMilli(), 10)
+	case time.Nanosecond:
+		return strconv.AppendInt(dst, ts.UnixNano(), 10)
+	default:
+		return strconv.AppendInt(dst, ts.Unix(), 10)
+	}
+}
+
+// acceptsJSON reports whether the client asked for JSON in its Accept header.
+// It compares the media types by hand, as mime.ParseMediaType allocates for
+// every value.
+func acceptsJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	for accept != "" {
+		var v string
+		v, accept, _ = strings.Cut(accept, ",")
+		v, _, _ = strings.Cut(v, ";")
+		if strings.EqualFold(strings.TrimSpace(v), contentTypeJSON) {
+			return true
+		}
+	}
+	return false
+}
+
+// timestamps are written as epoch seconds unless ?format=rfc3339 is given
+const (
+	formatParam   = "format"
+	formatEpoch   = "epoch"
+	formatRFC3339 = "rfc3339"
+)
+
+var errUnsupportedFormat = errors.New("format must be epoch or rfc3339")
+
+// timestampFormat returns the output format requested by r
+func timestampFormat(r *http.Request) (string, error) {
+	switch f := queryParam(r, formatParam); f {
+	case "", formatEpoch:
+		return formatEpoch, nil
+	case formatRFC3339:
+		return f, nil
+	default:
+		return "", errUnsupportedFormat
+	}
+}
+
+// formatTimestamp renders ts in format at the precision of unit
+func formatTimestamp(ts time.Time, format string, unit time.Duration) string {
+	return string(appendTimestamp(nil, ts, format, unit))
+}
+
+func appendTimestamp(dst []byte, ts time.Time, format string, unit time.Duration) []byte {
+	if format == formatRFC3339 {
+		return truncate(ts, unit).UTC().AppendFormat(dst, time.RFC3339Nano)
+	}
+	return appendEpoch(dst, ts, unit)
+}
+
+// timestamp responses are small and fixed in shape, so they are built in
+// pooled buffers rather than with encoding/json, which keeps the JSON path
+// as cheap as plain text. The Content-Type values are shared and must not be
+// modified.
+var (
+	responseBufs = sync.Pool{New: func() any {
+		b := make([]byte, 0, 64)
+		return &b
+	}}
+	textContentType = []string{contentTypeText}
+	jsonContentType = []string{contentTypeJSON}
+)
+
+// writeTimestamp writes ts with the given status, in the format and content
+// type negotiated with the client
+func writeTimestamp(w http.ResponseWriter, r *http.Request, status int, ts time.Time) {
+	format, err := timestampFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	unit, err := requestPrecision(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	buf := responseBufs.Get().(*[]byte)
+	b := (*buf)[:0]
+	if acceptsJSON(r) {
+		// RFC 3339 timestamps are JSON strings, epoch seconds numbers. Neither
+		// contains anything that needs escaping.
+		b = append(b, `{"timestamp":`...)
+		if format == formatRFC3339 {
+			b = append(b, '"')
+			b = appendTimestamp(b, ts, format, unit)
+			b = append(b, '"')
+		} else {
+			b = appendTimestamp(b, ts, format, unit)
+		}
+		b = append(b, "}\n"...)
+		w.Header()["Content-Type"] = jsonContentType
+	} else {
+		b = appendTimestamp(b, ts, format, unit)
+		w.Header()["Content-Type"] = textContentType
+	}
+	w.WriteHeader(status)
+	w.Write(b)
+	*buf = b
+	responseBufs.Put(buf)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	tests := []struct {
+		description string
+		contentType string
+		body        string
+		unit        time.Duration
+		expected    time.Time
+		expectErr   bool
+	}{
+		{"epoch", contentTypeText, "1234567", time.Second, time.Unix(1234567, 0), false},
+		{"epoch ms", contentTypeText, "1234567890", time.Millisecond, time.Unix(1234567, 890000000), false},
+		{"epoch ns", contentTypeText, "1234567000000001", time.Nanosecond, time.Unix(1234567, 1), false},
+		{"rfc3339", contentTypeText, "2024-03-01T12:00:00Z", time.Second, time.Unix(1709294400, 0), false},
+		{"rfc3339 with offset", contentTypeText, "2024-03-01T13:00:00+01:00", time.Second, time.Unix(1709294400, 0), false},
+		{"rfc3339 drops fractions", contentTypeText, "2024-03-01T12:00:00.75Z", time.Second, time.Unix(1709294400, 0), false},
+		{"rfc3339 keeps ms", contentTypeText, "2024-03-01T12:00:00.7509Z", time.Millisecond, time.Unix(1709294400, 750000000), false},
+		{"rfc3339 before 1970", contentTypeText, "1969-12-31T23:59:59Z", time.Second, time.Time{}, true},
+		{"garbage", contentTypeText, "yesterday", time.Second, time.Time{}, true},
+		{"json", contentTypeJSON, `{"timestamp":42}`, time.Second, time.Unix(42, 0), false},
+		{"json ms", contentTypeJSON, `{"timestamp":42001}`, time.Millisecond, time.Unix(42, 1000000), false},
+		{"json unknown field", contentTypeJSON, `{"timestamp":42,"x":1}`, time.Second, time.Time{}, true},
+		{"unsupported", "application/xml", "42", time.Second, time.Time{}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			ts, err := parseTimestamp(test.contentType, []byte(test.body), test.unit)
+			if test.expectErr {
+				if err == nil {
+					t.Errorf("expected an error, got: %s", ts)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !ts.Equal(test.expected) {
+				t.Errorf("expected %s, got: %s", test.expected, ts)
+			}
+		})
+	}
+}
+
+func TestWriteTimestamp(t *testing.T) {
+	ts := time.Unix(1709294400, 123456789)
+	tests := []struct {
+		description        string
+		query              string
+		accept             string
+		expectedStatusCode int
+		expectedBody       string
+	}{
+		{"epoch", "", "", http.StatusOK, "1709294400"},
+		{"explicit epoch", "?format=epoch", "", http.StatusOK, "1709294400"},
+		{"rfc3339", "?format=rfc3339", "", http.StatusOK, "2024-03-01T12:00:00Z"},
+		{"json epoch", "", contentTypeJSON, http.StatusOK, "{\"timestamp\":1709294400}\n"},
+		{"json rfc3339", "?format=rfc3339", contentTypeJSON, http.StatusOK, "{\"timestamp\":\"2024-03-01T12:00:00Z\"}\n"},
+		{"unknown format", "?format=iso", "", http.StatusBadRequest, "format must be epoch or rfc3339\n"},
+		{"ms", "?precision=ms", "", http.StatusOK, "1709294400123"},
+		{"ns", "?precision=ns", "", http.StatusOK, "1709294400123456789"},
+		{"rfc3339 ms", "?format=rfc3339&precision=ms", "", http.StatusOK, "2024-03-01T12:00:00.123Z"},
+		{"json ns", "?precision=ns", contentTypeJSON, http.StatusOK, "{\"timestamp\":1709294400123456789}\n"},
+		{"json among others", "", "text/html, Application/JSON; q=0.9", http.StatusOK, "{\"timestamp\":1709294400}\n"},
+		{"json suffix", "", "application/jsonl", http.StatusOK, "1709294400"},
+		{"unknown precision", "?precision=us", "", http.StatusBadRequest, "precision must be s, ms or ns\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, getRetrievePath()+test.query, nil)
+			req.Header.Set("Accept", test.accept)
+			w := httptest.NewRecorder()
+			writeTimestamp(w, req, http.StatusOK, ts)
+			if w.Code != test.expectedStatusCode {
+				t.Errorf("expected status code to be %d, got: %d", test.expectedStatusCode, w.Code)
+			}
+			if w.Body.String() != test.expectedBody {
+				t.Errorf("expected %q, got: %q", test.expectedBody, w.Body.String())
+			}
+		})
+	}
+}
+
+// headerWriter is a ResponseWriter that keeps nothing but its headers
+type headerWriter http.Header
+
+func (w headerWriter) Header() http.Header         { return http.Header(w) }
+func (w headerWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w headerWriter) WriteHeader(int)             {}
+
+func TestWriteTimestampAllocs(t *testing.T) {
+	ts := time.Unix(1709294400, 123456789)
+	tests := []struct {
+		description string
+		query       string
+		accept      string
+	}{
+		{"text", "", ""},
+		{"json", "", contentTypeJSON},
+		{"json rfc3339", "?format=rfc3339", "text/html, " + contentTypeJSON},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, getRetrievePath()+test.query, nil)
+			req.Header.Set("Accept", test.accept)
+			w := headerWriter{"Content-Type": nil}
+			// a query is parsed once for the format and once for the
+			// precision, which is all a request with one may allocate
+			expected := 0.0
+			if test.query != "" {
+				expected = 2 * testing.AllocsPerRun(10, func() { req.URL.Query() })
+			}
+			allocs := testing.AllocsPerRun(100, func() {
+				writeTimestamp(w, req, http.StatusOK, ts)
+			})
+			if allocs > expected {
+				t.Errorf("expected at most %v allocations, got: %v", expected, allocs)
+			}
+		})
+	}
+}
+
+func TestPrecisionFlag(t *testing.T) {
+	tests := []struct {
+		description string
+		args        []string
+		wantErr     bool
+	}{
+		{"default", nil, false},
+		{"ms", []string{"-precision", "ms"}, false},
+		{"ns", []string{"-precision", "ns"}, false},
+		{"unknown", []string{"-precision", "us"}, true},
+		{"empty", []string{"-precision", ""}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			err := configureForTest(t, test.args...)
+			if (err != nil) != test.wantErr {
+				t.Errorf("configure(%q) = %v, want error %t", test.args, err, test.wantErr)
+			}
+		})
+	}
+}
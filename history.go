@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	historyPath         = "/history"
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 1000
+)
+
+const historyPruneInterval = time.Minute
+
+// degradedReadHeader marks a read answered from history because the storage
+// backend couldn't be read
+const degradedReadHeader = "X-Degraded-Read"
+
+var (
+	recordHistory     = flag.Bool("history", false, "record every accepted write, served by /history")
+	historyMaxEntries = flag.Int("history-max-entries", 10000, "number of writes kept in history, 0 for no limit")
+	historyMaxAge     = flag.Duration("history-max-age", 7*24*time.Hour, "how long writes are kept in history, 0 for no limit")
+)
+
+// historyEntry is one write. The value is in Unix seconds and the
+// nanoseconds within them, kept apart so entries read as before for clients
+// that don't care about sub-second precision.
+type historyEntry struct {
+	ID     string `json:"id"`
+	Value  int64  `json:"timestamp"`
+	Nsec   int64  `json:"nsec,omitempty"`
+	Writer string `json:"writer"`
+	At     int64  `json:"at"`
+}
+
+func newHistoryEntry(id string, value time.Time, writer string, at time.Time) historyEntry {
+	return historyEntry{ID: id, Value: value.Unix(), Nsec: int64(value.Nanosecond()), Writer: writer, At: at.Unix()}
+}
+
+// value is the timestamp written
+func (e historyEntry) value() time.Time {
+	return time.Unix(e.Value, e.Nsec)
+}
+
+// writeHistory keeps accepted writes in the order they arrived. The number of
+// entries is bounded on every write, their age by a background pruner.
+// Trimming always copies to a new slice and appends never touch existing
+// entries, so a snapshot stays valid after the lock is released.
+type writeHistory struct {
+	mu         sync.RWMutex
+	entries    []historyEntry
+	maxEntries int
+	maxAge     time.Duration
+}
+
+// history is nil unless -history is set
+var history *writeHistory
+
+func (h *writeHistory) record(e historyEntry) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.entries = append(h.entries, e)
+	if h.maxEntries > 0 && len(h.entries) > h.maxEntries {
+		h.entries = append(h.entries[:0:0], h.entries[len(h.entries)-h.maxEntries:]...)
+	}
+}
+
+// prune drops entries older than maxAge and returns how many were dropped
+func (h *writeHistory) prune(at time.Time) int {
+	if h.maxAge <= 0 {
+		return 0
+	}
+	cutoff := at.Add(-h.maxAge).Unix()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := 0
+	for n < len(h.entries) && h.entries[n].At < cutoff {
+		n++
+	}
+	if n > 0 {
+		h.entries = append(h.entries[:0:0], h.entries[n:]...)
+	}
+	return n
+}
+
+// pruneHistory prunes every interval until ctx is done
+func (h *writeHistory) pruneHistory(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if n := h.prune(now()); n > 0 {
+				log(os.Stdout, "pruned %d writes from history\n", n)
+			}
+		}
+	}
+}
+
+// between returns up to limit writes that arrived in [from, to], oldest first
+func (h *writeHistory) between(from, to time.Time, limit int) []historyEntry {
+	res := []historyEntry{}
+	h.each(from, to, func(e historyEntry) bool {
+		res = append(res, e)
+		return len(res) < limit
+	})
+	return res
+}
+
+// latest returns the most recent write, if there is one
+func (h *writeHistory) latest() (historyEntry, bool) {
+	if h == nil {
+		return historyEntry{}, false
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if len(h.entries) == 0 {
+		return historyEntry{}, false
+	}
+	return h.entries[len(h.entries)-1], true
+}
+
+// backendDegraded is set while reads are answered from history, so the repair
+// event is published once per failure rather than for every read
+var backendDegraded atomic.Bool
+
+// readValueOrHistory is readValue falling back to the latest write in history
+// when the backend can't be read, e.g. because its record is corrupt. It
+// reports whether it fell back, and publishes EventRepairNeeded when it
+// starts to. History only has the writes since the server started, so
+// without -history or a write since then the backend's error is returned.
+// So is an error expiring the value, as history would serve it past its TTL.
+func readValueOrHistory() (time.Time, bool, error) {
+	if err := expireDue(); err != nil {
+		return time.Time{}, false, err
+	}
+	ts, err := th.Get()
+	if err == nil {
+		if backendDegraded.Load() {
+			backendDegraded.Store(false)
+			log(os.Stdout, "storage backend readable again\n")
+		}
+		return ts, false, nil
+	}
+	e, ok := history.latest()
+	if !ok {
+		return time.Time{}, false, err
+	}
+	ts = e.value()
+	if backendDegraded.CompareAndSwap(false, true) {
+		log(os.Stderr, "could not read timestamp, serving write %s from history: %s\n", e.ID, err.Error())
+		events.publish(Event{Type: EventRepairNeeded, ID: e.ID, Value: ts, Writer: e.Writer, At: now()})
+	}
+	return ts, true, nil
+}
+
+// snapshot returns the current entries, which must not be modified
+func (h *writeHistory) snapshot() []historyEntry {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.entries[:len(h.entries):len(h.entries)]
+}
+
+// each calls fn for the writes that arrived in [from, to], oldest first,
+// until fn returns false. fn must not call back into h.
+func (h *writeHistory) each(from, to time.Time, fn func(historyEntry) bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, e := range h.entries {
+		if e.At >= from.Unix() && e.At <= to.Unix() && !fn(e) {
+			return
+		}
+	}
+}
+
+// historyHandler serves GET /history?from=&to=&limit= with from and to in
+// Unix seconds of arrival, both optional
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if history == nil {
+		http.Error(w, "history is not enabled", http.StatusNotFound)
+		return
+	}
+	from, to, err := historyRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := defaultHistoryLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxHistoryLimit {
+			http.Error(w, "limit must be between 1 and "+strconv.Itoa(maxHistoryLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(history.between(from, to, limit)); err != nil {
+		log(os.Stderr, "error while writing history: %s\n", err.Error())
+	}
+}
+
+// historyRange parses the optional from and to query parameters, in Unix
+// seconds, defaulting to everything up to now
+func historyRange(r *http.Request) (time.Time, time.Time, error) {
+	q := r.URL.Query()
+	from, to := time.Unix(0, 0), now()
+	for name, dst := range map[string]*time.Time{"from": &from, "to": &to} {
+		if v := q.Get(name); v != "" {
+			ts, err := timestamp(v).toUnixTime()
+			if err != nil {
+				return time.Time{}, time.Time{}, errors.New(name + " must be a Unix timestamp")
+			}
+			*dst = ts
+		}
+	}
+	return from, to, nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHistoryHandler(t *testing.T) {
+	defer func(h *writeHistory) { history = h }(history)
+	history = nil
+
+	w := httptest.NewRecorder()
+	historyHandler(w, httptest.NewRequest(http.MethodGet, apiPrefix+historyPath, nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected %d while history is disabled, got: %d", http.StatusNotFound, w.Code)
+	}
+
+	history = &writeHistory{}
+	for i, at := range []int64{100, 200, 300, 400} {
+		history.record(historyEntry{ID: string(rune('a' + i)), Value: at - 1, Writer: "w", At: at})
+	}
+
+	tests := []struct {
+		description        string
+		query              string
+		expectedStatusCode int
+		expectedIDs        string
+	}{
+		{"everything", "", http.StatusOK, "abcd"},
+		{"from", "?from=200", http.StatusOK, "bcd"},
+		{"to", "?to=300", http.StatusOK, "abc"},
+		{"range", "?from=150&to=350", http.StatusOK, "bc"},
+		{"limit", "?from=200&limit=1", http.StatusOK, "b"},
+		{"empty", "?from=500", http.StatusOK, ""},
+		{"bad from", "?from=x", http.StatusBadRequest, ""},
+		{"bad limit", "?limit=0", http.StatusBadRequest, ""},
+		{"limit too large", "?limit=1001", http.StatusBadRequest, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			historyHandler(w, httptest.NewRequest(http.MethodGet, apiPrefix+historyPath+test.query, nil))
+			if w.Code != test.expectedStatusCode {
+				t.Fatalf("expected status code to be %d, got: %d", test.expectedStatusCode, w.Code)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var entries []historyEntry
+			if err := json.NewDecoder(w.Body).Decode(&entries); err != nil {
+				t.Fatalf("could not decode history: %v", err)
+			}
+			var ids string
+			for _, e := range entries {
+				ids += e.ID
+			}
+			if ids != test.expectedIDs {
+				t.Errorf("expected writes %q, got: %q", test.expectedIDs, ids)
+			}
+		})
+	}
+}
+
+func TestUpdateRecordsHistory(t *testing.T) {
+	defer resetStore()
+	defer func(h *writeHistory) { history = h }(history)
+	history = &writeHistory{}
+
+	req := httptest.NewRequest(http.MethodPut, getStorePath()+"?precision=ms", bytes.NewReader([]byte("42500")))
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set(writerIDHeader, "agent-1")
+	w := httptest.NewRecorder()
+	update(w, req)
+
+	entries := history.between(time.Unix(0, 0), now(), maxHistoryLimit)
+	if len(entries) != 1 {
+		t.Fatalf("expected one recorded write, got: %d", len(entries))
+	}
+	e := entries[0]
+	if e.ID != w.Result().Header.Get(writeIDHeader) || e.Value != 42 || e.Nsec != 500000000 || e.Writer != "agent-1" {
+		t.Errorf("unexpected history entry: %+v", e)
+	}
+}
+
+func TestHistoryRetention(t *testing.T) {
+	h := &writeHistory{maxEntries: 3, maxAge: time.Minute}
+	for _, at := range []int64{100, 110, 120, 130, 140} {
+		h.record(historyEntry{Value: at, At: at})
+	}
+	if got := len(h.between(time.Unix(0, 0), time.Unix(1000, 0), maxHistoryLimit)); got != 3 {
+		t.Errorf("expected history to be capped at 3 entries, got: %d", got)
+	}
+
+	tests := []struct {
+		description string
+		at          int64
+		pruned      int
+		remaining   int
+	}{
+		{"nothing old enough", 180, 0, 3},
+		{"oldest entry", 185, 1, 2},
+		{"everything", 1000, 2, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			if n := h.prune(time.Unix(test.at, 0)); n != test.pruned {
+				t.Errorf("expected %d entries to be pruned, got: %d", test.pruned, n)
+			}
+			if got := len(h.between(time.Unix(0, 0), time.Unix(1000, 0), maxHistoryLimit)); got != test.remaining {
+				t.Errorf("expected %d entries to remain, got: %d", test.remaining, got)
+			}
+		})
+	}
+}
+
+// brokenStore fails every read, like a backend whose record is corrupt
+type brokenStore struct{ dataStore }
+
+func (*brokenStore) Get() (time.Time, error) {
+	return time.Time{}, errors.New("checksum mismatch")
+}
+
+func TestDegradedRead(t *testing.T) {
+	defer resetStore()
+	defer func(h *writeHistory) { history = h }(history)
+	defer backendDegraded.Store(false)
+	history = &writeHistory{}
+	th = &brokenStore{}
+
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		retrieve(w, httptest.NewRequest(http.MethodGet, getRetrievePath(), nil))
+		return w
+	}
+	if w := get(); w.Code != http.StatusInternalServerError {
+		t.Errorf("expected %d without history, got: %d", http.StatusInternalServerError, w.Code)
+	}
+
+	history.record(historyEntry{ID: "write-1", Value: 42, Nsec: 5, Writer: "w", At: 50})
+	updates, unsubscribe := events.subscribe(2)
+	defer unsubscribe()
+	for i := 0; i < 2; i++ {
+		w := get()
+		if w.Code != http.StatusOK || w.Body.String() != "42" || w.Header().Get(degradedReadHeader) != "history" {
+			t.Fatalf("expected a degraded read of 42, got: %d %q %v", w.Code, w.Body.String(), w.Header())
+		}
+	}
+	select {
+	case e := <-updates:
+		if e.Type != EventRepairNeeded || e.ID != "write-1" || !e.Value.Equal(time.Unix(42, 5)) {
+			t.Errorf("unexpected event: %+v", e)
+		}
+	default:
+		t.Fatal("expected a repair event")
+	}
+	select {
+	case e := <-updates:
+		t.Errorf("expected one repair event per failure, got another: %+v", e)
+	default:
+	}
+
+	th = &dataStore{}
+	ts := time.Unix(43, 0)
+	th.Set(&ts)
+	if w := get(); w.Body.String() != "43" || w.Header().Get(degradedReadHeader) != "" {
+		t.Errorf("expected a normal read once the backend recovered, got: %q %v", w.Body.String(), w.Header())
+	}
+	if backendDegraded.Load() {
+		t.Error("expected the backend to be reported readable")
+	}
+}
+
+// unclearableStore can't clear its value, so it can't expire it either
+type unclearableStore struct{ dataStore }
+
+func (s *unclearableStore) Set(ts *time.Time) error {
+	if ts == nil {
+		return errors.New("read-only file system")
+	}
+	return s.dataStore.Set(ts)
+}
+
+func TestDegradedReadKeepsExpiryErrors(t *testing.T) {
+	defer resetStore()
+	defer func(s Store) { th = s }(th)
+	defer func(h *writeHistory) { history = h }(history)
+	history = &writeHistory{}
+	th = &unclearableStore{}
+	ts := time.Unix(42, 0)
+	th.Set(&ts)
+	history.record(historyEntry{ID: "write-1", Value: 42, Writer: "w", At: 50})
+	valueExpiresAt.Store(now().Add(-time.Second).UnixNano())
+
+	if _, _, err := readValueOrHistory(); err == nil {
+		t.Error("expected the expiry error rather than the expired value from history")
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// advisory lock with lease expiry for writers coordinating around the stored
+// timestamp. Every acquisition hands out a new, higher fencing token; writes
+// carrying any other token than the latest one are rejected, so a writer
+// whose lease silently expired can't overwrite a newer holder's update.
+// Tokens start from the clock at startup rather than from 0, so tokens handed
+// out before a restart are all lower than those handed out after it.
+const (
+	lockPath          = "/lock"
+	fencingHeader     = "X-Fencing-Token"
+	defaultLeaseTTL   = 30 * time.Second
+	maxLeaseTTL       = 10 * time.Minute
+	lockOwnerParam    = "owner"
+	lockTokenParam    = "token"
+	lockDurationParam = "ttl"
+)
+
+var (
+	errLockHeld     = errors.New("lock is held by another owner")
+	errNotLockOwner = errors.New("lock is not held with this owner and token")
+	errStaleToken   = errors.New("stale fencing token")
+	errUnknownToken = errors.New("fencing token was never handed out")
+)
+
+type lease struct {
+	Owner   string    `json:"owner"`
+	Token   uint64    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+type leaseLock struct {
+	mu        sync.Mutex
+	current   *lease
+	lastToken uint64
+}
+
+var tsLock = newLeaseLock(time.Now())
+
+// newLeaseLock seeds the tokens with the Unix microseconds of start, which
+// no run hands out tokens faster than, while keeping them exact as JSON
+// numbers in clients that read them as doubles
+func newLeaseLock(start time.Time) *leaseLock {
+	return &leaseLock{lastToken: uint64(start.UnixMicro())}
+}
+
+// held must be called with mu held
+func (l *leaseLock) held(at time.Time) bool {
+	return l.current != nil && at.Before(l.current.Expires)
+}
+
+func (l *leaseLock) acquire(owner string, ttl time.Duration, at time.Time) (lease, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.held(at) && l.current.Owner != owner {
+		return *l.current, errLockHeld
+	}
+	l.lastToken++
+	l.current = &lease{Owner: owner, Token: l.lastToken, Expires: at.Add(ttl)}
+	return *l.current, nil
+}
+
+func (l *leaseLock) renew(owner string, token uint64, ttl time.Duration, at time.Time) (lease, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.held(at) || l.current.Owner != owner || l.current.Token != token {
+		return lease{}, errNotLockOwner
+	}
+	l.current.Expires = at.Add(ttl)
+	return *l.current, nil
+}
+
+func (l *leaseLock) release(owner string, token uint64, at time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.held(at) || l.current.Owner != owner || l.current.Token != token {
+		return errNotLockOwner
+	}
+	l.current = nil
+	return nil
+}
+
+// checkFence rejects tokens other than the latest one handed out, which is
+// the token of the current lease while one is held
+func (l *leaseLock) checkFence(token uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch {
+	case token < l.lastToken:
+		return errStaleToken
+	case token > l.lastToken:
+		return errUnknownToken
+	}
+	return nil
+}
+
+// checkFence validates the optional fencing token sent with a write. It must
+// be called with storeMu held, which acquisitions take too, so the lease
+// can't change before the write is applied.
+func checkFence(v string) error {
+	if v == "" {
+		return nil
+	}
+	token, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return errors.New("invalid fencing token")
+	}
+	return tsLock.checkFence(token)
+}
+
+// lockHandler acquires (POST), renews (PUT) or releases (DELETE) the lock.
+// owner defaults to the writer identity, ttl is a duration like "30s".
+func lockHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	owner := r.URL.Query().Get(lockOwnerParam)
+	if owner == "" {
+		owner = writer(r)
+	}
+	ttl := defaultLeaseTTL
+	if v := r.URL.Query().Get(lockDurationParam); v != "" {
+		d, err := parseDuration(lockDurationParam, v, maxLeaseTTL)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ttl = d
+	}
+	var token uint64
+	if r.Method != http.MethodPost {
+		var err error
+		if token, err = strconv.ParseUint(r.URL.Query().Get(lockTokenParam), 10, 64); err != nil {
+			http.Error(w, "token is required", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var (
+		l   lease
+		err error
+	)
+	switch r.Method {
+	case http.MethodPost:
+		// wait for writes checked against the current lease, see checkFence
+		storeMu.Lock()
+		l, err = tsLock.acquire(owner, ttl, now())
+		storeMu.Unlock()
+	case http.MethodPut:
+		l, err = tsLock.renew(owner, token, ttl, now())
+	case http.MethodDelete:
+		if err = tsLock.release(owner, token, now()); err == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	switch {
+	case errors.Is(err, errLockHeld):
+		writeLease(w, http.StatusConflict, l)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		writeLease(w, http.StatusOK, l)
+	}
+}
+
+func writeLease(w http.ResponseWriter, status int, l lease) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(l); err != nil {
+		log(os.Stderr, "error while writing lease: %s\n", err.Error())
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLeaseLock(t *testing.T) {
+	l := &leaseLock{}
+	start := time.Unix(1000, 0)
+
+	a, err := l.acquire("a", time.Minute, start)
+	if err != nil {
+		t.Fatalf("could not acquire free lock: %v", err)
+	}
+	if _, err := l.acquire("b", time.Minute, start.Add(time.Second)); err != errLockHeld {
+		t.Errorf("expected lock to be held, got: %v", err)
+	}
+	if _, err := l.renew("a", a.Token, time.Minute, start.Add(50*time.Second)); err != nil {
+		t.Errorf("could not renew: %v", err)
+	}
+	if _, err := l.acquire("b", time.Minute, start.Add(90*time.Second)); err != errLockHeld {
+		t.Errorf("renewed lock should still be held, got: %v", err)
+	}
+
+	// the lease runs out, b takes over with a higher token
+	b, err := l.acquire("b", time.Minute, start.Add(3*time.Minute))
+	if err != nil {
+		t.Fatalf("could not acquire expired lock: %v", err)
+	}
+	if b.Token <= a.Token {
+		t.Errorf("expected token to increase, got %d after %d", b.Token, a.Token)
+	}
+	if _, err := l.renew("a", a.Token, time.Minute, start.Add(3*time.Minute)); err != errNotLockOwner {
+		t.Errorf("previous owner should not renew, got: %v", err)
+	}
+	if err := l.checkFence(a.Token); err != errStaleToken {
+		t.Errorf("expected stale token, got: %v", err)
+	}
+	if err := l.checkFence(b.Token); err != nil {
+		t.Errorf("current token rejected: %v", err)
+	}
+	if err := l.checkFence(b.Token + 1); err != errUnknownToken {
+		t.Errorf("expected a token never handed out to be rejected, got: %v", err)
+	}
+	if err := l.release("a", a.Token, start.Add(3*time.Minute)); err != errNotLockOwner {
+		t.Errorf("previous owner should not release, got: %v", err)
+	}
+	if err := l.release("b", b.Token, start.Add(3*time.Minute)); err != nil {
+		t.Errorf("could not release: %v", err)
+	}
+	if _, err := l.acquire("a", time.Minute, start.Add(3*time.Minute)); err != nil {
+		t.Errorf("could not acquire released lock: %v", err)
+	}
+
+	// after a restart, tokens handed out before it are all stale
+	restarted := newLeaseLock(start.Add(4 * time.Minute))
+	if err := restarted.checkFence(b.Token); err != errStaleToken {
+		t.Errorf("expected a token from before the restart to be stale, got: %v", err)
+	}
+	c, err := restarted.acquire("c", time.Minute, start.Add(4*time.Minute))
+	if err != nil {
+		t.Fatalf("could not acquire after restart: %v", err)
+	}
+	if c.Token <= b.Token {
+		t.Errorf("expected tokens to keep increasing across restarts, got %d after %d", c.Token, b.Token)
+	}
+}
+
+func TestLockHandler(t *testing.T) {
+	defer resetStore()
+	defer func(l *leaseLock) { tsLock = l }(tsLock)
+	tsLock = newLeaseLock(time.Now())
+	initServer(defaultTimeout)
+
+	do := func(method, query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, apiPrefix+lockPath+"?"+query, nil)
+		w := httptest.NewRecorder()
+		httpServer.Handler.ServeHTTP(w, req)
+		return w
+	}
+	w := do(http.MethodPost, "owner=a&ttl=1m")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected to acquire lock, got: %d", w.Code)
+	}
+	var l lease
+	if err := json.NewDecoder(w.Body).Decode(&l); err != nil {
+		t.Fatalf("could not decode lease: %v", err)
+	}
+	if l.Owner != "a" || l.Token == 0 {
+		t.Errorf("unexpected lease: %+v", l)
+	}
+
+	tests := []struct {
+		description        string
+		method             string
+		query              string
+		expectedStatusCode int
+	}{
+		{"held by other", http.MethodPost, "owner=b", http.StatusConflict},
+		{"bad ttl", http.MethodPost, "owner=b&ttl=1y", http.StatusBadRequest},
+		{"ttl too long", http.MethodPost, "owner=b&ttl=24h", http.StatusBadRequest},
+		{"renew without token", http.MethodPut, "owner=a", http.StatusBadRequest},
+		{"renew wrong owner", http.MethodPut, fmt.Sprintf("owner=b&token=%d", l.Token), http.StatusConflict},
+		{"renew", http.MethodPut, fmt.Sprintf("owner=a&token=%d", l.Token), http.StatusOK},
+		{"bad method", http.MethodGet, "", http.StatusMethodNotAllowed},
+		{"release", http.MethodDelete, fmt.Sprintf("owner=a&token=%d", l.Token), http.StatusNoContent},
+		{"release again", http.MethodDelete, fmt.Sprintf("owner=a&token=%d", l.Token), http.StatusConflict},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			if w := do(test.method, test.query); w.Code != test.expectedStatusCode {
+				t.Errorf("expected status code to be %d, got: %d", test.expectedStatusCode, w.Code)
+			}
+		})
+	}
+
+	// a new holder fences off writes carrying the old token
+	do(http.MethodPost, "owner=b")
+	for token, expectedStatusCode := range map[uint64]int{l.Token: http.StatusConflict, l.Token + 1: http.StatusOK, l.Token + 5: http.StatusConflict} {
+		req := httptest.NewRequest(http.MethodPut, getStorePath(), bytes.NewReader([]byte("10")))
+		req.Header.Set("Content-Type", "text/plain")
+		req.Header.Set(fencingHeader, fmt.Sprint(token))
+		w := httptest.NewRecorder()
+		update(w, req)
+		if w.Code != expectedStatusCode {
+			t.Errorf("write with token %d: expected status code to be %d, got: %d", token, expectedStatusCode, w.Code)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	httpServer.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, lockPath, nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("lock should not have an unversioned alias, got: %d", w.Code)
+	}
+}
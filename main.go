@@ -4,71 +4,279 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	logger "log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 )
 
 const (
-	protocol       = "http"
-	serverAddr     = ":8080"
-	getPath        = "/retrieve"
-	putPath        = "/update"
-	defaultTimeout = 5 * time.Second
-	maxReqBytes    = 1024 // 1 kB should be enough
+	protocol           = "http"
+	serverAddr         = ":8080"
+	apiPrefix          = "/v1"
+	getPath            = "/retrieve"
+	putPath            = "/update"
+	defaultTimeout     = 5 * time.Second
+	defaultMaxReqBytes = 1024 // 1 kB should be enough
+	updateBudget       = 2 * time.Second
+	retrieveBudget     = 1 * time.Second
+	monotonicHeader    = "X-Monotonic"
 )
 
 var (
-	th         timestampHandler
-	client     *http.Client
-	httpServer *http.Server
+	// legacy unversioned routes are removed after this date
+	legacySunset = time.Date(2027, time.April, 1, 0, 0, 0, 0, time.UTC)
+
+	th           Store
+	client       *http.Client
+	httpServer   *http.Server
+	publicServer *http.Server // optional read-only listener
+	// storeMu serializes the handlers' writes, so monotonic writes can
+	// compare and set atomically
+	storeMu sync.Mutex
+
+	backend    = flag.String("backend", "", "storage backend, defaults to file if -data-file is set and memory otherwise")
+	notifier   = flag.String("wasm-notifier", "", "WASM module receiving an on_event call for every event")
+	script     = flag.String("script", "", "starlark script defining on_write and/or filter_event hooks")
+	dataFile   = flag.String("data-file", "", "where durable backends keep their data: a file for file, bolt and sqlite, a directory for wal, the module for wasm, the object for s3")
+	maxFuture  = flag.Duration("max-future", 0, "reject writes with a timestamp further than this ahead of server time with 422, 0 allows any")
+	monotonic  = flag.Bool("monotonic", false, "reject writes older than the stored value with 409, writers can also ask for this with X-Monotonic: true")
+	resetValue = flag.Int64("reset-value", 0, "Unix seconds a DELETE of the update route resets the value to, 0 clears it")
+	dbPath     = flag.String("db-path", "", "same as -data-file, the usual name for the sqlite database")
+
+	listenAddr   = flag.String("listen", serverAddr, "address the server listens on, and the built-in client connects to")
+	readTimeout  = flag.Duration("read-timeout", defaultTimeout, "time allowed to read a request, including its body")
+	writeTimeout = flag.Duration("write-timeout", defaultTimeout, "time allowed to write a response, lifted for /stream and /watch")
+	// maxReqBytes bounds request bodies and WebSocket messages
+	maxReqBytes int64 = defaultMaxReqBytes
+
+	// development flags, for testing clients against a misbehaving store
+	devLatency   = flag.Duration("dev-latency", 0, "development only: delay every response by this duration")
+	devClockSkew = flag.Duration("dev-clock-skew", 0, "development only: offset the server clock by this duration, e.g. -90s")
 )
 
 func init() {
+	flag.Int64Var(&maxReqBytes, "max-body-bytes", defaultMaxReqBytes, "largest request body or WebSocket message accepted, decompressed")
 	initClient(defaultTimeout)
 	initServer(defaultTimeout)
 	initDataStore()
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		if err := runReplay(os.Args[2:]); err != nil {
+			logger.Fatalf("replay failed: %s\n", err.Error())
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		if err := runBench(os.Args[2:], os.Stdout); err != nil {
+			logger.Fatalf("bench failed: %s\n", err.Error())
+		}
+		return
+	}
+	if err := configure(os.Args[1:]); err != nil {
+		logger.Fatalf("%s\n", err.Error())
+	}
+	if *devLatency != 0 || *devClockSkew != 0 {
+		log(os.Stdout, "simulating latency of %s and clock skew of %s\n", *devLatency, *devClockSkew)
+	}
+	demoCfg, err := demoConfigFromFlags()
+	if err != nil {
+		logger.Fatalf("invalid demo flags: %s\n", err.Error())
+	}
+	if *selfTest {
+		if err := runSelfTest(); err != nil {
+			logger.Fatalf("self-test failed: %s\n", err.Error())
+		}
+		log(os.Stdout, "self-test passed\n")
+		return
+	}
+	if *dbPath != "" {
+		*dataFile = *dbPath
+	}
+	err = runPhase(phaseRecover, *recoverTimeout, func() error {
+		return initBackend(*backend, *dataFile)
+	})
+	if err != nil {
+		logger.Fatalf("could not open storage backend: %s\n", err.Error())
+	}
+	if c, ok := th.(io.Closer); ok {
+		shutdown.add("storage backend", func(context.Context) error { return c.Close() })
+	}
+	if *recordHistory {
+		history = &writeHistory{maxEntries: *historyMaxEntries, maxAge: *historyMaxAge}
+		shutdown.goBackground("history pruning", func(ctx context.Context) {
+			history.pruneHistory(ctx, historyPruneInterval)
+		})
+	}
+	if *watchdogMaxStaleness > 0 {
+		if *watchdogURL == "" {
+			logger.Fatalf("-watchdog-max-staleness requires -watchdog-url\n")
+		}
+		d := newWatchdog(*watchdogURL, *watchdogMaxStaleness, now())
+		shutdown.goBackground("watchdog", func(ctx context.Context) {
+			d.run(ctx, *watchdogInterval)
+		})
+	}
+	webhooks = newWebhookRegistry(webhookSecret, webhookInitialBackoff)
+	for _, u := range webhookURLs {
+		if err := webhooks.add(u); err != nil {
+			logger.Fatalf("invalid -webhook: %s\n", err.Error())
+		}
+	}
+	shutdown.add("webhooks", stopFunc(webhooks.start()))
+	if *script != "" {
+		h, err := loadScriptHooks(*script)
+		if err != nil {
+			logger.Fatalf("could not load script hooks: %s\n", err.Error())
+		}
+		hooks = h
+		events.filter = hooks.allowEvent
+	}
+	if *notifier != "" {
+		stop, err := startWASMNotifier(*notifier)
+		if err != nil {
+			logger.Fatalf("could not load wasm notifier: %s\n", err.Error())
+		}
+		shutdown.add("wasm notifier", stopFunc(stop))
+	}
+
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-	// start the HTTP Server
-	go startHTTPServer()
+	// serve only now that the backend has recovered, see startup.go
+	servers := []*http.Server{httpServer}
+	if publicServer != nil {
+		servers = append(servers, publicServer)
+	}
+	var admin *http.Server
+	if *adminAddr != "" {
+		admin = newAdminServer(*adminAddr)
+		servers = append(servers, admin)
+	}
+	var listeners []net.Listener
+	err = runPhase(phaseListen, *listenTimeout, func() (err error) {
+		listeners, err = listenAll(servers)
+		return err
+	})
+	if err != nil {
+		logger.Fatalf("error while listening: %s\n", err.Error())
+	}
+	for i, srv := range servers {
+		go serveOn(srv, listeners[i])
+	}
+	shutdown.add("HTTP servers", shutdownHTTPServers)
+	if admin != nil {
+		shutdown.add("admin server", admin.Shutdown)
+	}
 
-	// store and retrieve by Client
-	makePutReq("123456789")
-	makeGetReq()
+	if *writeBufferPath != "" {
+		shutdown.goBackground("write buffer replay", func(ctx context.Context) {
+			replayWriteBuffer(ctx, *writeBufferInterval)
+		})
+	}
+	if *demo {
+		if err := runDemo(demoCfg); err != nil {
+			log(os.Stderr, "%s\n", err.Error())
+		}
+	}
 
 	<-sigCh
-	stopHttpServer()
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	shutdown.run(ctx)
 }
 
-type timestampHandler interface {
-	store(ts *time.Time)
-	get() time.Time
+// configure parses the command line and applies the settings that don't
+// depend on the storage backend. It refuses settings the server can't run
+// with, or not safely.
+func configure(args []string) error {
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return err
+	}
+	if err := checkDurationFlags(); err != nil {
+		return err
+	}
+	if maxReqBytes <= 0 {
+		return errors.New("-max-body-bytes must be positive")
+	}
+	if _, ok := precisions[*defaultPrecision]; !ok {
+		return fmt.Errorf("invalid -precision: %w", errUnsupportedPrecision)
+	}
+	applyServerFlags()
+	requested, err := parseRouteAuthPairs(*routeAuthSpec)
+	if err != nil {
+		return fmt.Errorf("invalid -route-auth: %w", err)
+	}
+	if err := configureAuth(requested); err != nil {
+		return err
+	}
+	routeAuth = withDefaultRouteAuth(requested)
+	if webhookSecret, err = loadSecret(*webhookSecretFile, webhookSecretEnv); err != nil {
+		return fmt.Errorf("could not read the webhook secret: %w", err)
+	}
+	if redirects, err = parseRedirectRules(redirectRules); err != nil {
+		return fmt.Errorf("invalid -redirect: %w", err)
+	}
+	if err := validRedirectStatus(*redirectStatus); err != nil {
+		return fmt.Errorf("invalid -redirect-status: %w", err)
+	}
+	if *adminAddr != "" {
+		if err := checkAdminAddr(*adminAddr, *adminAllowRemote); err != nil {
+			return fmt.Errorf("invalid -admin-addr: %w", err)
+		}
+	}
+	if validationURL != "" {
+		if err := checkValidationURL(validationURL); err != nil {
+			return fmt.Errorf("invalid -validation-url: %w", err)
+		}
+	}
+	if customResponseHeaders, err = parseResponseHeaders(responseHeaderSpecs); err != nil {
+		return fmt.Errorf("invalid -response-header: %w", err)
+	}
+	if err := checkAllowedOrigins(wsAllowedOrigins); err != nil {
+		return fmt.Errorf("invalid -ws-allowed-origin: %w", err)
+	}
+	enableWriteBuffer(*writeBufferPath)
+	if *publicListen != "" {
+		var limiter *rateLimiter
+		switch {
+		case *publicRate < 0:
+			return errors.New("-public-rate must not be negative")
+		case *publicRate > 0 && *publicBurst < 1:
+			return errors.New("-public-burst must be at least 1")
+		case *publicRate > 0:
+			limiter = newRateLimiter(*publicRate, *publicBurst)
+		}
+		initPublicServer(*publicListen, *writeTimeout, limiter)
+		publicServer.ReadTimeout = *readTimeout
+	}
+	return nil
 }
 
-// data store
+// data store, the default in-memory backend
 type dataStore struct {
 	ts atomic.Pointer[time.Time]
 }
 
-func (ds *dataStore) store(ts *time.Time) {
+func (ds *dataStore) Set(ts *time.Time) error {
 	if ds == nil {
 		panic("writing to uninitialized dataStore")
 	}
 	ds.ts.Store(ts)
+	return nil
 }
 
-func (ds *dataStore) get() time.Time {
+func (ds *dataStore) Get() (time.Time, error) {
 	if ds == nil {
 		panic("reading from uninitialized dataStore")
 	}
@@ -79,116 +287,270 @@ func (ds *dataStore) get() time.Time {
 	} else {
 		ts = time.Unix(0, 0)
 	}
-	return ts
+	return ts, nil
 }
 
 // HTTP handlers
 func update(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		reset(w, r)
+		return
+	}
 	if r.Method != http.MethodPut {
+		metrics.reject(rejectMethod)
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	if r.Header.Get("Content-Type") != "text/plain" {
-		http.Error(w, "only text/plain content-type is allowed", http.StatusBadRequest)
+	if ct := mediaType(r.Header.Get("Content-Type")); ct != contentTypeText && ct != contentTypeJSON {
+		metrics.reject(rejectContentType)
+		http.Error(w, errUnsupportedContentType.Error(), http.StatusBadRequest)
 		return
 	}
 	if r.Body == nil {
+		metrics.reject(rejectInvalid)
 		http.Error(w, "request body missing", http.StatusBadRequest)
 		return
 	}
-	var (
-		ts  timestamp
-		err error
-	)
-	r.Body = http.MaxBytesReader(w, r.Body, int64(maxReqBytes))
+	ack, err := requestedAckLevel(r)
+	if err != nil {
+		metrics.reject(rejectInvalid)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxReqBytes)
 
 	defer r.Body.Close()
-	data, err := io.ReadAll(r.Body)
+	body, err := decodeBody(r)
+	if err != nil {
+		log(os.Stderr, "error while decoding request body: %s\n", err.Error())
+		metrics.reject(rejectContentType)
+		http.Error(w, "unsupported or invalid content encoding", http.StatusUnsupportedMediaType)
+		return
+	}
+	data, err := io.ReadAll(body)
+	if errors.Is(err, errDecompressionLimit) {
+		log(os.Stderr, "rejected compressed request body: %s\n", err.Error())
+		metrics.reject(rejectTooLarge)
+		http.Error(w, "decompressed request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
 	if err != nil {
 		log(os.Stderr, "error while reading request body: %s\n", err.Error())
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			metrics.reject(rejectTooLarge)
+		} else {
+			metrics.reject(rejectInvalid)
+		}
 		http.Error(w, "invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	ts = timestamp(data)
-	unixTime, err := ts.toUnixTime()
+	unit, err := requestPrecision(r)
+	if err != nil {
+		metrics.reject(rejectInvalid)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	unixTime, err := parseTimestamp(r.Header.Get("Content-Type"), data, unit)
 	if err != nil {
 		log(os.Stderr, "could not convert data to timestamp: %s\n", err.Error())
+		metrics.reject(rejectParse)
 		http.Error(w, "invalid timestamp in request body", http.StatusBadRequest)
 		return
 	}
-	th.store(&unixTime)
+	ttl, err := requestTTL(r, data)
+	if err != nil {
+		metrics.reject(rejectInvalid)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	id, err := storeWrite(r.Context(), writeOp{
+		Value:     unixTime,
+		TTL:       ttl,
+		Writer:    writer(r),
+		Fence:     r.Header.Get(fencingHeader),
+		Monotonic: *monotonic || r.Header.Get(monotonicHeader) == "true",
+		Ack:       ack,
+	})
+	if err != nil {
+		writeCoreError(w, r, err)
+		return
+	}
+	w.Header().Set(writeIDHeader, id)
+	w.Header().Set(ackLevelHeader, storeAckLevel(th).String())
 	w.WriteHeader(http.StatusOK)
 }
 
+// reset puts the value back to -reset-value, clearing it when that is 0
+func reset(w http.ResponseWriter, r *http.Request) {
+	ts, err := readValue()
+	if err != nil {
+		log(os.Stderr, "could not read timestamp: %s\n", err.Error())
+		http.Error(w, "could not read timestamp", http.StatusInternalServerError)
+		return
+	}
+	// the action names the value, so a confirmation doesn't clear a newer one
+	if !confirmDestructive(w, r, "clear stored timestamp "+epochValue(ts, time.Second)) {
+		return
+	}
+	id, err := storeReset(r.Context(), writer(r), r.Header.Get(fencingHeader))
+	if err != nil {
+		writeCoreError(w, r, err)
+		return
+	}
+	w.Header().Set(writeIDHeader, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeStatus maps the core's refusals to HTTP status codes
+var writeStatus = map[writeErrorKind]int{
+	writeUnavailableAck: http.StatusPreconditionFailed,
+	writeConflict:       http.StatusConflict,
+	writeOutdated:       http.StatusConflict,
+	writeUnprocessable:  http.StatusUnprocessableEntity,
+	writeDenied:         http.StatusForbidden,
+	writeUnavailable:    http.StatusServiceUnavailable,
+	writeInternal:       http.StatusInternalServerError,
+	writeTimedOut:       http.StatusGatewayTimeout,
+}
+
+// writeCoreError answers a write the core refused. An outdated write gets the
+// stored value it lost to.
+func writeCoreError(w http.ResponseWriter, r *http.Request, err error) {
+	var we *writeError
+	if !errors.As(err, &we) {
+		http.Error(w, "could not store timestamp", http.StatusInternalServerError)
+		return
+	}
+	if we.kind == writeOutdated {
+		writeTimestamp(w, r, http.StatusConflict, we.current)
+		return
+	}
+	http.Error(w, we.msg, writeStatus[we.kind])
+}
+
 func retrieve(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	w.Header().Set("Content-Type", "text/plain")
-	w.Write([]byte(strconv.FormatInt(th.get().Unix(), 10)))
+	ts, degraded, err := readValueOrHistory()
+	if err != nil {
+		log(os.Stderr, "could not read timestamp: %s\n", err.Error())
+		http.Error(w, "could not read timestamp", http.StatusInternalServerError)
+		return
+	}
+	totalReads.Add(1)
+	if degraded {
+		w.Header().Set(degradedReadHeader, "history")
+	}
+	if hint := updateCadence.pollAfter(); hint > 0 {
+		w.Header().Set(pollAfterHeader, formatPollAfter(hint))
+	}
+	writeTimestamp(w, r, http.StatusOK, ts)
 }
 
 // client code
 func makePutReq(ts string) {
-	req, err := http.NewRequest(http.MethodPut, getStorePath(), bytes.NewReader([]byte(ts)))
-	if err != nil {
-		log(os.Stderr, "error while creating request: %s\n", err.Error())
-		return
-	}
-	req.Header.Set("Content-Type", "text/plain")
-	rsp, err := client.Do(req)
+	writeBufferMu.Lock()
+	defer writeBufferMu.Unlock()
+	rsp, err := doPut(context.Background(), ts)
 	if err != nil {
 		log(os.Stderr, "error while making PUT request: %s\n", err.Error())
+		bufferWrite(ts)
 		return
 	}
+	defer rsp.Body.Close()
 	if rsp.StatusCode != http.StatusOK {
 		log(os.Stderr, "recieved non 200 status code from server: %s\n", rsp.Status)
-		if rsp.Body != nil {
-			msg, err := io.ReadAll(rsp.Body)
-			if err != nil {
-				log(os.Stderr, "error while reading error response: %s\n", err.Error())
-				return
-			}
-			defer rsp.Body.Close()
-			log(os.Stderr, "error response: %s\n", string(msg))
+		if rsp.StatusCode >= http.StatusInternalServerError {
+			bufferWrite(ts)
+		}
+		msg, err := io.ReadAll(rsp.Body)
+		if err != nil {
+			log(os.Stderr, "error while reading error response: %s\n", err.Error())
+			return
 		}
+		log(os.Stderr, "error response: %s\n", string(msg))
+		return
 	}
-	defer rsp.Body.Close()
+	log(os.Stdout, "write %s accepted\n", rsp.Header.Get(writeIDHeader))
+	// a delivered write supersedes anything still buffered
+	discardBufferedWrite()
+}
+
+func doPut(ctx context.Context, ts string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, getStorePath(), bytes.NewReader([]byte(ts)))
+	if err != nil {
+		return nil, fmt.Errorf("error while creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("X-Sent-At", time.Now().UTC().Format(time.RFC3339Nano))
+	req.Header.Set(writerIDHeader, writerID)
+	setTOTPHeader(req)
+	return doRequest(req)
 }
 
 func makeGetReq() string {
-	req, err := http.NewRequest(http.MethodGet, getRetrievePath(), nil)
+	return getLoggedTimestamp(context.Background())
+}
+
+// getLoggedTimestamp is makeGetReq within ctx
+func getLoggedTimestamp(ctx context.Context) string {
+	ts, err := getTimestamp(ctx)
 	if err != nil {
-		log(os.Stderr, "error while creating request: %s\n", err.Error())
+		log(os.Stderr, "%s\n", err.Error())
 		return ""
 	}
-	rsp, err := client.Do(req)
+	log(os.Stdout, "recieved timestamp from server: %s\n", ts)
+	return ts
+}
+
+// getTimestamp reads the stored timestamp within ctx's deadline
+func getTimestamp(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, getRetrievePath(), nil)
 	if err != nil {
-		log(os.Stderr, "error while making get request: %s\n", err.Error())
-		return ""
+		return "", fmt.Errorf("error while creating request: %w", err)
 	}
+	rsp, err := doRequest(req)
+	if err != nil {
+		return "", fmt.Errorf("error while making get request: %w", err)
+	}
+	defer rsp.Body.Close()
 	if rsp.StatusCode != http.StatusOK {
 		log(os.Stderr, "recieved non 200 status code from server: %s\n", rsp.Status)
 	}
-	defer rsp.Body.Close()
 	data, err := io.ReadAll(rsp.Body)
 	if err != nil {
-		log(os.Stderr, "error while reading response body: %s\n", err.Error())
-		return ""
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return "", fmt.Errorf("error while reading response body: %w", err)
 	}
-	log(os.Stdout, "recieved timestamp from server: %s\n", string(data))
-	return string(data)
+	return string(data), nil
 }
 
 // helpers
 func getStorePath() string {
-	return fmt.Sprintf("%s://%s%s", protocol, serverAddr, putPath)
+	return fmt.Sprintf("%s://%s%s%s", protocol, *listenAddr, apiPrefix, putPath)
 }
 
 func getRetrievePath() string {
-	return fmt.Sprintf("%s://%s%s", protocol, serverAddr, getPath)
+	return fmt.Sprintf("%s://%s%s%s", protocol, *listenAddr, apiPrefix, getPath)
+}
+
+// now is the server's notion of the current time
+func now() time.Time {
+	return time.Now().Add(*devClockSkew)
+}
+
+// writer returns the identity the client attached to the request
+func writer(r *http.Request) string {
+	if id := r.Header.Get(writerIDHeader); id != "" {
+		return id
+	}
+	return "unknown"
 }
 
 func log(w io.Writer, format string, a ...any) {
@@ -202,43 +564,153 @@ func initDataStore() {
 	th = &dataStore{}
 }
 
+// initBackend opens the storage backend, which has recovered its value by the
+// time it returns, and restores the value's expiry deadline, clearing it if
+// it expired while the server was down. main calls it before starting the
+// servers, see startup.go.
+func initBackend(name, location string) error {
+	if name == "" {
+		name = "memory"
+		if location != "" {
+			name = "file"
+		}
+	}
+	s, err := OpenStore(name, location)
+	if err != nil {
+		return err
+	}
+	th = s
+	return restoreExpiry()
+}
+
 func initClient(timeout time.Duration) {
 	client = &http.Client{
-		Timeout: timeout,
+		Timeout:       timeout,
+		CheckRedirect: checkSignedRedirect,
 	}
+	configureClientHeaders(defaultUserAgent, nil)
 }
 
-func initServer(timeout time.Duration) {
-	routes := map[string]http.HandlerFunc{
-		putPath: update,
-		getPath: retrieve,
+// readRoutes are the routes that don't modify state
+func readRoutes() map[string]http.HandlerFunc {
+	return map[string]http.HandlerFunc{
+		getPath:    withTimeout(retrieve, retrieveBudget),
+		statusPath: withTimeout(status, retrieveBudget),
+		statsPath:  withTimeout(stats, retrieveBudget),
+		// streams and watches lift the write timeout, see
+		// clearWriteDeadline
+		streamPath: streamHandler,
+		watchPath:  watch,
 	}
+}
+
+func newMux(routes map[string]http.HandlerFunc) http.Handler {
 	mux := http.NewServeMux()
+	// every route is served under the versioned prefix, the routes that
+	// predate versioning remain as deprecated aliases
 	for path, handler := range routes {
-		mux.HandleFunc(path, handler)
+		handler = withMetrics(path, withAuth(path, handler))
+		mux.HandleFunc(apiPrefix+path, handler)
+		if path == getPath || path == putPath {
+			mux.HandleFunc(path, deprecated(handler, apiPrefix+path))
+		}
 	}
+	mux.HandleFunc("/", rootHandler(routes))
+	return withAccessLog(withDevSimulation(withResponseHeaders(withRedirects(mux))))
+}
+
+// serverRoutes are all the routes of the main listener, keyed without the
+// versioned prefix
+func serverRoutes() map[string]http.HandlerFunc {
+	routes := readRoutes()
+	routes[putPath] = withTimeout(requireRecent(update), updateBudget)
+	routes[lockPath] = withTimeout(lockHandler, updateBudget)
+	routes[historyPath] = withTimeout(historyHandler, retrieveBudget)
+	routes[usagePath] = withTimeout(usageHandler, retrieveBudget)
+	routes[exportPath] = exportHandler
+	routes[webhooksPath] = withTimeout(webhooksHandler, updateBudget)
+	routes[metricsPath] = withTimeout(metricsHandler, retrieveBudget)
+	routes[versionPath] = withTimeout(versionHandler, retrieveBudget)
+	routes[debugStatsPath] = withTimeout(debugStatsHandler, retrieveBudget)
+	// upgraded connections outlive any budget, writes are authorized by wsHandler
+	routes[wsPath] = wsHandler
+	return routes
+}
+
+func initServer(timeout time.Duration) {
 	httpServer = &http.Server{
-		Handler:      mux,
+		Handler:      newMux(serverRoutes()),
 		Addr:         serverAddr,
 		ReadTimeout:  timeout,
 		WriteTimeout: timeout,
 	}
 }
 
+// applyServerFlags applies the listener flags to the server set up by init
+func applyServerFlags() {
+	httpServer.Addr = *listenAddr
+	httpServer.ReadTimeout = *readTimeout
+	httpServer.WriteTimeout = *writeTimeout
+}
+
+// initPublicServer sets up a second listener on addr exposing only the read
+// routes, so it can be bound to a public interface while writes stay
+// internal. Clients are limited by limiter unless it is nil.
+func initPublicServer(addr string, timeout time.Duration, limiter *rateLimiter) {
+	handler := newMux(readRoutes())
+	if limiter != nil {
+		handler = withRateLimit(limiter, handler)
+	}
+	publicServer = &http.Server{
+		Handler:      handler,
+		Addr:         addr,
+		ReadTimeout:  timeout,
+		WriteTimeout: timeout,
+	}
+}
+
 func startHTTPServer() {
-	if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	serve(httpServer)
+}
+
+func startPublicServer() {
+	serve(publicServer)
+}
+
+func serve(srv *http.Server) {
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		logger.Fatalf("error while listening: %s\n", err.Error())
 		return
 	}
 }
 
+// serveOn serves srv on ln, bound by the listen phase of startup
+func serveOn(srv *http.Server, ln net.Listener) {
+	if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+		logger.Fatalf("error while serving: %s\n", err.Error())
+	}
+}
+
 func stopHttpServer() {
-	log(os.Stdout, "shutting down server\n")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
 	defer cancel()
+	shutdownHTTPServers(ctx)
+}
+
+// shutdownHTTPServers stops the servers, letting requests in flight finish
+// until ctx is done
+func shutdownHTTPServers(ctx context.Context) error {
+	log(os.Stdout, "shutting down server\n")
 	if err := httpServer.Shutdown(ctx); err != nil {
 		log(os.Stderr, "error while shutting down httpServer: %s\n", err.Error())
 	}
+	if publicServer == nil {
+		return nil
+	}
+	if err := publicServer.Shutdown(ctx); err != nil {
+		log(os.Stderr, "error while shutting down publicServer: %s\n", err.Error())
+	}
+	return nil
 }
 
 type timestamp string
@@ -255,6 +727,12 @@ func (ts timestamp) toInt64() (int64, error) {
 }
 
 func (ts timestamp) toUnixTime() (time.Time, error) {
+	return ts.toTime(time.Second)
+}
+
+// toTime reads ts as a count of unit since the epoch, unit being one of
+// time.Second, time.Millisecond or time.Nanosecond
+func (ts timestamp) toTime(unit time.Duration) (time.Time, error) {
 	tsI64, err := ts.toInt64()
 	if err != nil {
 		return time.Time{}, err
@@ -262,5 +740,6 @@ func (ts timestamp) toUnixTime() (time.Time, error) {
 	if tsI64 < 0 {
 		return time.Time{}, errors.New("timestamp supplied is negative")
 	}
-	return time.Unix(tsI64, 0), nil
+	perSecond := int64(time.Second / unit)
+	return time.Unix(tsI64/perSecond, tsI64%perSecond*int64(unit)), nil
 }
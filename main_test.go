@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"errors"
+	"flag"
 	"io"
 	"math"
 	"net/http"
@@ -13,6 +14,38 @@ import (
 	"time"
 )
 
+// configureForTest runs configure on args as main does, and undoes what it
+// changed when the test ends
+func configureForTest(t *testing.T, args ...string) error {
+	saved := map[string]string{}
+	lists := map[*stringList]stringList{}
+	flag.VisitAll(func(f *flag.Flag) {
+		if l, ok := f.Value.(*stringList); ok {
+			lists[l] = append(stringList(nil), *l...)
+			return
+		}
+		saved[f.Name] = f.Value.String()
+	})
+	levels, rules, headers := routeAuth, redirects, customResponseHeaders
+	ws, cs, hs := writeSecret, clientSecret, webhookSecret
+	t.Cleanup(func() {
+		flag.VisitAll(func(f *flag.Flag) {
+			if v, ok := saved[f.Name]; ok && f.Value.String() != v {
+				f.Value.Set(v)
+			}
+		})
+		for l, v := range lists {
+			*l = v
+		}
+		routeAuth, redirects, customResponseHeaders = levels, rules, headers
+		writeSecret, clientSecret, webhookSecret = ws, cs, hs
+		enableWriteBuffer("")
+		initServer(defaultTimeout)
+		publicServer = nil
+	})
+	return configure(args)
+}
+
 func TestInit(t *testing.T) {
 	if client == nil {
 		t.Error("http client is still nil after init")
@@ -32,8 +65,8 @@ func TestInit(t *testing.T) {
 	if th == nil {
 		t.Error("timestampHandler is nil even after init")
 	}
-	if th.get().Unix() != 0 {
-		t.Errorf("initial timestamp stored is not 0: %d", th.get().Unix())
+	if mustGet(t, th).Unix() != 0 {
+		t.Errorf("initial timestamp stored is not 0: %d", mustGet(t, th).Unix())
 	}
 }
 
@@ -48,6 +81,38 @@ func TestInitServer(t *testing.T) {
 	}
 }
 
+func TestApplyServerFlags(t *testing.T) {
+	defer initServer(defaultTimeout)
+	defer func(addr string, rt, wt time.Duration) {
+		*listenAddr, *readTimeout, *writeTimeout = addr, rt, wt
+	}(*listenAddr, *readTimeout, *writeTimeout)
+	*listenAddr, *readTimeout, *writeTimeout = "127.0.0.1:9090", 2*time.Second, time.Minute
+
+	applyServerFlags()
+	if httpServer.Addr != "127.0.0.1:9090" || httpServer.ReadTimeout != 2*time.Second || httpServer.WriteTimeout != time.Minute {
+		t.Errorf("expected the flags to be applied, got %s with timeouts %s and %s", httpServer.Addr, httpServer.ReadTimeout, httpServer.WriteTimeout)
+	}
+	if expected := "http://127.0.0.1:9090" + apiPrefix + putPath; getStorePath() != expected {
+		t.Errorf("expected the client to use %s, got: %s", expected, getStorePath())
+	}
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+	defer resetStore()
+	defer func(n int64) { maxReqBytes = n }(maxReqBytes)
+	maxReqBytes = 4
+
+	for body, expected := range map[string]int{"1234": http.StatusOK, "12345": http.StatusBadRequest} {
+		req := httptest.NewRequest(http.MethodPut, getStorePath(), bytes.NewReader([]byte(body)))
+		req.Header.Set("Content-Type", contentTypeText)
+		w := httptest.NewRecorder()
+		update(w, req)
+		if w.Code != expected {
+			t.Errorf("expected %d for %q, got: %d", expected, body, w.Code)
+		}
+	}
+}
+
 func TestInitClient(t *testing.T) {
 	if client.Timeout != defaultTimeout {
 		t.Error("client timeout is not as expected")
@@ -103,8 +168,8 @@ func TestTimestampHandler(t *testing.T) {
 
 	for _, test := range tests {
 		t.Run(test.description, func(t *testing.T) {
-			th.store(&test.inputTs)
-			if th.get() != test.expectedTs {
+			th.Set(&test.inputTs)
+			if mustGet(t, th) != test.expectedTs {
 				t.Errorf("expected: %d, got: %d", test.inputTs.Unix(), test.expectedTs.Unix())
 			}
 		})
@@ -124,12 +189,12 @@ func TestForRace(t *testing.T) {
 			go func(ts int64) {
 				defer wg.Done()
 				tsUnix := time.Unix(ts, 0)
-				th.store(&tsUnix)
+				th.Set(&tsUnix)
 			}(int64(i))
 		} else {
 			go func() {
 				defer wg.Done()
-				th.get()
+				th.Get()
 			}()
 		}
 	}
@@ -178,6 +243,7 @@ func TestRetrieveHandler(t *testing.T) {
 	type tc struct {
 		description        string
 		method             string
+		accept             string
 		expectedErr        error
 		expectedStatusCode int
 		expectedTs         string
@@ -200,6 +266,15 @@ func TestRetrieveHandler(t *testing.T) {
 			setupValue:         time.Unix(100, 0),
 			expectedTs:         "100",
 		},
+		{
+			description:        "JSON",
+			method:             http.MethodGet,
+			accept:             "text/html, application/json;q=0.9",
+			expectedErr:        nil,
+			expectedStatusCode: http.StatusOK,
+			setupValue:         time.Unix(100, 0),
+			expectedTs:         "{\"timestamp\":100}\n",
+		},
 		{
 			description:        "bad method",
 			method:             http.MethodPut,
@@ -211,9 +286,10 @@ func TestRetrieveHandler(t *testing.T) {
 	}
 	for _, test := range testCases {
 		t.Run(test.description, func(t *testing.T) {
-			th.store(&test.setupValue)
+			th.Set(&test.setupValue)
 
 			req := httptest.NewRequest(test.method, getRetrievePath(), nil)
+			req.Header.Set("Accept", test.accept)
 			w := httptest.NewRecorder()
 			retrieve(w, req)
 			res := w.Result()
@@ -263,10 +339,34 @@ func TestUpdateHandler(t *testing.T) {
 		},
 		{
 			description:        "invalid content type",
+			contentType:        "application/xml",
+			method:             http.MethodPut,
+			body:               bytes.NewReader([]byte("1234567")),
+			expectedErr:        errors.New("only text/plain and application/json content-types are allowed\n"),
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			description:        "JSON",
+			contentType:        "application/json; charset=utf-8",
+			method:             http.MethodPut,
+			body:               bytes.NewReader([]byte(`{"timestamp": 1234567}`)),
+			expectedErr:        nil,
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			description:        "JSON without timestamp",
+			contentType:        "application/json",
+			method:             http.MethodPut,
+			body:               bytes.NewReader([]byte(`{"ts": 1234567}`)),
+			expectedErr:        errors.New("invalid timestamp in request body\n"),
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			description:        "plain text body sent as JSON",
 			contentType:        "application/json",
 			method:             http.MethodPut,
 			body:               bytes.NewReader([]byte("1234567")),
-			expectedErr:        errors.New("only text/plain content-type is allowed\n"),
+			expectedErr:        errors.New("invalid timestamp in request body\n"),
 			expectedStatusCode: http.StatusBadRequest,
 		},
 		{
@@ -331,5 +431,267 @@ func TestUpdateHandler(t *testing.T) {
 }
 
 func resetStore() {
-	th.store(nil)
+	th.Set(nil)
+	valueExpiresAt.Store(0)
+}
+
+func mustGet(t *testing.T, s Store) time.Time {
+	t.Helper()
+	ts, err := s.Get()
+	if err != nil {
+		t.Fatalf("could not read from store: %v", err)
+	}
+	return ts
+}
+
+func TestVersionedRoutes(t *testing.T) {
+	defer resetStore()
+	initServer(defaultTimeout)
+
+	tests := []struct {
+		description string
+		path        string
+		deprecated  bool
+	}{
+		{"versioned", apiPrefix + getPath, false},
+		{"legacy", getPath, true},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, test.path, nil)
+			w := httptest.NewRecorder()
+			httpServer.Handler.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Errorf("expected status code to be %d, got: %d", http.StatusOK, w.Code)
+			}
+			if got := w.Header().Get("Deprecation") != ""; got != test.deprecated {
+				t.Errorf("expected deprecated to be %t, got: %t", test.deprecated, got)
+			}
+			if test.deprecated {
+				if w.Header().Get("Sunset") == "" {
+					t.Error("deprecated route is missing Sunset header")
+				}
+				if link := w.Header().Get("Link"); link != `</v1/retrieve>; rel="successor-version"` {
+					t.Errorf("unexpected Link header: %s", link)
+				}
+			}
+		})
+	}
+}
+
+func TestPublicServer(t *testing.T) {
+	defer resetStore()
+	initPublicServer(":8081", defaultTimeout, nil)
+	defer func() { publicServer = nil }()
+
+	tests := []struct {
+		description        string
+		method             string
+		path               string
+		expectedStatusCode int
+	}{
+		{"read", http.MethodGet, apiPrefix + getPath, http.StatusOK},
+		{"legacy read", http.MethodGet, getPath, http.StatusOK},
+		{"stats", http.MethodGet, apiPrefix + statsPath, http.StatusOK},
+		{"write", http.MethodPut, apiPrefix + putPath, http.StatusNotFound},
+		{"legacy write", http.MethodPut, putPath, http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, test.path, bytes.NewReader([]byte("10")))
+			req.Header.Set("Content-Type", "text/plain")
+			w := httptest.NewRecorder()
+			publicServer.Handler.ServeHTTP(w, req)
+			if w.Code != test.expectedStatusCode {
+				t.Errorf("expected status code to be %d, got: %d", test.expectedStatusCode, w.Code)
+			}
+		})
+	}
+}
+
+func TestConfigurePublicServer(t *testing.T) {
+	tests := []struct {
+		description string
+		args        []string
+		wantErr     bool
+		limited     bool
+	}{
+		{"disabled", nil, false, false},
+		{"limited", []string{"-public-listen", ":8081"}, false, true},
+		{"unlimited", []string{"-public-listen", ":8081", "-public-rate", "0"}, false, false},
+		{"negative rate", []string{"-public-listen", ":8081", "-public-rate", "-1"}, true, false},
+		{"no burst", []string{"-public-listen", ":8081", "-public-burst", "0"}, true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			err := configureForTest(t, test.args...)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("configure(%q) = %v, want error %t", test.args, err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if len(test.args) == 0 {
+				if publicServer != nil {
+					t.Error("public server set up without -public-listen")
+				}
+				return
+			}
+			if publicServer == nil || publicServer.Addr != ":8081" {
+				t.Fatal("public server not set up on -public-listen")
+			}
+			// /stats shares the budget of the other routes
+			codes := map[int]int{}
+			for i := 0; i < *publicBurst+1; i++ {
+				path := getPath
+				if i == *publicBurst {
+					path = statsPath
+				}
+				req := httptest.NewRequest(http.MethodGet, apiPrefix+path, nil)
+				w := httptest.NewRecorder()
+				publicServer.Handler.ServeHTTP(w, req)
+				codes[w.Code]++
+			}
+			if limited := codes[http.StatusTooManyRequests] == 1; limited != test.limited {
+				t.Errorf("expected limited to be %t, got status codes %v", test.limited, codes)
+			}
+		})
+	}
+}
+
+func TestResetHandler(t *testing.T) {
+	defer resetStore()
+	defer func(v int64) { *resetValue = v }(*resetValue)
+
+	tests := []struct {
+		description        string
+		resetValue         int64
+		fencingToken       string
+		expectedStatusCode int
+		expectedTs         int64
+	}{
+		{"clear", 0, "", http.StatusNoContent, 0},
+		{"configured zero state", 1000, "", http.StatusNoContent, 1000},
+		{"bad fencing token", 0, "x", http.StatusConflict, 500},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			ts := time.Unix(500, 0)
+			th.Set(&ts)
+			*resetValue = test.resetValue
+			req := httptest.NewRequest(http.MethodDelete, getStorePath(), nil)
+			if test.fencingToken != "" {
+				req.Header.Set(fencingHeader, test.fencingToken)
+			}
+			w := httptest.NewRecorder()
+			update(w, req)
+			if w.Code != test.expectedStatusCode {
+				t.Errorf("expected status code to be %d, got: %d", test.expectedStatusCode, w.Code)
+			}
+			if got := mustGet(t, th).Unix(); got != test.expectedTs {
+				t.Errorf("expected %d after reset, got: %d", test.expectedTs, got)
+			}
+		})
+	}
+}
+
+func TestMonotonicUpdate(t *testing.T) {
+	defer resetStore()
+	defer func(v bool) { *monotonic = v }(*monotonic)
+
+	tests := []struct {
+		description        string
+		flag               bool
+		header             string
+		body               string
+		expectedStatusCode int
+		expectedBody       string
+		expectedTs         int64
+	}{
+		{"older without monotonic mode", false, "", "50", http.StatusOK, "", 50},
+		{"older with flag", true, "", "50", http.StatusConflict, "100", 100},
+		{"older with header", false, "true", "50", http.StatusConflict, "100", 100},
+		{"same with flag", true, "", "100", http.StatusOK, "", 100},
+		{"newer with flag", true, "", "150", http.StatusOK, "", 150},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			ts := time.Unix(100, 0)
+			th.Set(&ts)
+			*monotonic = test.flag
+			req := httptest.NewRequest(http.MethodPut, getStorePath(), bytes.NewReader([]byte(test.body)))
+			req.Header.Set("Content-Type", "text/plain")
+			if test.header != "" {
+				req.Header.Set(monotonicHeader, test.header)
+			}
+			w := httptest.NewRecorder()
+			update(w, req)
+			if w.Code != test.expectedStatusCode {
+				t.Errorf("expected status code to be %d, got: %d", test.expectedStatusCode, w.Code)
+			}
+			if w.Body.String() != test.expectedBody {
+				t.Errorf("expected body %q, got: %q", test.expectedBody, w.Body.String())
+			}
+			if got := mustGet(t, th).Unix(); got != test.expectedTs {
+				t.Errorf("expected %d to be stored, got: %d", test.expectedTs, got)
+			}
+		})
+	}
+}
+
+func TestMonotonicUpdateConcurrent(t *testing.T) {
+	defer resetStore()
+	defer func(v bool) { *monotonic = v }(*monotonic)
+	*monotonic = true
+	th.Set(nil)
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPut, getStorePath(), bytes.NewReader([]byte(strconv.Itoa(i))))
+			req.Header.Set("Content-Type", "text/plain")
+			update(httptest.NewRecorder(), req)
+		}(i)
+	}
+	wg.Wait()
+	if got := mustGet(t, th).Unix(); got != 50 {
+		t.Errorf("expected the highest write to win, got: %d", got)
+	}
+}
+
+func TestMaxFuture(t *testing.T) {
+	defer resetStore()
+	defer func(v time.Duration) { *maxFuture = v }(*maxFuture)
+
+	tests := []struct {
+		description        string
+		maxFuture          time.Duration
+		ahead              time.Duration
+		expectedStatusCode int
+	}{
+		{"disabled", 0, time.Hour, http.StatusOK},
+		{"past", time.Minute, -time.Hour, http.StatusOK},
+		{"within limit", time.Minute, 30 * time.Second, http.StatusOK},
+		{"too far ahead", time.Minute, 2 * time.Minute, http.StatusUnprocessableEntity},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			th.Set(nil)
+			*maxFuture = test.maxFuture
+			ts := strconv.FormatInt(now().Add(test.ahead).Unix(), 10)
+			req := httptest.NewRequest(http.MethodPut, getStorePath(), bytes.NewReader([]byte(ts)))
+			req.Header.Set("Content-Type", "text/plain")
+			w := httptest.NewRecorder()
+			update(w, req)
+			if w.Code != test.expectedStatusCode {
+				t.Errorf("expected status code to be %d, got: %d", test.expectedStatusCode, w.Code)
+			}
+			expected := test.expectedStatusCode == http.StatusOK
+			if stored := mustGet(t, th).Unix() != 0; stored != expected {
+				t.Errorf("expected the write to be stored: %t, got: %t", expected, stored)
+			}
+		})
+	}
 }
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// /metrics serves Prometheus text format. The handful of metrics doesn't
+// warrant the client library, so they are kept and written here.
+const metricsPath = "/metrics"
+
+// request latency buckets in seconds
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+type requestKey struct {
+	route  string
+	method string
+	code   int
+}
+
+type routeLatency struct {
+	buckets []uint64 // per bucket, not cumulative, the last one is +Inf
+	count   uint64
+	sum     float64
+}
+
+type requestMetrics struct {
+	mu         sync.Mutex
+	counts     map[requestKey]uint64
+	latencies  map[string]*routeLatency
+	rejections map[string]uint64
+}
+
+var metrics = newRequestMetrics()
+
+func newRequestMetrics() *requestMetrics {
+	return &requestMetrics{
+		counts:     make(map[requestKey]uint64),
+		latencies:  make(map[string]*routeLatency),
+		rejections: make(map[string]uint64),
+	}
+}
+
+func (m *requestMetrics) observe(route, method string, code int, took time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counts[requestKey{route, method, code}]++
+	l := m.latencies[route]
+	if l == nil {
+		l = &routeLatency{buckets: make([]uint64, len(latencyBuckets)+1)}
+		m.latencies[route] = l
+	}
+	s := took.Seconds()
+	i := 0
+	for i < len(latencyBuckets) && s > latencyBuckets[i] {
+		i++
+	}
+	l.buckets[i]++
+	l.count++
+	l.sum += s
+}
+
+func (m *requestMetrics) reject(reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rejections[reason]++
+}
+
+// reasons of the rejected writes metric for writes refused before they reach
+// the core
+const (
+	rejectMethod       = "method_not_allowed"
+	rejectContentType  = "unsupported_content_type"
+	rejectInvalid      = "invalid_request"
+	rejectParse        = "parse_error"
+	rejectTooLarge     = "body_too_large"
+	rejectUnauthorized = "unauthorized"
+	rejectStale        = "stale_request"
+)
+
+// isValueWrite reports whether r writes the stored value, under any of the
+// paths that is served at
+func isValueWrite(r *http.Request) bool {
+	return (r.Method == http.MethodPut || r.Method == http.MethodDelete) &&
+		(r.URL.Path == putPath || r.URL.Path == apiPrefix+putPath)
+}
+
+// rejectionReasons label the rejected writes metric for the core's refusals
+var rejectionReasons = map[writeErrorKind]string{
+	writeUnavailableAck: "ack_unavailable",
+	writeConflict:       "conflict",
+	writeOutdated:       "outdated",
+	writeUnprocessable:  "unprocessable",
+	writeDenied:         "denied",
+	writeUnavailable:    "validation_unavailable",
+	writeInternal:       "internal",
+	writeTimedOut:       "timeout",
+}
+
+// statusRecorder captures the status code and body size of a response. It
+// passes on flushing and hijacking, which /stream and /ws depend on, and
+// unwraps for the rest of http.ResponseController.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(p []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := sr.ResponseWriter.Write(p)
+	sr.bytes += int64(n)
+	return n, err
+}
+
+func (sr *statusRecorder) Flush() {
+	if f, ok := sr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+func (sr *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := sr.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking is not supported")
+	}
+	sr.status = http.StatusSwitchingProtocols
+	return hj.Hijack()
+}
+
+// withMetrics counts the requests to route and how long they took. Routes
+// rather than request paths are the label, so clients can't blow up the
+// number of series.
+func withMetrics(route string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w}
+		h(sr, r)
+		if sr.status == 0 {
+			sr.status = http.StatusOK
+		}
+		metrics.observe(route, r.Method, sr.status, time.Since(start))
+	}
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ts, err := readValue()
+	if err != nil {
+		log(os.Stderr, "could not read timestamp: %s\n", err.Error())
+		http.Error(w, "could not read timestamp", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	bw := bufio.NewWriter(w)
+	writeMetrics(bw, ts, now())
+	if err := bw.Flush(); err != nil {
+		log(os.Stderr, "error while writing metrics: %s\n", err.Error())
+	}
+}
+
+func writeMetrics(w *bufio.Writer, ts, at time.Time) {
+	fmt.Fprintln(w, "# HELP ts_store_value_timestamp_seconds Stored timestamp, 0 while nothing is stored.")
+	fmt.Fprintln(w, "# TYPE ts_store_value_timestamp_seconds gauge")
+	fmt.Fprintf(w, "ts_store_value_timestamp_seconds %s\n", formatFloat(float64(ts.UnixNano())/1e9))
+	if ts.Unix() != 0 {
+		fmt.Fprintln(w, "# HELP ts_store_value_age_seconds Time since the stored timestamp.")
+		fmt.Fprintln(w, "# TYPE ts_store_value_age_seconds gauge")
+		fmt.Fprintf(w, "ts_store_value_age_seconds %s\n", formatFloat(at.Sub(ts).Seconds()))
+	}
+
+	metrics.mu.Lock()
+	keys := make([]requestKey, 0, len(metrics.counts))
+	for k := range metrics.counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.code < b.code
+	})
+	fmt.Fprintln(w, "# HELP ts_store_http_requests_total Requests by route, method and status code.")
+	fmt.Fprintln(w, "# TYPE ts_store_http_requests_total counter")
+	for _, k := range keys {
+		fmt.Fprintf(w, "ts_store_http_requests_total{route=%q,method=%q,code=\"%d\"} %d\n", k.route, k.method, k.code, metrics.counts[k])
+	}
+
+	routes := make([]string, 0, len(metrics.latencies))
+	for route := range metrics.latencies {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	fmt.Fprintln(w, "# HELP ts_store_http_request_duration_seconds Request latency by route.")
+	fmt.Fprintln(w, "# TYPE ts_store_http_request_duration_seconds histogram")
+	for _, route := range routes {
+		l := metrics.latencies[route]
+		var cumulative uint64
+		for i, n := range l.buckets {
+			cumulative += n
+			le := "+Inf"
+			if i < len(latencyBuckets) {
+				le = formatFloat(latencyBuckets[i])
+			}
+			fmt.Fprintf(w, "ts_store_http_request_duration_seconds_bucket{route=%q,le=%q} %d\n", route, le, cumulative)
+		}
+		fmt.Fprintf(w, "ts_store_http_request_duration_seconds_sum{route=%q} %s\n", route, formatFloat(l.sum))
+		fmt.Fprintf(w, "ts_store_http_request_duration_seconds_count{route=%q} %d\n", route, l.count)
+	}
+
+	reasons := make([]string, 0, len(metrics.rejections))
+	for reason := range metrics.rejections {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	fmt.Fprintln(w, "# HELP ts_store_rejected_writes_total Writes refused, by reason.")
+	fmt.Fprintln(w, "# TYPE ts_store_rejected_writes_total counter")
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "ts_store_rejected_writes_total{reason=%q} %d\n", reason, metrics.rejections[reason])
+	}
+	metrics.mu.Unlock()
+
+	gaps := updateGaps.snapshot()
+	fmt.Fprintln(w, "# HELP ts_store_update_gap_seconds Time between consecutive writes.")
+	fmt.Fprintln(w, "# TYPE ts_store_update_gap_seconds histogram")
+	for _, b := range gaps.Buckets {
+		fmt.Fprintf(w, "ts_store_update_gap_seconds_bucket{le=%q} %d\n", b.LE, b.Count)
+	}
+	fmt.Fprintf(w, "ts_store_update_gap_seconds_sum %s\n", formatFloat(gaps.SumSeconds))
+	fmt.Fprintf(w, "ts_store_update_gap_seconds_count %d\n", gaps.Count)
+
+	phases, took := startupPhases.snapshot()
+	fmt.Fprintln(w, "# HELP ts_store_startup_phase_duration_seconds How long each startup phase took, recover being the recovery of the stored value.")
+	fmt.Fprintln(w, "# TYPE ts_store_startup_phase_duration_seconds gauge")
+	for _, phase := range phases {
+		fmt.Fprintf(w, "ts_store_startup_phase_duration_seconds{phase=%q} %s\n", phase, formatFloat(took[phase].Seconds()))
+	}
+}
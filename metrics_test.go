@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	defer resetStore()
+	defer func(m *requestMetrics) { metrics = m }(metrics)
+	defer func(v bool) { *monotonic = v }(*monotonic)
+	metrics = newRequestMetrics()
+	*monotonic = true
+
+	srv := httptest.NewServer(newMux(map[string]http.HandlerFunc{
+		getPath:     retrieve,
+		putPath:     update,
+		metricsPath: metricsHandler,
+	}))
+	defer srv.Close()
+
+	put := func(body string) {
+		req, _ := http.NewRequest(http.MethodPut, srv.URL+apiPrefix+putPath, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentTypeText)
+		rsp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		rsp.Body.Close()
+	}
+	put("100")
+	put("50") // outdated
+	rsp, err := http.Get(srv.URL + apiPrefix + getPath)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	rsp.Body.Close()
+
+	rsp, err = http.Get(srv.URL + apiPrefix + metricsPath)
+	if err != nil {
+		t.Fatalf("could not get metrics: %v", err)
+	}
+	defer rsp.Body.Close()
+	body, _ := io.ReadAll(rsp.Body)
+	for _, expected := range []string{
+		"ts_store_value_timestamp_seconds 100\n",
+		`ts_store_http_requests_total{route="/update",method="PUT",code="200"} 1` + "\n",
+		`ts_store_http_requests_total{route="/update",method="PUT",code="409"} 1` + "\n",
+		`ts_store_http_requests_total{route="/retrieve",method="GET",code="200"} 1` + "\n",
+		`ts_store_http_request_duration_seconds_bucket{route="/update",le="+Inf"} 2` + "\n",
+		`ts_store_http_request_duration_seconds_count{route="/retrieve"} 1` + "\n",
+		`ts_store_rejected_writes_total{reason="outdated"} 1` + "\n",
+		"ts_store_update_gap_seconds_count ",
+	} {
+		if !bytes.Contains(body, []byte(expected)) {
+			t.Errorf("expected %q in metrics:\n%s", expected, body)
+		}
+	}
+}
+
+func TestWriteMetricsAge(t *testing.T) {
+	defer func(m *requestMetrics) { metrics = m }(metrics)
+	metrics = newRequestMetrics()
+	tests := []struct {
+		description string
+		ts          time.Time
+		expectAge   bool
+	}{
+		{"stored", time.Unix(100, 0), true},
+		{"missing", time.Unix(0, 0), false},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := bufio.NewWriter(&buf)
+			writeMetrics(w, test.ts, time.Unix(130, 0))
+			w.Flush()
+			hasAge := strings.Contains(buf.String(), "ts_store_value_age_seconds 30\n")
+			if hasAge != test.expectAge {
+				t.Errorf("expected age reported %v, got:\n%s", test.expectAge, buf.String())
+			}
+		})
+	}
+}
+
+func TestRejectedWriteReasons(t *testing.T) {
+	defer resetStore()
+	defer func(m *requestMetrics) { metrics = m }(metrics)
+	defer func(d time.Duration) { maxRequestAge = d }(maxRequestAge)
+	defer func(s []byte) { writeSecret = s }(writeSecret)
+	metrics = newRequestMetrics()
+	handler := newMux(map[string]http.HandlerFunc{putPath: requireRecent(update)})
+
+	tests := []struct {
+		description string
+		method      string
+		contentType string
+		body        string
+		header      map[string]string
+		secret      string
+		maxAge      time.Duration
+		reason      string
+	}{
+		{"bad method", http.MethodPost, contentTypeText, "10", nil, "", 0, rejectMethod},
+		{"unsupported content type", http.MethodPut, "application/xml", "10", nil, "", 0, rejectContentType},
+		{"parse error", http.MethodPut, contentTypeText, "soon", nil, "", 0, rejectParse},
+		{"body too large", http.MethodPut, contentTypeText, strings.Repeat("1", int(maxReqBytes)+1), nil, "", 0, rejectTooLarge},
+		{"unauthorized", http.MethodPut, contentTypeText, "10", nil, "secret", 0, rejectUnauthorized},
+		{"stale request", http.MethodPut, contentTypeText, "10", map[string]string{"X-Sent-At": time.Now().Add(-time.Hour).Format(time.RFC3339Nano)}, "", time.Minute, rejectStale},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			writeSecret = []byte(test.secret)
+			maxRequestAge = test.maxAge
+			req := httptest.NewRequest(test.method, apiPrefix+putPath, strings.NewReader(test.body))
+			req.Header.Set("Content-Type", test.contentType)
+			for k, v := range test.header {
+				req.Header.Set(k, v)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+			metrics.mu.Lock()
+			defer metrics.mu.Unlock()
+			if n := metrics.rejections[test.reason]; n != 1 {
+				t.Errorf("expected one rejection for %s, got %d in %v", test.reason, n, metrics.rejections)
+			}
+			delete(metrics.rejections, test.reason)
+		})
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// problem is an RFC 7807 problem details body
+type problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func writeProblem(w http.ResponseWriter, status int, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+	})
+	if err != nil {
+		log(os.Stderr, "error while writing problem response: %s\n", err.Error())
+	}
+}
+
+// timeoutWriter buffers the response of a handler running under a budget,
+// so nothing reaches the client if the budget is exceeded
+type timeoutWriter struct {
+	mu       sync.Mutex
+	header   http.Header
+	buf      bytes.Buffer
+	status   int
+	timedOut bool
+	// committed is set once the handler started applying a write, which
+	// it then answers itself however long it takes
+	committed bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) Write(p []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if tw.status == 0 {
+		tw.status = http.StatusOK
+	}
+	return tw.buf.Write(p)
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut || tw.status != 0 {
+		return
+	}
+	tw.status = status
+}
+
+// flush sends the buffered response, it must be called with mu held
+func (tw *timeoutWriter) flush(w http.ResponseWriter) {
+	for k, v := range tw.header {
+		w.Header()[k] = v
+	}
+	if tw.status == 0 {
+		tw.status = http.StatusOK
+	}
+	w.WriteHeader(tw.status)
+	w.Write(tw.buf.Bytes())
+}
+
+type timeoutWriterKey struct{}
+
+// beginCommit is called right before a write is applied. It reports false
+// if ctx is done, the write must not be applied then: the client is told it
+// timed out. Once it returned true a budget running out doesn't answer 504
+// anymore, the client waits for the outcome of the write instead.
+func beginCommit(ctx context.Context) bool {
+	tw, ok := ctx.Value(timeoutWriterKey{}).(*timeoutWriter)
+	if !ok {
+		return ctx.Err() == nil
+	}
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut || ctx.Err() != nil {
+		return false
+	}
+	tw.committed = true
+	return true
+}
+
+// withTimeout runs h with a context that expires after budget. If the handler
+// does not finish in time a 504 problem+json response is sent instead, unless
+// it already started applying a write, see beginCommit.
+func withTimeout(h http.HandlerFunc, budget time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), budget)
+		defer cancel()
+
+		tw := &timeoutWriter{header: make(http.Header)}
+		ctx = context.WithValue(ctx, timeoutWriterKey{}, tw)
+		done := make(chan struct{})
+		panicCh := make(chan any, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicCh <- p
+				}
+			}()
+			h(tw, r.WithContext(ctx))
+			close(done)
+		}()
+
+		select {
+		case p := <-panicCh:
+			panic(p)
+		case <-done:
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+			tw.flush(w)
+		case <-ctx.Done():
+			tw.mu.Lock()
+			if tw.committed {
+				tw.mu.Unlock()
+				select {
+				case p := <-panicCh:
+					panic(p)
+				case <-done:
+				}
+				tw.mu.Lock()
+				defer tw.mu.Unlock()
+				tw.flush(w)
+				return
+			}
+			defer tw.mu.Unlock()
+			tw.timedOut = true
+			if ctx.Err() == context.DeadlineExceeded {
+				log(os.Stderr, "handler for %s exceeded its budget of %s\n", r.URL.Path, budget)
+				writeProblem(w, http.StatusGatewayTimeout, "request exceeded its time budget")
+			}
+		}
+	}
+}
+
+// deprecated marks a legacy route with Deprecation and Sunset headers and links
+// to the route replacing it
+func deprecated(h http.HandlerFunc, successor string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Sunset", legacySunset.Format(http.TimeFormat))
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+		h(w, r)
+	}
+}
+
+// maxRequestAge is how far the sender's clock reading may be from the server's
+// before a write is rejected, 0 disables the check
+var maxRequestAge time.Duration
+
+func init() {
+	flag.DurationVar(&maxRequestAge, "max-request-age", 0, "reject writes whose X-Sent-At or Date is further than this from server time, 0 disables the check")
+	flag.DurationVar(&hstsMaxAge, "hsts-max-age", 0, "send Strict-Transport-Security with this max-age, 0 omits it, only for deployments behind TLS")
+}
+
+var (
+	errSentAtRequired = errors.New("send time required")
+	errRequestTooOld  = errors.New("request is too old")
+)
+
+// checkRequestAge rejects writes sent at sentAt, as the sender's clock read
+// it, further than maxRequestAge from server time, counting why in
+// /metrics. A zero sentAt means the sender didn't say.
+func checkRequestAge(sentAt time.Time) error {
+	if maxRequestAge <= 0 {
+		return nil
+	}
+	if sentAt.IsZero() {
+		metrics.reject(rejectInvalid)
+		return errSentAtRequired
+	}
+	age := now().Sub(sentAt)
+	if age > maxRequestAge || age < -maxRequestAge {
+		log(os.Stderr, "rejected request sent at %s\n", sentAt.Format(time.RFC3339))
+		metrics.reject(rejectStale)
+		return errRequestTooOld
+	}
+	return nil
+}
+
+// requireRecent rejects requests whose X-Sent-At (RFC 3339) or Date header is
+// missing or outside of maxRequestAge, so replayed or long-delayed writes are
+// not treated as fresh. A missing or malformed header is a 400, a request
+// too old or too far ahead a 403, so clients can tell the two apart.
+func requireRecent(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if maxRequestAge <= 0 {
+			h(w, r)
+			return
+		}
+		sentAt, err := requestSentAt(r)
+		if err != nil {
+			log(os.Stderr, "could not determine request age: %s\n", err.Error())
+			sentAt = time.Time{}
+		}
+		switch err := checkRequestAge(sentAt); {
+		case errors.Is(err, errRequestTooOld):
+			http.Error(w, err.Error(), http.StatusForbidden)
+		case err != nil:
+			http.Error(w, "X-Sent-At or Date header required", http.StatusBadRequest)
+		default:
+			h(w, r)
+		}
+	}
+}
+
+func requestSentAt(r *http.Request) (time.Time, error) {
+	if v := r.Header.Get("X-Sent-At"); v != "" {
+		return time.Parse(time.RFC3339Nano, v)
+	}
+	if v := r.Header.Get("Date"); v != "" {
+		return http.ParseTime(v)
+	}
+	return time.Time{}, errors.New("no X-Sent-At or Date header")
+}
+
+var (
+	// hstsMaxAge sets Strict-Transport-Security on every response, 0 omits it.
+	// Only enable it when the service is reached over TLS.
+	hstsMaxAge time.Duration
+	// customResponseHeaders are set on every response, after the defaults
+	customResponseHeaders = http.Header{}
+	responseHeaderSpecs   stringList
+)
+
+func init() {
+	flag.Var(&responseHeaderSpecs, "response-header", "'Name: value' header set on every response, overriding the defaults, can be repeated")
+}
+
+// parseResponseHeaders parses -response-header values. Headers given more
+// than once get every value.
+func parseResponseHeaders(specs []string) (http.Header, error) {
+	hdr := http.Header{}
+	for _, spec := range specs {
+		name, value, ok := strings.Cut(spec, ":")
+		if !ok {
+			return nil, fmt.Errorf("%q is not a 'Name: value' header", spec)
+		}
+		if !validHeaderName(name) {
+			return nil, fmt.Errorf("%q is not a valid header name", name)
+		}
+		value = strings.TrimSpace(value)
+		if strings.ContainsAny(value, "\r\n\x00") {
+			return nil, fmt.Errorf("value of %s contains a line break", name)
+		}
+		hdr.Add(name, value)
+	}
+	return hdr, nil
+}
+
+// validHeaderName reports whether name is a token as defined by RFC 9110
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("!#$%&'*+-.^_`|~", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// withResponseHeaders applies the security baseline and any configured headers.
+// net/http does not identify itself with a Server header, so there is nothing
+// to strip there.
+func withResponseHeaders(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hdr := w.Header()
+		hdr.Set("X-Content-Type-Options", "nosniff")
+		hdr.Set("X-Frame-Options", "DENY")
+		hdr.Set("Cache-Control", "no-store")
+		if hstsMaxAge > 0 {
+			hdr.Set("Strict-Transport-Security", fmt.Sprintf("max-age=%d; includeSubDomains", int64(hstsMaxAge.Seconds())))
+		}
+		for k, v := range customResponseHeaders {
+			hdr[k] = v
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+var (
+	accessLog = flag.Bool("access-log", false, "log every request with its status, response size and duration")
+	// accessLogOutput receives the access log lines
+	accessLogOutput io.Writer = os.Stdout
+)
+
+// withAccessLog writes one logfmt line per request once it has been answered.
+// The query is left out, as it can carry confirm tokens and webhook URLs.
+func withAccessLog(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !*accessLog {
+			h.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(sr, r)
+		if sr.status == 0 {
+			sr.status = http.StatusOK
+		}
+		log(accessLogOutput, "time=%s method=%s path=%q status=%d bytes=%d duration=%s remote=%s writer=%q\n",
+			start.UTC().Format(time.RFC3339Nano), r.Method, r.URL.Path, sr.status, sr.bytes, time.Since(start), r.RemoteAddr, writer(r))
+	})
+}
+
+// withDevSimulation delays responses by devLatency and reports the skewed
+// server clock in the Date header. Both are no-ops unless set by flag.
+func withDevSimulation(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if *devClockSkew != 0 {
+			w.Header().Set("Date", now().UTC().Format(http.TimeFormat))
+		}
+		if *devLatency > 0 {
+			select {
+			case <-time.After(*devLatency):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWithTimeout(t *testing.T) {
+	type tc struct {
+		description        string
+		handler            http.HandlerFunc
+		expectedStatusCode int
+		expectedBody       string
+		expectedType       string
+	}
+	testCases := []tc{
+		{
+			description: "within budget",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				w.WriteHeader(http.StatusCreated)
+				w.Write([]byte("done"))
+			},
+			expectedStatusCode: http.StatusCreated,
+			expectedBody:       "done",
+			expectedType:       "text/plain",
+		},
+		{
+			description: "implicit OK",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("ok"))
+			},
+			expectedStatusCode: http.StatusOK,
+			expectedBody:       "ok",
+		},
+		{
+			description: "budget exceeded",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				<-r.Context().Done()
+				w.Write([]byte("too late"))
+			},
+			expectedStatusCode: http.StatusGatewayTimeout,
+			expectedType:       "application/problem+json",
+		},
+		{
+			description: "write committed within budget",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				if !beginCommit(r.Context()) {
+					t.Error("commit refused within budget")
+				}
+				<-r.Context().Done()
+				w.Write([]byte("applied"))
+			},
+			expectedStatusCode: http.StatusOK,
+			expectedBody:       "applied",
+		},
+		{
+			description: "write committed past budget",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				<-r.Context().Done()
+				if beginCommit(r.Context()) {
+					t.Error("commit allowed past budget")
+				}
+			},
+			expectedStatusCode: http.StatusGatewayTimeout,
+			expectedType:       "application/problem+json",
+		},
+	}
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, getRetrievePath(), nil)
+			w := httptest.NewRecorder()
+			withTimeout(test.handler, 50*time.Millisecond)(w, req)
+			res := w.Result()
+			defer res.Body.Close()
+			if res.StatusCode != test.expectedStatusCode {
+				t.Errorf("expected status code to be %d, got: %d", test.expectedStatusCode, res.StatusCode)
+			}
+			if ct := res.Header.Get("Content-Type"); test.expectedType != "" && ct != test.expectedType {
+				t.Errorf("expected content type %s, got: %s", test.expectedType, ct)
+			}
+			data, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Errorf("could not read response body: %v", err)
+			}
+			if test.expectedStatusCode == http.StatusGatewayTimeout {
+				var p problem
+				if err := json.Unmarshal(data, &p); err != nil {
+					t.Fatalf("could not decode problem body: %v", err)
+				}
+				if p.Status != http.StatusGatewayTimeout {
+					t.Errorf("unexpected problem status: %d", p.Status)
+				}
+				return
+			}
+			if string(data) != test.expectedBody {
+				t.Errorf("expected %s, got %s", test.expectedBody, string(data))
+			}
+		})
+	}
+}
+
+func TestRequireRecent(t *testing.T) {
+	defer func() { maxRequestAge = 0 }()
+
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	now := time.Now()
+	type tc struct {
+		description        string
+		maxAge             time.Duration
+		headers            map[string]string
+		expectedStatusCode int
+	}
+	testCases := []tc{
+		{"disabled", 0, nil, http.StatusOK},
+		{"missing headers", time.Minute, nil, http.StatusBadRequest},
+		{"fresh X-Sent-At", time.Minute, map[string]string{"X-Sent-At": now.Format(time.RFC3339Nano)}, http.StatusOK},
+		{"old X-Sent-At", time.Minute, map[string]string{"X-Sent-At": now.Add(-2 * time.Minute).Format(time.RFC3339Nano)}, http.StatusForbidden},
+		{"future X-Sent-At", time.Minute, map[string]string{"X-Sent-At": now.Add(2 * time.Minute).Format(time.RFC3339Nano)}, http.StatusForbidden},
+		{"fresh Date", time.Minute, map[string]string{"Date": now.UTC().Format(http.TimeFormat)}, http.StatusOK},
+		{"old Date", time.Minute, map[string]string{"Date": now.Add(-time.Hour).UTC().Format(http.TimeFormat)}, http.StatusForbidden},
+		{"unparsable", time.Minute, map[string]string{"X-Sent-At": "yesterday"}, http.StatusBadRequest},
+	}
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			maxRequestAge = test.maxAge
+			req := httptest.NewRequest(http.MethodPut, getStorePath(), nil)
+			for k, v := range test.headers {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			requireRecent(ok)(w, req)
+			if w.Code != test.expectedStatusCode {
+				t.Errorf("expected status code to be %d, got: %d", test.expectedStatusCode, w.Code)
+			}
+		})
+	}
+}
+
+func TestMaxRequestAgeFlag(t *testing.T) {
+	defer resetStore()
+	if err := configureForTest(t, "-max-request-age", "1m"); err != nil {
+		t.Fatalf("could not configure: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodPut, apiPrefix+putPath, bytes.NewReader([]byte("42")))
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("X-Sent-At", time.Now().Add(-time.Hour).Format(time.RFC3339Nano))
+	w := httptest.NewRecorder()
+	httpServer.Handler.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected a write sent an hour ago to be refused with %d, got: %d", http.StatusForbidden, w.Code)
+	}
+}
+
+func TestWithResponseHeaders(t *testing.T) {
+	defer func() {
+		hstsMaxAge = 0
+		customResponseHeaders = http.Header{}
+	}()
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	w := httptest.NewRecorder()
+	withResponseHeaders(ok).ServeHTTP(w, httptest.NewRequest(http.MethodGet, getRetrievePath(), nil))
+	if v := w.Header().Get("X-Content-Type-Options"); v != "nosniff" {
+		t.Errorf("unexpected X-Content-Type-Options: %s", v)
+	}
+	if v := w.Header().Get("Strict-Transport-Security"); v != "" {
+		t.Errorf("HSTS should be off by default, got: %s", v)
+	}
+
+	hstsMaxAge = 365 * 24 * time.Hour
+	customResponseHeaders.Set("X-Frame-Options", "SAMEORIGIN")
+	customResponseHeaders.Set("X-Owner", "platform")
+	w = httptest.NewRecorder()
+	withResponseHeaders(ok).ServeHTTP(w, httptest.NewRequest(http.MethodGet, getRetrievePath(), nil))
+	if v := w.Header().Get("Strict-Transport-Security"); v != "max-age=31536000; includeSubDomains" {
+		t.Errorf("unexpected HSTS header: %s", v)
+	}
+	if v := w.Header().Get("X-Frame-Options"); v != "SAMEORIGIN" {
+		t.Errorf("custom header should override default, got: %s", v)
+	}
+	if v := w.Header().Get("X-Owner"); v != "platform" {
+		t.Errorf("custom header missing, got: %s", v)
+	}
+}
+
+func TestResponseHeaderFlag(t *testing.T) {
+	tests := []struct {
+		description string
+		args        []string
+		wantErr     bool
+		expected    http.Header
+	}{
+		{"none", nil, false, http.Header{}},
+		{"headers", []string{"-response-header", "X-Owner: platform", "-response-header", "X-Frame-Options:SAMEORIGIN"}, false, http.Header{"X-Owner": {"platform"}, "X-Frame-Options": {"SAMEORIGIN"}}},
+		{"repeated header", []string{"-response-header", "Vary: Accept", "-response-header", "Vary: Origin"}, false, http.Header{"Vary": {"Accept", "Origin"}}},
+		{"no colon", []string{"-response-header", "X-Owner platform"}, true, nil},
+		{"invalid name", []string{"-response-header", "X Owner: platform"}, true, nil},
+		{"empty name", []string{"-response-header", ": platform"}, true, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			err := configureForTest(t, test.args...)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("configure(%q) = %v, want error %t", test.args, err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			w := httptest.NewRecorder()
+			httpServer.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, apiPrefix+getPath, nil))
+			for name, values := range test.expected {
+				if got := w.Header().Values(name); strings.Join(got, ",") != strings.Join(values, ",") {
+					t.Errorf("expected %s: %q, got: %q", name, values, got)
+				}
+			}
+		})
+	}
+}
+
+func TestWithDevSimulation(t *testing.T) {
+	defer func() {
+		*devLatency = 0
+		*devClockSkew = 0
+	}()
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	*devLatency = 100 * time.Millisecond
+	*devClockSkew = -time.Hour
+	start := time.Now()
+	w := httptest.NewRecorder()
+	withDevSimulation(ok).ServeHTTP(w, httptest.NewRequest(http.MethodGet, getRetrievePath(), nil))
+	if elapsed := time.Since(start); elapsed < *devLatency {
+		t.Errorf("expected response to be delayed by %s, took: %s", *devLatency, elapsed)
+	}
+	date, err := http.ParseTime(w.Header().Get("Date"))
+	if err != nil {
+		t.Fatalf("could not parse Date header: %v", err)
+	}
+	if skew := time.Until(date); skew > -59*time.Minute || skew < -61*time.Minute {
+		t.Errorf("expected Date to be skewed by an hour, got: %s", skew)
+	}
+
+	// the skewed clock is also what request age is judged against
+	maxRequestAge = time.Minute
+	defer func() { maxRequestAge = 0 }()
+	req := httptest.NewRequest(http.MethodPut, getStorePath(), nil)
+	req.Header.Set("X-Sent-At", time.Now().Format(time.RFC3339Nano))
+	w = httptest.NewRecorder()
+	requireRecent(ok)(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected skewed server to reject request, got: %d", w.Code)
+	}
+}
+
+func TestWithAccessLog(t *testing.T) {
+	defer func(v bool, w io.Writer) { *accessLog, accessLogOutput = v, w }(*accessLog, accessLogOutput)
+	var buf strings.Builder
+	accessLogOutput = &buf
+	h := withAccessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("short and stout"))
+	}))
+
+	tests := []struct {
+		description string
+		enabled     bool
+		expected    []string
+	}{
+		{"disabled", false, nil},
+		{"enabled", true, []string{"method=PUT ", `path="/v1/update" `, "status=418 ", "bytes=15 ", "duration=", `writer="w1"`}},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			buf.Reset()
+			*accessLog = test.enabled
+			req := httptest.NewRequest(http.MethodPut, "/v1/update?url=secret", nil)
+			req.Header.Set(writerIDHeader, "w1")
+			h.ServeHTTP(httptest.NewRecorder(), req)
+			line := buf.String()
+			if test.expected == nil && line != "" {
+				t.Errorf("expected nothing to be logged, got: %q", line)
+			}
+			for _, expected := range test.expected {
+				if !strings.Contains(line, expected) {
+					t.Errorf("expected %q in %q", expected, line)
+				}
+			}
+			if strings.Contains(line, "secret") || strings.Count(line, "\n") > 1 {
+				t.Errorf("expected one line without the query, got: %q", line)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterBackend("file", func(location string) (Store, error) {
+		if location == "" {
+			return nil, errors.New("file backend requires a data file")
+		}
+		return newFileStore(location), nil
+	})
+}
+
+// fileStore keeps the timestamp in memory and persists every update to a file,
+// so the value survives restarts. The file is replaced atomically by writing
+// a temporary file and renaming it over the old one.
+//
+// A durable backend loads its state (and the wal backend replays its log on
+// top of it) before its factory returns, which is the recover phase of
+// startup, see startup.go.
+type fileStore struct {
+	dataStore
+	mu   sync.Mutex
+	path string
+	// expiresAt is the deadline persisted with the value, zero for none
+	expiresAt time.Time
+}
+
+// newFileStore restores the last value from path. A missing file starts from
+// Unix(0, 0), as does a corrupt one after logging the problem.
+func newFileStore(path string) *fileStore {
+	s := &fileStore{path: path}
+	ts, expiresAt, err := readStateFile(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		log(os.Stderr, "ignoring corrupt state file %s: %s\n", path, err.Error())
+	default:
+		s.dataStore.Set(&ts)
+		s.expiresAt = expiresAt
+	}
+	return s
+}
+
+func (s *fileStore) Set(ts *time.Time) error {
+	return s.SetExpiring(ts, time.Time{})
+}
+
+// SetExpiring only updates the in-memory value once it is persisted
+func (s *fileStore) SetExpiring(ts *time.Time, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := writeStateFile(s.path, ts, expiresAt); err != nil {
+		return fmt.Errorf("could not persist timestamp: %w", err)
+	}
+	s.expiresAt = expiresAt
+	return s.dataStore.Set(ts)
+}
+
+func (s *fileStore) Expiry() (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.expiresAt, nil
+}
+
+func (s *fileStore) Durable() bool {
+	return true
+}
+
+// the state file holds "<unix seconds> <crc32 of the seconds>\n", the seconds
+// having a fraction when the value has sub-second precision. A value with a
+// TTL has its deadline, in the same format, after the seconds and before
+// the checksum, which covers both.
+func encodeState(ts, expiresAt time.Time) []byte {
+	payload := formatStateTime(ts)
+	if !expiresAt.IsZero() {
+		payload += " " + formatStateTime(expiresAt)
+	}
+	return []byte(fmt.Sprintf("%s %08x\n", payload, crc32.ChecksumIEEE([]byte(payload))))
+}
+
+// formatStateTime writes whole seconds as before sub-second precision was
+// supported, so older releases can still read them
+func formatStateTime(ts time.Time) string {
+	sec := strconv.FormatInt(ts.Unix(), 10)
+	if ts.Nanosecond() != 0 {
+		sec += fmt.Sprintf(".%09d", ts.Nanosecond())
+	}
+	return sec
+}
+
+func parseStateTime(v string) (time.Time, error) {
+	sec, frac, ok := strings.Cut(v, ".")
+	ts, err := timestamp(sec).toUnixTime()
+	if err != nil || !ok {
+		return ts, err
+	}
+	nsec, err := strconv.ParseUint(frac, 10, 32)
+	if err != nil || len(frac) != 9 {
+		return time.Time{}, errors.New("invalid fraction of a second")
+	}
+	return ts.Add(time.Duration(nsec)), nil
+}
+
+func decodeState(data []byte) (ts, expiresAt time.Time, err error) {
+	line := strings.TrimSuffix(string(data), "\n")
+	i := strings.LastIndexByte(line, ' ')
+	if i < 0 {
+		return time.Time{}, time.Time{}, errors.New("malformed state")
+	}
+	payload, sum := line[:i], line[i+1:]
+	if fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(payload))) != sum {
+		return time.Time{}, time.Time{}, errors.New("checksum mismatch")
+	}
+	sec, expiry, hasExpiry := strings.Cut(payload, " ")
+	if ts, err = parseStateTime(sec); err != nil || !hasExpiry {
+		return ts, time.Time{}, err
+	}
+	if expiresAt, err = parseStateTime(expiry); err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid expiry: %w", err)
+	}
+	return ts, expiresAt, nil
+}
+
+func readStateFile(path string) (ts, expiresAt time.Time, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return decodeState(data)
+}
+
+// writeStateFile atomically replaces the state file, a nil ts removes it
+func writeStateFile(path string, ts *time.Time, expiresAt time.Time) error {
+	if ts == nil {
+		if err := os.Remove(path); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		return syncDir(filepath.Dir(path))
+	}
+	return writeFileAtomic(path, encodeState(*ts, expiresAt))
+}
+
+// writeFileAtomic replaces path with data, so readers see either the old or
+// the new content but never a partial write. It returns once the new content
+// survives a crash, rename included.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	// make sure the data is on disk before it replaces the old state
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir flushes the entries of dir, which renames and removals change, to
+// disk
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
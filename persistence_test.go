@@ -0,0 +1,130 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state")
+
+	s := newFileStore(path)
+	if mustGet(t, s).Unix() != 0 {
+		t.Errorf("new store should start at 0, got: %d", mustGet(t, s).Unix())
+	}
+	ts := time.Unix(1234567, 0)
+	if err := s.Set(&ts); err != nil {
+		t.Fatalf("could not store: %v", err)
+	}
+
+	restored := newFileStore(path)
+	if mustGet(t, restored).Unix() != 1234567 {
+		t.Errorf("value was not restored, got: %d", mustGet(t, restored).Unix())
+	}
+
+	if err := restored.Set(nil); err != nil {
+		t.Fatalf("could not reset: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("state file should be removed on reset, stat: %v", err)
+	}
+	if mustGet(t, newFileStore(path)).Unix() != 0 {
+		t.Error("reset value was restored")
+	}
+}
+
+func TestStateTime(t *testing.T) {
+	tests := []struct {
+		description string
+		ts          time.Time
+		expected    string
+	}{
+		{"whole seconds", time.Unix(99, 0), "99"},
+		{"milliseconds", time.Unix(99, 5000000), "99.005000000"},
+		{"nanoseconds", time.Unix(99, 1), "99.000000001"},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			v := formatStateTime(test.ts)
+			if v != test.expected {
+				t.Errorf("expected %s, got: %s", test.expected, v)
+			}
+			got, err := parseStateTime(v)
+			if err != nil {
+				t.Fatalf("could not parse %s: %v", v, err)
+			}
+			if !got.Equal(test.ts) {
+				t.Errorf("expected %s, got: %s", test.ts, got)
+			}
+		})
+	}
+	for _, v := range []string{"99.5", "99.", "99.x00000000", "-1.000000000"} {
+		if _, err := parseStateTime(v); err == nil {
+			t.Errorf("expected %q to be rejected", v)
+		}
+	}
+}
+
+func TestFileStoreRecovery(t *testing.T) {
+	tests := []struct {
+		description string
+		content     string
+		expectedTs  int64
+	}{
+		{"valid", string(encodeState(time.Unix(99, 0), time.Time{})), 99},
+		{"valid with expiry", string(encodeState(time.Unix(99, 0), time.Unix(120, 5))), 99},
+		{"bad expiry", "99 x 00000000\n", 0},
+		{"empty", "", 0},
+		{"truncated", "12345", 0},
+		{"bad checksum", "12345 00000000\n", 0},
+		{"garbage", "\x00\x01\x02", 0},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "state")
+			if err := os.WriteFile(path, []byte(test.content), 0o600); err != nil {
+				t.Fatalf("could not write state file: %v", err)
+			}
+			if got := mustGet(t, newFileStore(path)).Unix(); got != test.expectedTs {
+				t.Errorf("expected %d, got: %d", test.expectedTs, got)
+			}
+		})
+	}
+}
+
+func TestFileStoreWriteFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing-dir", "state")
+	s := newFileStore(path)
+	ts := time.Unix(5, 0)
+	if err := s.Set(&ts); err == nil {
+		t.Fatal("expected an error when the state can't be persisted")
+	}
+	if mustGet(t, s).Unix() != 0 {
+		t.Error("value that could not be persisted should not be served")
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state")
+	for _, content := range []string{"first", "second"} {
+		if err := writeFileAtomic(path, []byte(content)); err != nil {
+			t.Fatalf("could not write %q: %v", content, err)
+		}
+		if data, err := os.ReadFile(path); err != nil || string(data) != content {
+			t.Errorf("expected %q, got %q: %v", content, data, err)
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected only the state file to be left, got %d entries", len(entries))
+	}
+	if err := syncDir(filepath.Join(dir, "missing")); err == nil {
+		t.Error("expected an error syncing a missing directory")
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	pollAfterHeader = "X-Poll-After"
+	minPollAfter    = 1 * time.Second
+	maxPollAfter    = 5 * time.Minute
+	// weight of the newest gap in the moving average
+	cadenceWeight = 0.25
+)
+
+// cadence tracks how often the value is updated, so pollers can be told how
+// long to wait before asking again
+type cadence struct {
+	mu   sync.Mutex
+	last time.Time
+	avg  time.Duration
+}
+
+var updateCadence = &cadence{}
+
+func (c *cadence) observe(at time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.last.IsZero() {
+		gap := at.Sub(c.last)
+		if c.avg == 0 {
+			c.avg = gap
+		} else {
+			c.avg = time.Duration(cadenceWeight*float64(gap) + (1-cadenceWeight)*float64(c.avg))
+		}
+	}
+	c.last = at
+}
+
+// pollAfter suggests polling at half the observed update interval, or returns
+// 0 while there is not enough history to tell
+func (c *cadence) pollAfter() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.avg <= 0 {
+		return 0
+	}
+	hint := c.avg / 2
+	if hint < minPollAfter {
+		hint = minPollAfter
+	}
+	if hint > maxPollAfter {
+		hint = maxPollAfter
+	}
+	return hint
+}
+
+func formatPollAfter(d time.Duration) string {
+	return strconv.FormatInt(int64(d/time.Second), 10)
+}
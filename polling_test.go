@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCadence(t *testing.T) {
+	start := time.Unix(1000, 0)
+	tests := []struct {
+		description string
+		gaps        []time.Duration
+		expected    time.Duration
+	}{
+		{"no writes", nil, 0},
+		{"single write", []time.Duration{0}, 0},
+		{"steady", []time.Duration{0, time.Minute, time.Minute, time.Minute}, 30 * time.Second},
+		{"too frequent", []time.Duration{0, 100 * time.Millisecond}, minPollAfter},
+		{"rare", []time.Duration{0, 24 * time.Hour}, maxPollAfter},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			c := &cadence{}
+			at := start
+			for _, gap := range test.gaps {
+				at = at.Add(gap)
+				c.observe(at)
+			}
+			if got := c.pollAfter(); got != test.expected {
+				t.Errorf("expected %s, got: %s", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestRetrievePollHint(t *testing.T) {
+	defer func(c *cadence) { updateCadence = c }(updateCadence)
+	updateCadence = &cadence{}
+
+	get := func() *http.Response {
+		w := httptest.NewRecorder()
+		retrieve(w, httptest.NewRequest(http.MethodGet, getRetrievePath(), nil))
+		return w.Result()
+	}
+	if v := get().Header.Get(pollAfterHeader); v != "" {
+		t.Errorf("no hint expected without history, got: %s", v)
+	}
+	updateCadence.observe(time.Unix(0, 0))
+	updateCadence.observe(time.Unix(120, 0))
+	if v := get().Header.Get(pollAfterHeader); v != "60" {
+		t.Errorf("expected hint of 60 seconds, got: %s", v)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"flag"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The public listener is reachable by anyone, so each client address gets
+// a token bucket refilled at -public-rate requests per second, holding up to
+// -public-burst requests. The internal listener is not limited.
+var (
+	publicListen = flag.String("public-listen", "", "address of a second listener serving only the read routes, like :8081, disabled if empty")
+	publicRate   = flag.Float64("public-rate", 10, "requests per second each client may make on -public-listen, 0 for no limit")
+	publicBurst  = flag.Int("public-burst", 20, "requests each client may make at once on -public-listen")
+)
+
+// maxLimitedClients bounds the buckets kept, beyond it the buckets of
+// clients that have been idle long enough to be full again are dropped
+const maxLimitedClients = 10000
+
+type bucket struct {
+	tokens float64
+	at     time.Time
+}
+
+// rateLimiter is a token bucket per client address
+type rateLimiter struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		now:     time.Now,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// allow takes a token from the bucket of client. When it is empty it
+// reports how long until the next token instead.
+func (l *rateLimiter) allow(client string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	b, ok := l.buckets[client]
+	if !ok {
+		if len(l.buckets) >= maxLimitedClients {
+			l.dropIdle(now)
+		}
+		b = &bucket{tokens: l.burst, at: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.at).Seconds()*l.rate)
+	b.at = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// dropIdle forgets the clients whose bucket has refilled, as a new bucket
+// would be the same
+func (l *rateLimiter) dropIdle(now time.Time) {
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.at).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// withRateLimit answers 429 to clients over the limit, with a Retry-After of
+// the seconds until they may try again
+func withRateLimit(l *rateLimiter, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			client = r.RemoteAddr
+		}
+		if ok, wait := l.allow(client); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeProblem(w, http.StatusTooManyRequests, "rate limit exceeded")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
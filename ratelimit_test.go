@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	at := time.Unix(1700000000, 0)
+	l := newRateLimiter(2, 3)
+	l.now = func() time.Time { return at }
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.allow("a"); !ok {
+			t.Fatalf("request %d within the burst was refused", i+1)
+		}
+	}
+	ok, wait := l.allow("a")
+	if ok {
+		t.Fatal("request over the burst was allowed")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("expected to wait 500ms, got %s", wait)
+	}
+	if ok, _ := l.allow("b"); !ok {
+		t.Error("another client was refused")
+	}
+	at = at.Add(wait)
+	if ok, _ := l.allow("a"); !ok {
+		t.Error("request after the wait was refused")
+	}
+	at = at.Add(time.Hour)
+	l.dropIdle(at)
+	if len(l.buckets) != 0 {
+		t.Errorf("expected idle clients to be dropped, %d left", len(l.buckets))
+	}
+}
+
+func TestWithRateLimit(t *testing.T) {
+	l := newRateLimiter(1, 1)
+	h := withRateLimit(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		description        string
+		remoteAddr         string
+		expectedStatusCode int
+	}{
+		{"first request", "192.0.2.1:1234", http.StatusOK},
+		{"same client on another port", "192.0.2.1:4321", http.StatusTooManyRequests},
+		{"other client", "192.0.2.2:1234", http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, apiPrefix+getPath, nil)
+			req.RemoteAddr = test.remoteAddr
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			if w.Code != test.expectedStatusCode {
+				t.Errorf("expected status code to be %d, got: %d", test.expectedStatusCode, w.Code)
+			}
+			if w.Code == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "1" {
+				t.Errorf("unexpected Retry-After: %q", w.Header().Get("Retry-After"))
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Redirects move clients to another deployment, e.g. during a blue/green
+// cutover. A -redirect rule is source=target: a source starting with / is a
+// path prefix, which the target URL replaces, anything else a hostname,
+// whose requests are sent to the same path and query under the target. The
+// first matching rule wins. 307 and 308 both keep the method and body, so
+// writes follow the redirect too.
+//
+// With -redirect-secret the server signs the Location of every redirect in
+// X-Redirect-Signature, and the client only follows redirects carrying a
+// valid signature, which lets it keep sending its write token to the new
+// deployment.
+const redirectSignatureHeader = "X-Redirect-Signature"
+
+var (
+	redirectRules  stringList
+	redirectStatus = flag.Int("redirect-status", http.StatusTemporaryRedirect, "status of -redirect responses, 307 or 308")
+	redirectSecret = flag.String("redirect-secret", "", "key signing redirects, the client then only follows signed ones")
+)
+
+func init() {
+	flag.Var(&redirectRules, "redirect", "source=target redirect, source being a path prefix like /v1/retrieve or a hostname, can be repeated")
+}
+
+type redirectRule struct {
+	host   string // lowercase hostname, or "" for a path rule
+	prefix string
+	target *url.URL
+}
+
+// redirects is empty unless -redirect is given
+var redirects []redirectRule
+
+func parseRedirectRules(specs []string) ([]redirectRule, error) {
+	var rules []redirectRule
+	for _, spec := range specs {
+		source, target, ok := strings.Cut(spec, "=")
+		if !ok || source == "" {
+			return nil, fmt.Errorf("invalid redirect %q, expected source=target", spec)
+		}
+		u, err := url.Parse(target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid redirect target %q", target)
+		}
+		rule := redirectRule{target: u}
+		if strings.HasPrefix(source, "/") {
+			rule.prefix = source
+		} else {
+			rule.host = strings.ToLower(source)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func validRedirectStatus(status int) error {
+	if status != http.StatusTemporaryRedirect && status != http.StatusPermanentRedirect {
+		return errors.New("redirect status must be 307 or 308")
+	}
+	return nil
+}
+
+// location returns where r is redirected to, or "" if the rule doesn't match
+func (rule redirectRule) location(r *http.Request) string {
+	target := *rule.target
+	if rule.host != "" {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if !strings.EqualFold(host, rule.host) {
+			return ""
+		}
+		target.Path = strings.TrimSuffix(target.Path, "/") + r.URL.Path
+	} else {
+		if !strings.HasPrefix(r.URL.Path, rule.prefix) {
+			return ""
+		}
+		target.Path = strings.TrimSuffix(target.Path, "/") + strings.TrimPrefix(r.URL.Path, rule.prefix)
+	}
+	target.RawPath = ""
+	target.RawQuery = r.URL.RawQuery
+	return target.String()
+}
+
+func signRedirect(secret, location string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(location))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// withRedirects answers requests matching a redirect rule before they reach
+// the routes
+func withRedirects(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, rule := range redirects {
+			location := rule.location(r)
+			if location == "" {
+				continue
+			}
+			if *redirectSecret != "" {
+				w.Header().Set(redirectSignatureHeader, signRedirect(*redirectSecret, location))
+			}
+			http.Redirect(w, r, location, *redirectStatus)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// maxRedirects matches the default of net/http
+const maxRedirects = 10
+
+var errUnsignedRedirect = errors.New("refusing to follow a redirect without a valid signature")
+
+// checkSignedRedirect is the client's redirect policy. Without a
+// -redirect-secret it behaves like the net/http default. With one, it only
+// follows redirects signed with it, and as those come from the store itself
+// it keeps sending the Authorization header to the new location.
+func checkSignedRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+	if *redirectSecret == "" {
+		return nil
+	}
+	location := req.Response.Header.Get("Location")
+	expected := signRedirect(*redirectSecret, location)
+	if !hmac.Equal([]byte(expected), []byte(req.Response.Header.Get(redirectSignatureHeader))) {
+		return errUnsignedRedirect
+	}
+	if auth := via[0].Header.Get("Authorization"); auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRedirectRules(t *testing.T) {
+	rules, err := parseRedirectRules([]string{
+		"/v1/retrieve=https://green.example.com/v1/retrieve",
+		"Blue.Example.com=https://green.example.com/",
+	})
+	if err != nil {
+		t.Fatalf("could not parse rules: %v", err)
+	}
+
+	tests := []struct {
+		description string
+		host        string
+		target      string
+		expected    string
+	}{
+		{"path", "localhost", "/v1/retrieve?format=rfc3339", "https://green.example.com/v1/retrieve?format=rfc3339"},
+		{"host", "blue.example.com:8080", "/v1/update", "https://green.example.com/v1/update"},
+		{"no match", "localhost", "/v1/update", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, test.target, nil)
+			r.Host = test.host
+			got := ""
+			for _, rule := range rules {
+				if got = rule.location(r); got != "" {
+					break
+				}
+			}
+			if got != test.expected {
+				t.Errorf("expected %q, got: %q", test.expected, got)
+			}
+		})
+	}
+
+	for _, spec := range []string{"nothing", "=https://example.com", "/v1=ftp://example.com", "/v1=/v2"} {
+		if _, err := parseRedirectRules([]string{spec}); err == nil {
+			t.Errorf("expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestSignedRedirect(t *testing.T) {
+	defer initClient(defaultTimeout)
+	defer func(rules []redirectRule, secret string) { redirects, *redirectSecret = rules, secret }(redirects, *redirectSecret)
+
+	var gotAuth, gotBody string
+	green := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		body, _ := io.ReadAll(r.Body)
+		gotBody = string(body)
+	}))
+	defer green.Close()
+	blue := httptest.NewServer(newMux(map[string]http.HandlerFunc{putPath: update}))
+	defer blue.Close()
+
+	rules, err := parseRedirectRules([]string{"/v1=" + green.URL + "/v1"})
+	if err != nil {
+		t.Fatalf("could not parse rules: %v", err)
+	}
+	redirects = rules
+	initClient(defaultTimeout)
+
+	put := func() error {
+		gotAuth, gotBody = "", ""
+		req, err := http.NewRequest(http.MethodPut, blue.URL+apiPrefix+putPath, strings.NewReader("42"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", totpScheme+" 12345678")
+		rsp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		rsp.Body.Close()
+		return nil
+	}
+
+	// unsigned redirects are followed like net/http does, without credentials
+	*redirectSecret = ""
+	if err := put(); err != nil {
+		t.Fatalf("expected the redirect to be followed, got: %v", err)
+	}
+	if gotBody != "42" {
+		t.Errorf("expected the write to be resent, got: %q", gotBody)
+	}
+
+	*redirectSecret = "secret"
+	if err := put(); err != nil {
+		t.Fatalf("expected the signed redirect to be followed, got: %v", err)
+	}
+	if gotAuth != totpScheme+" 12345678" || gotBody != "42" {
+		t.Errorf("expected the write and its token to be resent, got %q with %q", gotBody, gotAuth)
+	}
+
+	// a client with a secret refuses redirects signed with another
+	blueSecret := "other"
+	blue.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		location := green.URL + r.URL.Path
+		w.Header().Set(redirectSignatureHeader, signRedirect(blueSecret, location))
+		http.Redirect(w, r, location, http.StatusTemporaryRedirect)
+	})
+	if err := put(); !errors.Is(err, errUnsignedRedirect) {
+		t.Errorf("expected %v, got: %v", errUnsignedRedirect, err)
+	}
+}
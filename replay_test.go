@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplayWAL(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openWALStore(dir)
+	if err != nil {
+		t.Fatalf("could not open wal store: %v", err)
+	}
+	s.compactEvery = 3
+	for _, sec := range []int64{10, 20, 30, 40, 50} {
+		ts := time.Unix(sec, 0)
+		if err := s.Set(&ts); err != nil {
+			t.Fatalf("could not store: %v", err)
+		}
+	}
+	s.Close()
+
+	writes, err := readWALWrites(dir)
+	if err != nil {
+		t.Fatalf("could not read wal: %v", err)
+	}
+	// the snapshot covers the first three writes
+	if len(writes) != 3 || writes[0].Unix() != 30 || writes[2].Unix() != 50 {
+		t.Errorf("unexpected writes from wal: %v", writes)
+	}
+
+	target := filepath.Join(t.TempDir(), "state")
+	hash := stateHash(time.Unix(50, 0))
+	tests := []struct {
+		description string
+		args        []string
+		expectErr   bool
+	}{
+		{"into file backend", []string{"-wal", dir, "-backend", "file", "-data-file", target, "-expect-hash", hash}, false},
+		{"target not empty", []string{"-wal", dir, "-backend", "file", "-data-file", target}, true},
+		{"hash mismatch", []string{"-wal", dir, "-expect-hash", stateHash(time.Unix(40, 0))}, true},
+		{"no source", []string{"-backend", "memory"}, true},
+		{"two sources", []string{"-wal", dir, "-export", "-"}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			err := runReplay(test.args)
+			if (err != nil) != test.expectErr {
+				t.Errorf("expected an error: %t, got: %v", test.expectErr, err)
+			}
+		})
+	}
+	if got := mustGet(t, newFileStore(target)).Unix(); got != 50 {
+		t.Errorf("expected the replayed value in the target, got: %d", got)
+	}
+}
+
+func TestReplayExport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "export.ndjson")
+	export := strings.Join([]string{
+		`{"id":"a","timestamp":10,"writer":"w","at":1}`,
+		`{"id":"b","timestamp":0,"writer":"w","at":2}`,
+		`{"id":"c","timestamp":30,"nsec":500,"writer":"w","at":3}`,
+	}, "\n")
+	if err := os.WriteFile(path, []byte(export), 0o600); err != nil {
+		t.Fatalf("could not write export: %v", err)
+	}
+	writes, err := readExportWrites(path)
+	if err != nil {
+		t.Fatalf("could not read export: %v", err)
+	}
+	if len(writes) != 3 || writes[0].Unix() != 10 || writes[1] != nil || !writes[2].Equal(time.Unix(30, 500)) {
+		t.Errorf("unexpected writes from export: %v", writes)
+	}
+	if err := runReplay([]string{"-export", path, "-expect-hash", stateHash(time.Unix(30, 500))}); err != nil {
+		t.Errorf("could not replay export: %v", err)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const serviceName = "ts_store"
+
+// version is set at build time with -ldflags "-X main.version=...", see
+// version.go
+var version = "dev"
+
+var serveRootInfo = flag.Bool("root-info", true, "describe the service at / instead of answering 404, disable for locked-down deployments")
+
+type rootInfo struct {
+	Service string            `json:"service"`
+	Version string            `json:"version"`
+	Links   map[string]string `json:"links"`
+}
+
+// rootHandler answers "/" with the service name, version and the routes the
+// listener serves, everything else the mux doesn't know stays a 404
+func rootHandler(routes map[string]http.HandlerFunc) http.HandlerFunc {
+	info := rootInfo{Service: serviceName, Version: build.Version, Links: map[string]string{}}
+	for path := range routes {
+		info.Links[strings.TrimPrefix(path, "/")] = apiPrefix + path
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" || !*serveRootInfo {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(info); err != nil {
+			log(os.Stderr, "error while writing service info: %s\n", err.Error())
+		}
+	}
+}
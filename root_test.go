@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRootHandler(t *testing.T) {
+	handler := newMux(map[string]http.HandlerFunc{getPath: retrieve})
+
+	tests := []struct {
+		description        string
+		method             string
+		path               string
+		enabled            bool
+		expectedStatusCode int
+	}{
+		{"info", http.MethodGet, "/", true, http.StatusOK},
+		{"disabled", http.MethodGet, "/", false, http.StatusNotFound},
+		{"unknown path", http.MethodGet, "/nope", true, http.StatusNotFound},
+		{"bad method", http.MethodPost, "/", true, http.StatusMethodNotAllowed},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			defer func(v bool) { *serveRootInfo = v }(*serveRootInfo)
+			*serveRootInfo = test.enabled
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest(test.method, test.path, nil))
+			if w.Code != test.expectedStatusCode {
+				t.Fatalf("expected status code to be %d, got: %d", test.expectedStatusCode, w.Code)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var info rootInfo
+			if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+				t.Fatalf("could not decode service info: %v", err)
+			}
+			if info.Service != serviceName || info.Version != build.Version {
+				t.Errorf("unexpected service info: %+v", info)
+			}
+			if len(info.Links) != 1 || info.Links["retrieve"] != apiPrefix+getPath {
+				t.Errorf("expected a link to the read route only, got: %v", info.Links)
+			}
+		})
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The s3 backend serves from memory and checkpoints the value to an object in
+// S3-compatible storage, restoring it on startup, so a container can run
+// without a volume. Writes between the last checkpoint and a crash are lost.
+//
+// The location is the object, either s3://bucket/key on AWS or a path-style
+// URL like https://minio.internal:9000/bucket/key for other providers.
+// Credentials and region come from the usual AWS_* environment variables.
+const (
+	s3DefaultRegion = "us-east-1"
+	s3MaxObjectSize = 1024
+	s3Timeout       = 5 * time.Second
+)
+
+var s3Checkpoint = flag.Duration("s3-checkpoint", 10*time.Second, "how often the s3 backend saves a changed value")
+
+func init() {
+	RegisterBackend("s3", func(location string) (Store, error) {
+		if location == "" {
+			return nil, errors.New("s3 backend requires an object location")
+		}
+		c, err := newS3ClientFromEnv(location)
+		if err != nil {
+			return nil, err
+		}
+		return openS3Store(c, *s3Checkpoint)
+	})
+}
+
+// s3Client reads and writes a single object with SigV4 signed requests
+type s3Client struct {
+	object    *url.URL
+	region    string
+	accessKey string
+	secretKey string
+	token     string
+	http      *http.Client
+}
+
+func newS3ClientFromEnv(location string) (*s3Client, error) {
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = s3DefaultRegion
+	}
+	object, err := s3ObjectURL(location, region)
+	if err != nil {
+		return nil, err
+	}
+	c := &s3Client{
+		object:    object,
+		region:    region,
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:     os.Getenv("AWS_SESSION_TOKEN"),
+		http:      &http.Client{Timeout: s3Timeout},
+	}
+	if c.accessKey == "" || c.secretKey == "" {
+		return nil, errors.New("s3 backend requires AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	return c, nil
+}
+
+func s3ObjectURL(location, region string) (*url.URL, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 location: %w", err)
+	}
+	switch u.Scheme {
+	case "s3":
+		if u.Host == "" || strings.Trim(u.Path, "/") == "" {
+			return nil, errors.New("s3 location must be s3://bucket/key")
+		}
+		return url.Parse(fmt.Sprintf("https://s3.%s.amazonaws.com/%s%s", region, u.Host, u.EscapedPath()))
+	case "http", "https":
+		// path-style, the bucket is the first path segment
+		if _, key, _ := strings.Cut(strings.TrimPrefix(u.Path, "/"), "/"); key == "" {
+			return nil, errors.New("s3 location must include a bucket and a key")
+		}
+		return u, nil
+	default:
+		return nil, fmt.Errorf("unsupported s3 location scheme %q", u.Scheme)
+	}
+}
+
+// get returns the object, or nil if it doesn't exist
+func (c *s3Client) get() ([]byte, error) {
+	res, err := c.do(http.MethodGet, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("s3 GET returned %s", res.Status)
+	}
+	return io.ReadAll(io.LimitReader(res.Body, s3MaxObjectSize))
+}
+
+func (c *s3Client) put(data []byte) error {
+	return c.expect(http.MethodPut, data)
+}
+
+func (c *s3Client) delete() error {
+	return c.expect(http.MethodDelete, nil)
+}
+
+func (c *s3Client) expect(method string, body []byte) error {
+	res, err := c.do(method, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, maxReqBytes))
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("s3 %s returned %s", method, res.Status)
+	}
+	return nil
+}
+
+func (c *s3Client) do(method string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.object.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("X-Amz-Security-Token", c.token)
+	}
+	c.sign(req, body, time.Now())
+	return c.http.Do(req)
+}
+
+// sign adds an AWS Signature Version 4 Authorization header covering the host
+// and every header already set on req
+func (c *s3Client) sign(req *http.Request, body []byte, at time.Time) {
+	at = at.UTC()
+	amzDate := at.Format("20060102T150405Z")
+	day := at.Format("20060102")
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + c.region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), day)
+	for _, part := range []string{c.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Store checkpoints the in-memory value whenever it changed since the last
+// checkpoint, and once more on Close
+type s3Store struct {
+	dataStore
+	client    *s3Client
+	mu        sync.Mutex
+	expiresAt time.Time // of the current value, zero for none
+	dirty     bool
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+func openS3Store(c *s3Client, interval time.Duration) (*s3Store, error) {
+	data, err := c.get()
+	if err != nil {
+		return nil, fmt.Errorf("could not restore from s3: %w", err)
+	}
+	s := &s3Store{client: c, stop: make(chan struct{}), done: make(chan struct{})}
+	if data != nil {
+		ts, expiresAt, err := decodeState(data)
+		if err != nil {
+			log(os.Stderr, "ignoring corrupt s3 snapshot %s: %s\n", c.object, err.Error())
+		} else {
+			s.dataStore.Set(&ts)
+			s.expiresAt = expiresAt
+		}
+	}
+	go s.run(interval)
+	return s, nil
+}
+
+func (s *s3Store) Set(ts *time.Time) error {
+	return s.SetExpiring(ts, time.Time{})
+}
+
+func (s *s3Store) SetExpiring(ts *time.Time, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dirty = true
+	s.expiresAt = expiresAt
+	return s.dataStore.Set(ts)
+}
+
+func (s *s3Store) Expiry() (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.expiresAt, nil
+}
+
+func (s *s3Store) run(interval time.Duration) {
+	defer close(s.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.checkpoint(); err != nil {
+				log(os.Stderr, "could not checkpoint to s3: %s\n", err.Error())
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// checkpoint uploads the current value, or deletes the object after a reset.
+// The store stays dirty if the upload fails, so the next tick retries.
+func (s *s3Store) checkpoint() error {
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	s.dirty = false
+	ts := s.dataStore.ts.Load()
+	expiresAt := s.expiresAt
+	s.mu.Unlock()
+
+	var err error
+	if ts == nil {
+		err = s.client.delete()
+	} else {
+		err = s.client.put(encodeState(*ts, expiresAt))
+	}
+	if err != nil {
+		s.mu.Lock()
+		s.dirty = true
+		s.mu.Unlock()
+	}
+	return err
+}
+
+func (s *s3Store) Close() error {
+	close(s.stop)
+	<-s.done
+	return s.checkpoint()
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"go.starlark.net/starlark"
+)
+
+// Starlark hooks let operators transform or reject writes and filter events
+// without forking the server. A script may define:
+//
+//	def on_write(ts, writer, nsec):
+//	    # return None to keep the value, an int of seconds or a (seconds,
+//	    # nanoseconds) tuple to store instead, or fail("reason")
+//
+//	def filter_event(kind, ts, writer, nsec):
+//	    # return False to drop the event before it reaches subscribers
+//
+// ts is in Unix seconds and nsec the nanoseconds within them. nsec is only
+// passed to functions declaring it, so scripts written before sub-second
+// precision keep working.
+//
+// Scripts can't load modules or do I/O. CPU is bounded by an execution step
+// limit and a wall-clock timeout; the interpreter has no allocation
+// accounting, so memory is only bounded indirectly through the step limit.
+const (
+	maxScriptSteps = 100000
+	scriptTimeout  = 50 * time.Millisecond
+)
+
+var errWriteRejectedByScript = errors.New("write rejected by script")
+
+type scriptHooks struct {
+	onWrite     *starlark.Function
+	filterEvent *starlark.Function
+}
+
+// hooks is nil unless a script is configured
+var hooks *scriptHooks
+
+func loadScriptHooks(path string) (*scriptHooks, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return compileScriptHooks(path, src)
+}
+
+func compileScriptHooks(name string, src []byte) (*scriptHooks, error) {
+	globals, err := starlark.ExecFile(newScriptThread("load"), name, src, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not load script: %w", err)
+	}
+	globals.Freeze()
+	h := &scriptHooks{}
+	for name, fn := range map[string]**starlark.Function{"on_write": &h.onWrite, "filter_event": &h.filterEvent} {
+		v, ok := globals[name]
+		if !ok {
+			continue
+		}
+		if *fn, ok = v.(*starlark.Function); !ok {
+			return nil, fmt.Errorf("%s must be a function, got %s", name, v.Type())
+		}
+	}
+	return h, nil
+}
+
+func newScriptThread(name string) *starlark.Thread {
+	thread := &starlark.Thread{
+		Name: name,
+		Print: func(_ *starlark.Thread, msg string) {
+			log(os.Stdout, "script: %s\n", msg)
+		},
+	}
+	thread.SetMaxExecutionSteps(maxScriptSteps)
+	return thread
+}
+
+// scriptArgs are the arguments of a hook taking ts, writer and, if fn
+// declares it, nsec, after the leading ones in args
+func scriptArgs(fn *starlark.Function, ts time.Time, writer string, args ...starlark.Value) []starlark.Value {
+	args = append(args, starlark.MakeInt64(ts.Unix()), starlark.String(writer))
+	if fn.NumParams() > len(args) {
+		args = append(args, starlark.MakeInt(ts.Nanosecond()))
+	}
+	return args
+}
+
+func callScript(fn *starlark.Function, args ...starlark.Value) (starlark.Value, error) {
+	thread := newScriptThread(fn.Name())
+	timer := time.AfterFunc(scriptTimeout, func() {
+		thread.Cancel("script timed out")
+	})
+	defer timer.Stop()
+	return starlark.Call(thread, fn, starlark.Tuple(args), nil)
+}
+
+// transformWrite runs on_write and returns the timestamp to store
+func (h *scriptHooks) transformWrite(ts time.Time, writer string) (time.Time, error) {
+	if h == nil || h.onWrite == nil {
+		return ts, nil
+	}
+	v, err := callScript(h.onWrite, scriptArgs(h.onWrite, ts, writer)...)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: %s", errWriteRejectedByScript, err.Error())
+	}
+	var sec, nsec starlark.Value
+	switch v := v.(type) {
+	case starlark.NoneType:
+		return ts, nil
+	case starlark.Int:
+		sec, nsec = v, starlark.MakeInt(0)
+	case starlark.Tuple:
+		if len(v) != 2 {
+			return time.Time{}, fmt.Errorf("%w: on_write returned a tuple of %d, not (seconds, nanoseconds)", errWriteRejectedByScript, len(v))
+		}
+		sec, nsec = v[0], v[1]
+	default:
+		return time.Time{}, fmt.Errorf("%w: on_write must return int, tuple or None, got %s", errWriteRejectedByScript, v.Type())
+	}
+	s, ok := scriptInt(sec)
+	n, nok := scriptInt(nsec)
+	if !ok || !nok || s < 0 || n < 0 || n >= int64(time.Second) {
+		return time.Time{}, fmt.Errorf("%w: on_write returned invalid timestamp %s", errWriteRejectedByScript, v)
+	}
+	return time.Unix(s, n), nil
+}
+
+func scriptInt(v starlark.Value) (int64, bool) {
+	i, ok := v.(starlark.Int)
+	if !ok {
+		return 0, false
+	}
+	return i.Int64()
+}
+
+// allowEvent runs filter_event. Events are delivered if the script fails, so
+// a broken filter can't silently swallow notifications.
+func (h *scriptHooks) allowEvent(e Event) bool {
+	if h == nil || h.filterEvent == nil {
+		return true
+	}
+	v, err := callScript(h.filterEvent, scriptArgs(h.filterEvent, e.Value, e.Writer, starlark.String(e.Type))...)
+	if err != nil {
+		log(os.Stderr, "event filter failed, delivering event: %s\n", err.Error())
+		return true
+	}
+	return bool(v.Truth())
+}
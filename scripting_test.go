@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const testScript = `
+def on_write(ts, writer):
+    if writer == "blocked":
+        fail("writer is blocked")
+    if ts > 1000000:
+        return ts // 1000
+    return None
+
+def filter_event(kind, ts, writer):
+    return writer != "noisy"
+`
+
+func TestScriptHooks(t *testing.T) {
+	h, err := compileScriptHooks("test.star", []byte(testScript))
+	if err != nil {
+		t.Fatalf("could not compile script: %v", err)
+	}
+
+	tests := []struct {
+		description string
+		ts          int64
+		writer      string
+		expectedTs  int64
+		expectErr   bool
+	}{
+		{"unchanged", 10, "agent", 10, false},
+		{"transformed", 5000000, "agent", 5000, false},
+		{"rejected", 10, "blocked", 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			got, err := h.transformWrite(time.Unix(test.ts, 0), test.writer)
+			if (err != nil) != test.expectErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !test.expectErr && got.Unix() != test.expectedTs {
+				t.Errorf("expected %d, got: %d", test.expectedTs, got.Unix())
+			}
+		})
+	}
+
+	if !h.allowEvent(Event{Type: EventValueChanged, Writer: "agent"}) {
+		t.Error("event should be allowed")
+	}
+	if h.allowEvent(Event{Type: EventValueChanged, Writer: "noisy"}) {
+		t.Error("event should be filtered")
+	}
+
+	var none *scriptHooks
+	if got, err := none.transformWrite(time.Unix(3, 0), "agent"); err != nil || got.Unix() != 3 {
+		t.Errorf("nil hooks should not change writes, got: %d, %v", got.Unix(), err)
+	}
+}
+
+func TestScriptHooksNsec(t *testing.T) {
+	h, err := compileScriptHooks("test.star", []byte(`
+def on_write(ts, writer, nsec):
+    if writer == "round":
+        return (ts, 0)
+    return (ts + 1, nsec)
+
+def filter_event(kind, ts, writer, nsec):
+    return nsec == 0
+`))
+	if err != nil {
+		t.Fatalf("could not compile script: %v", err)
+	}
+	if got, err := h.transformWrite(time.Unix(10, 5), "agent"); err != nil || !got.Equal(time.Unix(11, 5)) {
+		t.Errorf("expected the nanoseconds to be passed and kept, got: %v, %v", got, err)
+	}
+	if got, err := h.transformWrite(time.Unix(10, 5), "round"); err != nil || !got.Equal(time.Unix(10, 0)) {
+		t.Errorf("expected the returned nanoseconds to be stored, got: %v, %v", got, err)
+	}
+	if h.allowEvent(Event{Type: EventValueChanged, Value: time.Unix(10, 5)}) {
+		t.Error("expected the filter to see the nanoseconds")
+	}
+}
+
+func TestScriptSandbox(t *testing.T) {
+	tests := []struct {
+		description string
+		src         string
+	}{
+		{"endless loop", "def on_write(ts, writer):\n    for i in range(1000000000):\n        ts += 1\n    return ts\n"},
+		{"wrong return type", "def on_write(ts, writer):\n    return \"soon\"\n"},
+		{"negative", "def on_write(ts, writer):\n    return -1\n"},
+		{"nanoseconds out of range", "def on_write(ts, writer):\n    return (ts, 1000000000)\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			h, err := compileScriptHooks("test.star", []byte(test.src))
+			if err != nil {
+				t.Fatalf("could not compile script: %v", err)
+			}
+			start := time.Now()
+			if _, err := h.transformWrite(time.Unix(1, 0), "agent"); err == nil {
+				t.Error("expected the write to be rejected")
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("script was not stopped in time: %s", elapsed)
+			}
+		})
+	}
+
+	for _, src := range []string{"load('os.star', 'os')\n", "on_write = 1\n", "def broken(\n"} {
+		if _, err := compileScriptHooks("test.star", []byte(src)); err == nil {
+			t.Errorf("expected %q to be rejected", src)
+		}
+	}
+}
+
+func TestUpdateRunsScript(t *testing.T) {
+	defer resetStore()
+	defer func() { hooks = nil }()
+	h, err := compileScriptHooks("test.star", []byte(testScript))
+	if err != nil {
+		t.Fatalf("could not compile script: %v", err)
+	}
+	hooks = h
+
+	for _, test := range []struct {
+		writer             string
+		expectedStatusCode int
+	}{
+		{"agent", http.StatusOK},
+		{"blocked", http.StatusUnprocessableEntity},
+	} {
+		req := httptest.NewRequest(http.MethodPut, getStorePath(), bytes.NewReader([]byte("7000000")))
+		req.Header.Set("Content-Type", "text/plain")
+		req.Header.Set(writerIDHeader, test.writer)
+		w := httptest.NewRecorder()
+		update(w, req)
+		if w.Code != test.expectedStatusCode {
+			t.Errorf("expected status code to be %d, got: %d", test.expectedStatusCode, w.Code)
+		}
+	}
+	if got := mustGet(t, th).Unix(); got != 7000 {
+		t.Errorf("expected transformed value to be stored, got: %d", got)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const selfTestTimeout = 5 * time.Second
+
+var selfTest = flag.Bool("self-test", false, "serve on an ephemeral port with an in-memory store, check writing, reading and watching end to end, then exit")
+
+// runSelfTest exercises the same handlers main serves, against a fresh
+// in-memory store on a loopback listener
+func runSelfTest() error {
+	th = &dataStore{}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("could not listen: %w", err)
+	}
+	srv := &http.Server{Handler: httpServer.Handler}
+	go srv.Serve(ln)
+	defer srv.Close()
+	base := fmt.Sprintf("%s://%s%s", protocol, ln.Addr(), apiPrefix)
+	// authenticate every request, whatever the route policy
+	c := &http.Client{Timeout: selfTestTimeout, Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if len(writeSecret) > 0 {
+			req.Header.Set("Authorization", totpScheme+" "+totp(writeSecret, time.Now()))
+		}
+		return http.DefaultTransport.RoundTrip(req)
+	})}
+
+	watch, unsubscribe := events.subscribe(1)
+	defer unsubscribe()
+
+	value := strconv.FormatInt(now().Unix(), 10)
+	req, err := http.NewRequest(http.MethodPut, base+putPath, bytes.NewReader([]byte(value)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("X-Sent-At", time.Now().UTC().Format(time.RFC3339Nano))
+	req.Header.Set(writerIDHeader, "self-test")
+	res, err := c.Do(req)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("write: expected status %d, got: %s", http.StatusOK, res.Status)
+	}
+	id := res.Header.Get(writeIDHeader)
+	if id == "" {
+		return errors.New("write: no write ID returned")
+	}
+
+	for _, check := range []struct {
+		path     string
+		expected string
+	}{
+		{getPath, value},
+		{statusPath, string(fresh)},
+	} {
+		res, err := c.Get(base + check.path)
+		if err != nil {
+			return fmt.Errorf("read %s: %w", check.path, err)
+		}
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return fmt.Errorf("read %s: %w", check.path, err)
+		}
+		if res.StatusCode != http.StatusOK || string(body) != check.expected {
+			return fmt.Errorf("read %s: expected %s, got: %s %q", check.path, check.expected, res.Status, body)
+		}
+	}
+
+	select {
+	case e := <-watch:
+		if e.ID != id {
+			return fmt.Errorf("watch: expected event for write %s, got: %s", id, e.ID)
+		}
+	case <-time.After(selfTestTimeout):
+		return errors.New("watch: no event published for the write")
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	defer func(s Store) { th = s }(th)
+	if err := runSelfTest(); err != nil {
+		t.Errorf("self-test failed: %v", err)
+	}
+
+	writeSecret = []byte("12345678901234567890")
+	defer func() { writeSecret = nil }()
+	if err := runSelfTest(); err != nil {
+		t.Errorf("self-test failed with write auth: %v", err)
+	}
+}
+
+// TestSelfTestDefaults runs the self-test as main does on an image started
+// with no flags nor environment besides -self-test
+func TestSelfTestDefaults(t *testing.T) {
+	defer func(s Store) { th = s }(th)
+	t.Setenv(writeSecretEnv, "")
+	t.Setenv(clientSecretEnv, "")
+	os.Unsetenv(writeSecretEnv)
+	os.Unsetenv(clientSecretEnv)
+	if err := configureForTest(t, "-self-test"); err != nil {
+		t.Fatalf("configure: %v", err)
+	}
+	if !*selfTest {
+		t.Fatal("-self-test not set")
+	}
+	if err := runSelfTest(); err != nil {
+		t.Errorf("self-test failed: %v", err)
+	}
+}
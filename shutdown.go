@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"sync"
+	"time"
+)
+
+// Subsystems running in the background register a shutdown hook when they
+// start. On SIGINT or SIGTERM the hooks run in reverse order of registration,
+// so the HTTP servers, which start last, stop taking requests before the
+// subsystems they use go away and the storage backend is closed last. All
+// hooks share -shutdown-timeout: a hook still running when it is up is
+// abandoned, so a stuck delivery or upload can't keep the process from
+// exiting.
+var shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "time allowed for a graceful shutdown before exiting regardless")
+
+type shutdownHook struct {
+	name string
+	stop func(ctx context.Context) error
+}
+
+type shutdownHooks struct {
+	mu    sync.Mutex
+	hooks []shutdownHook
+}
+
+var shutdown shutdownHooks
+
+// add registers stop to be called on shutdown. stop should return once ctx is
+// done, even if it didn't finish.
+func (s *shutdownHooks) add(name string, stop func(ctx context.Context) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hooks = append(s.hooks, shutdownHook{name, stop})
+}
+
+// stopFunc turns a function stopping a subsystem into a hook. The hook returns
+// when ctx is done even if stop doesn't, which keeps running in the
+// background until the process exits.
+func stopFunc(stop func()) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			stop()
+		}()
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// goBackground runs fn in its own goroutine until shutdown, which cancels its
+// context and waits for it to return
+func (s *shutdownHooks) goBackground(name string, fn func(ctx context.Context)) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn(ctx)
+	}()
+	s.add(name, func(shutdownCtx context.Context) error {
+		cancel()
+		select {
+		case <-done:
+			return nil
+		case <-shutdownCtx.Done():
+			return shutdownCtx.Err()
+		}
+	})
+}
+
+// run calls the registered hooks, last registered first, and clears them.
+// Once ctx is done the remaining hooks are still called, so they get to
+// cancel their work, but not waited for.
+func (s *shutdownHooks) run(ctx context.Context) {
+	s.mu.Lock()
+	hooks := s.hooks
+	s.hooks = nil
+	s.mu.Unlock()
+	for i := len(hooks) - 1; i >= 0; i-- {
+		h := hooks[i]
+		errCh := make(chan error, 1)
+		go func() { errCh <- h.stop(ctx) }()
+		select {
+		case err := <-errCh:
+			if err != nil {
+				log(os.Stderr, "error while stopping %s: %s\n", h.name, err.Error())
+			}
+		case <-ctx.Done():
+			log(os.Stderr, "gave up waiting for %s to stop\n", h.name)
+		}
+	}
+}
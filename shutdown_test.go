@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestShutdownHooks(t *testing.T) {
+	var s shutdownHooks
+	called := make(chan string, 2)
+	record := func(name string) func(context.Context) error {
+		return func(context.Context) error {
+			called <- name
+			return nil
+		}
+	}
+	s.add("backend", record("backend"))
+	stopped := make(chan struct{})
+	s.goBackground("pruning", func(ctx context.Context) {
+		<-ctx.Done()
+		close(stopped)
+	})
+	// a hook that never returns must not keep the ones registered before it
+	// from being called
+	s.add("stuck", func(context.Context) error {
+		select {}
+	})
+	s.add("server", record("server"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	s.run(ctx)
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("expected shutdown to be bounded by its context, took %s", took)
+	}
+	for _, expected := range []string{"server", "backend"} {
+		select {
+		case name := <-called:
+			if name != expected {
+				t.Errorf("expected %s to stop next, got: %s", expected, name)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected %s to be stopped", expected)
+		}
+	}
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Error("expected the background goroutine to be cancelled")
+	}
+}
+
+func TestStopFunc(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	block := make(chan struct{})
+	defer close(block)
+	if err := stopFunc(func() { <-block })(ctx); err != context.Canceled {
+		t.Errorf("expected %v, got: %v", context.Canceled, err)
+	}
+	if err := stopFunc(func() {})(context.Background()); err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+}
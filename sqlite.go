@@ -0,0 +1,122 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteRetention is how many writes the sqlite backend keeps as history,
+// older rows are pruned as new ones come in
+const sqliteRetention = 1000
+
+// nsec holds the sub-second part of ts, expires_at the deadline of a value
+// with a TTL in Unix nanoseconds
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS history (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	ts INTEGER,
+	nsec INTEGER NOT NULL DEFAULT 0,
+	expires_at INTEGER,
+	written_at INTEGER NOT NULL
+)`
+
+func init() {
+	RegisterBackend("sqlite", func(location string) (Store, error) {
+		if location == "" {
+			return nil, errors.New("sqlite backend requires a database file")
+		}
+		return openSQLiteStore(location)
+	})
+}
+
+// sqliteStore appends every write to a history table and serves the latest
+// row. A reset is recorded as a row without a timestamp. The driver is pure
+// Go, so the backend doesn't need cgo.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func openSQLiteStore(path string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open sqlite database: %w", err)
+	}
+	// a single connection serializes writers instead of failing with SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not create schema: %w", err)
+	}
+	return &sqliteStore{db: db}, nil
+}
+
+func (s *sqliteStore) Set(ts *time.Time) error {
+	return s.SetExpiring(ts, time.Time{})
+}
+
+func (s *sqliteStore) SetExpiring(ts *time.Time, expiresAt time.Time) error {
+	var (
+		v, expiry sql.NullInt64
+		nsec      int
+	)
+	if ts != nil {
+		v = sql.NullInt64{Int64: ts.Unix(), Valid: true}
+		nsec = ts.Nanosecond()
+		if !expiresAt.IsZero() {
+			expiry = sql.NullInt64{Int64: expiresAt.UnixNano(), Valid: true}
+		}
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`INSERT INTO history (ts, nsec, expires_at, written_at) VALUES (?, ?, ?, ?)`, v, nsec, expiry, now().Unix())
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM history WHERE id <= ?`, id-sqliteRetention); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) Get() (time.Time, error) {
+	var (
+		v    sql.NullInt64
+		nsec int64
+	)
+	err := s.db.QueryRow(`SELECT ts, nsec FROM history ORDER BY id DESC LIMIT 1`).Scan(&v, &nsec)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, err
+	}
+	return time.Unix(v.Int64, nsec), nil
+}
+
+func (s *sqliteStore) Expiry() (time.Time, error) {
+	var expiry sql.NullInt64
+	err := s.db.QueryRow(`SELECT expires_at FROM history ORDER BY id DESC LIMIT 1`).Scan(&expiry)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, err
+	}
+	if !expiry.Valid {
+		return time.Time{}, nil
+	}
+	return time.Unix(0, expiry.Int64), nil
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *sqliteStore) Durable() bool {
+	return true
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSQLiteStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ts.sqlite")
+	s, err := openSQLiteStore(path)
+	if err != nil {
+		t.Fatalf("could not open sqlite store: %v", err)
+	}
+	if got := mustGet(t, s).Unix(); got != 0 {
+		t.Errorf("empty store should return 0, got: %d", got)
+	}
+	ts := time.Unix(1234567, 0)
+	if err := s.Set(&ts); err != nil {
+		t.Fatalf("could not store: %v", err)
+	}
+	s.Close()
+
+	s, err = openSQLiteStore(path)
+	if err != nil {
+		t.Fatalf("could not reopen sqlite store: %v", err)
+	}
+	defer s.Close()
+	if got := mustGet(t, s).Unix(); got != 1234567 {
+		t.Errorf("value was not persisted, got: %d", got)
+	}
+	precise := time.Unix(1234567, 890)
+	if err := s.Set(&precise); err != nil {
+		t.Fatalf("could not store: %v", err)
+	}
+	if got := mustGet(t, s); !got.Equal(precise) {
+		t.Errorf("expected sub-second precision to be kept, got: %s", got)
+	}
+	if err := s.Set(nil); err != nil {
+		t.Fatalf("could not reset: %v", err)
+	}
+	if got := mustGet(t, s).Unix(); got != 0 {
+		t.Errorf("expected reset value, got: %d", got)
+	}
+
+	// history is pruned to the retention limit
+	for i := 0; i < sqliteRetention+10; i++ {
+		ts := time.Unix(int64(i), 0)
+		if err := s.Set(&ts); err != nil {
+			t.Fatalf("could not store: %v", err)
+		}
+	}
+	var rows int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM history`).Scan(&rows); err != nil {
+		t.Fatalf("could not count history: %v", err)
+	}
+	if rows != sqliteRetention {
+		t.Errorf("expected %d rows of history, got: %d", sqliteRetention, rows)
+	}
+	if got := mustGet(t, s).Unix(); got != sqliteRetention+9 {
+		t.Errorf("expected latest value, got: %d", got)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Startup runs in phases, in this order, each bounded by its own timeout:
+//
+//	recover  open the backend, which loads the persisted value and replays
+//	         its log, then restore the value's expiry deadline
+//	listen   bind the address of every server
+//
+// Requests are only served once both are done, so none can read a value
+// before it is recovered, or write one that recovery would then overwrite.
+// There is no cluster mode, so there are no peers to sync from. How long
+// each phase took is exported in /metrics.
+const (
+	phaseRecover = "recover"
+	phaseListen  = "listen"
+)
+
+var (
+	recoverTimeout = flag.Duration("startup-recover-timeout", 5*time.Minute, "how long recovering the stored value may take at startup before the server gives up")
+	listenTimeout  = flag.Duration("startup-listen-timeout", 10*time.Second, "how long binding the listeners may take at startup before the server gives up")
+)
+
+// startupPhases holds how long each finished phase took
+var startupPhases = &phaseDurations{took: map[string]time.Duration{}}
+
+type phaseDurations struct {
+	mu   sync.Mutex
+	took map[string]time.Duration
+}
+
+func (p *phaseDurations) record(phase string, took time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.took[phase] = took
+}
+
+// snapshot returns the phases in alphabetical order with their durations
+func (p *phaseDurations) snapshot() ([]string, map[string]time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	phases := make([]string, 0, len(p.took))
+	took := make(map[string]time.Duration, len(p.took))
+	for phase, d := range p.took {
+		phases = append(phases, phase)
+		took[phase] = d
+	}
+	sort.Strings(phases)
+	return phases, took
+}
+
+// runPhase runs fn as the startup phase called phase, giving up on it after
+// timeout. fn is left running then, as main exits on the error anyway.
+func runPhase(phase string, timeout time.Duration, fn func() error) error {
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- fn() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("startup phase %s failed: %w", phase, err)
+		}
+		took := time.Since(start)
+		startupPhases.record(phase, took)
+		log(os.Stdout, "startup phase %s done in %s\n", phase, took.Round(time.Millisecond))
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("startup phase %s did not finish within %s", phase, timeout)
+	}
+}
+
+// listenAll binds the address of every server, closing the listeners
+// already bound when one fails
+func listenAll(servers []*http.Server) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, len(servers))
+	for _, srv := range servers {
+		ln, err := net.Listen("tcp", srv.Addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
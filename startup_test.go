@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunPhase(t *testing.T) {
+	defer func(p *phaseDurations) { startupPhases = p }(startupPhases)
+	startupPhases = &phaseDurations{took: map[string]time.Duration{}}
+
+	if err := runPhase("quick", time.Second, func() error { return nil }); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	failure := errors.New("corrupt")
+	if err := runPhase("failing", time.Second, func() error { return failure }); !errors.Is(err, failure) {
+		t.Errorf("expected the phase error, got: %v", err)
+	}
+	release := make(chan struct{})
+	defer close(release)
+	if err := runPhase("stuck", 20*time.Millisecond, func() error { <-release; return nil }); err == nil {
+		t.Error("expected a phase past its timeout to fail")
+	}
+	phases, _ := startupPhases.snapshot()
+	if strings.Join(phases, ",") != "quick" {
+		t.Errorf("expected only the finished phase to be recorded, got: %v", phases)
+	}
+
+	var sb strings.Builder
+	w := bufio.NewWriter(&sb)
+	writeMetrics(w, time.Unix(0, 0), time.Unix(0, 0))
+	w.Flush()
+	if !strings.Contains(sb.String(), `ts_store_startup_phase_duration_seconds{phase="quick"} `) {
+		t.Errorf("expected the phase duration in the metrics, got:\n%s", sb.String())
+	}
+}
+
+func TestListenAll(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	listeners, err := listenAll([]*http.Server{{Addr: "127.0.0.1:0"}, {Addr: "127.0.0.1:0"}})
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	for _, ln := range listeners {
+		ln.Close()
+	}
+
+	if _, err := listenAll([]*http.Server{{Addr: "127.0.0.1:0"}, {Addr: taken.Addr().String()}}); err == nil {
+		t.Fatal("expected an address in use to fail")
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	statsPath      = "/stats"
+	debugStatsPath = "/debug/stats"
+)
+
+var (
+	processStarted = time.Now()
+	// reads answered by /retrieve and writes accepted, resets included, since
+	// the process started
+	totalReads  atomic.Uint64
+	totalWrites atomic.Uint64
+)
+
+// gap histogram buckets double from 1s up to about 6 days, anything longer
+// ends up in the implicit +Inf bucket
+const (
+	gapBucketBase  = time.Second
+	gapBucketCount = 20
+)
+
+// gapHistogram counts the time between consecutive writes in exponential
+// buckets, which is enough for capacity planning and cadence alerts without
+// keeping the write history around
+type gapHistogram struct {
+	mu      sync.Mutex
+	last    time.Time
+	buckets [gapBucketCount + 1]uint64
+	count   uint64
+	sum     time.Duration
+}
+
+var updateGaps = &gapHistogram{}
+
+func gapBucketBound(i int) time.Duration {
+	return gapBucketBase << uint(i)
+}
+
+func (h *gapHistogram) observe(at time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.last.IsZero() {
+		gap := at.Sub(h.last)
+		i := 0
+		for i < gapBucketCount && gap > gapBucketBound(i) {
+			i++
+		}
+		h.buckets[i]++
+		h.count++
+		h.sum += gap
+	}
+	h.last = at
+}
+
+type histogramBucket struct {
+	// upper bound in seconds, "+Inf" for the last bucket
+	LE    string `json:"le"`
+	Count uint64 `json:"count"`
+}
+
+type histogramSnapshot struct {
+	Count      uint64            `json:"count"`
+	SumSeconds float64           `json:"sum_seconds"`
+	Buckets    []histogramBucket `json:"buckets"`
+}
+
+// snapshot returns cumulative bucket counts, as Prometheus histograms do
+func (h *gapHistogram) snapshot() histogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := histogramSnapshot{Count: h.count, SumSeconds: h.sum.Seconds()}
+	var cumulative uint64
+	for i, n := range h.buckets {
+		cumulative += n
+		le := "+Inf"
+		if i < gapBucketCount {
+			le = strconv.FormatFloat(gapBucketBound(i).Seconds(), 'f', -1, 64)
+		}
+		s.Buckets = append(s.Buckets, histogramBucket{LE: le, Count: cumulative})
+	}
+	return s
+}
+
+type statsResponse struct {
+	UpdateGaps histogramSnapshot `json:"update_gaps"`
+}
+
+func stats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(statsResponse{UpdateGaps: updateGaps.snapshot()}); err != nil {
+		log(os.Stderr, "error while writing stats: %s\n", err.Error())
+	}
+}
+
+type memoryStats struct {
+	HeapAllocBytes    uint64  `json:"heap_alloc_bytes"`
+	HeapObjects       uint64  `json:"heap_objects"`
+	SysBytes          uint64  `json:"sys_bytes"`
+	TotalAllocBytes   uint64  `json:"total_alloc_bytes"`
+	GCCycles          uint32  `json:"gc_cycles"`
+	GCPauseSecondsSum float64 `json:"gc_pause_seconds_sum"`
+}
+
+type debugStats struct {
+	Goroutines    int     `json:"goroutines"`
+	UptimeSeconds float64 `json:"uptime_seconds"`
+	Reads         uint64  `json:"reads"`
+	Writes        uint64  `json:"writes"`
+	// null while nothing is stored
+	ValueAgeSeconds *float64    `json:"value_age_seconds"`
+	Memory          memoryStats `json:"memory"`
+}
+
+// debugStatsHandler serves a snapshot of the process for a quick look, where
+// /metrics is meant for scraping
+func debugStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ts, err := readValue()
+	if err != nil {
+		log(os.Stderr, "could not read timestamp: %s\n", err.Error())
+		http.Error(w, "could not read timestamp", http.StatusInternalServerError)
+		return
+	}
+	at := now()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	s := debugStats{
+		Goroutines:    runtime.NumGoroutine(),
+		UptimeSeconds: time.Since(processStarted).Seconds(),
+		Reads:         totalReads.Load(),
+		Writes:        totalWrites.Load(),
+		Memory: memoryStats{
+			HeapAllocBytes:    m.HeapAlloc,
+			HeapObjects:       m.HeapObjects,
+			SysBytes:          m.Sys,
+			TotalAllocBytes:   m.TotalAlloc,
+			GCCycles:          m.NumGC,
+			GCPauseSecondsSum: time.Duration(m.PauseTotalNs).Seconds(),
+		},
+	}
+	if ts.Unix() != 0 {
+		age := at.Sub(ts).Seconds()
+		s.ValueAgeSeconds = &age
+	}
+	w.Header().Set("Content-Type", contentTypeJSON)
+	if err := json.NewEncoder(w).Encode(s); err != nil {
+		log(os.Stderr, "error while writing debug stats: %s\n", err.Error())
+	}
+}
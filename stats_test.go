@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGapHistogram(t *testing.T) {
+	h := &gapHistogram{}
+	start := time.Unix(1000, 0)
+	// gaps of 1s, 3s, 3s and 30 days
+	for _, at := range []time.Time{
+		start,
+		start.Add(time.Second),
+		start.Add(4 * time.Second),
+		start.Add(7 * time.Second),
+		start.Add(7*time.Second + 30*24*time.Hour),
+	} {
+		h.observe(at)
+	}
+	s := h.snapshot()
+	if s.Count != 4 {
+		t.Errorf("expected 4 gaps, got: %d", s.Count)
+	}
+	if len(s.Buckets) != gapBucketCount+1 {
+		t.Fatalf("expected %d buckets, got: %d", gapBucketCount+1, len(s.Buckets))
+	}
+	for _, test := range []struct {
+		bucket   int
+		le       string
+		expected uint64
+	}{
+		{0, "1", 1},
+		{1, "2", 1},
+		{2, "4", 3},
+		{gapBucketCount - 1, "524288", 3},
+		{gapBucketCount, "+Inf", 4},
+	} {
+		b := s.Buckets[test.bucket]
+		if b.LE != test.le || b.Count != test.expected {
+			t.Errorf("expected bucket %d to be le=%s count=%d, got: le=%s count=%d", test.bucket, test.le, test.expected, b.LE, b.Count)
+		}
+	}
+}
+
+func TestStatsHandler(t *testing.T) {
+	defer func(h *gapHistogram) { updateGaps = h }(updateGaps)
+	updateGaps = &gapHistogram{}
+	updateGaps.observe(time.Unix(0, 0))
+	updateGaps.observe(time.Unix(10, 0))
+
+	w := httptest.NewRecorder()
+	stats(w, httptest.NewRequest(http.MethodGet, apiPrefix+statsPath, nil))
+	res := w.Result()
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected status code to be %d, got: %d", http.StatusOK, res.StatusCode)
+	}
+	var body statsResponse
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		t.Fatalf("could not decode stats: %v", err)
+	}
+	if body.UpdateGaps.Count != 1 || body.UpdateGaps.SumSeconds != 10 {
+		t.Errorf("unexpected gap stats: %+v", body.UpdateGaps)
+	}
+}
+
+func TestDebugStatsHandler(t *testing.T) {
+	defer resetStore()
+	h := newMux(map[string]http.HandlerFunc{
+		getPath:        retrieve,
+		putPath:        update,
+		debugStatsPath: debugStatsHandler,
+	})
+	get := func() debugStats {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, apiPrefix+debugStatsPath, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected %d, got: %d", http.StatusOK, w.Code)
+		}
+		var s debugStats
+		if err := json.NewDecoder(w.Body).Decode(&s); err != nil {
+			t.Fatalf("could not decode stats: %v", err)
+		}
+		return s
+	}
+
+	before := get()
+	if before.ValueAgeSeconds != nil {
+		t.Errorf("expected no age while nothing is stored, got: %v", *before.ValueAgeSeconds)
+	}
+	if before.Goroutines == 0 || before.Memory.SysBytes == 0 {
+		t.Errorf("expected runtime stats, got: %+v", before)
+	}
+
+	req := httptest.NewRequest(http.MethodPut, apiPrefix+putPath, strings.NewReader(strconv.FormatInt(now().Add(-time.Minute).Unix(), 10)))
+	req.Header.Set("Content-Type", contentTypeText)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, apiPrefix+getPath, nil))
+
+	after := get()
+	if after.Reads-before.Reads != 1 || after.Writes-before.Writes != 1 {
+		t.Errorf("expected one read and one write more, got %d reads and %d writes", after.Reads-before.Reads, after.Writes-before.Writes)
+	}
+	if after.ValueAgeSeconds == nil || *after.ValueAgeSeconds < 60 || *after.ValueAgeSeconds > 70 {
+		t.Errorf("expected the value to be about a minute old, got: %v", after.ValueAgeSeconds)
+	}
+}
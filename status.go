@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"os"
+	"time"
+)
+
+const statusPath = "/status"
+
+type freshness string
+
+const (
+	fresh   freshness = "fresh"
+	warning freshness = "warning"
+	stale   freshness = "stale"
+	missing freshness = "missing"
+)
+
+var (
+	warningAfter = flag.Duration("status-warning", 5*time.Minute, "age after which /status reports warning")
+	staleAfter   = flag.Duration("status-stale", 15*time.Minute, "age after which /status reports stale")
+)
+
+func classify(ts, at time.Time) freshness {
+	if ts.Unix() == 0 {
+		return missing
+	}
+	age := at.Sub(ts)
+	switch {
+	case age >= *staleAfter:
+		return stale
+	case age >= *warningAfter:
+		return warning
+	default:
+		return fresh
+	}
+}
+
+// status reports how fresh the stored timestamp is as a single word. Stale
+// and missing are served with 503 so load balancer checks can act on them
+// without parsing the body.
+func status(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ts, err := readValue()
+	if err != nil {
+		log(os.Stderr, "could not read timestamp: %s\n", err.Error())
+		http.Error(w, "could not read timestamp", http.StatusInternalServerError)
+		return
+	}
+	class := classify(ts, now())
+	w.Header().Set("Content-Type", "text/plain")
+	if class == stale || class == missing {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write([]byte(class))
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClassify(t *testing.T) {
+	at := time.Unix(100000, 0)
+	tests := []struct {
+		description string
+		ts          time.Time
+		expected    freshness
+	}{
+		{"nothing stored", time.Unix(0, 0), missing},
+		{"just written", at, fresh},
+		{"in the future", at.Add(time.Minute), fresh},
+		{"warning", at.Add(-*warningAfter), warning},
+		{"stale", at.Add(-*staleAfter - time.Second), stale},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			if got := classify(test.ts, at); got != test.expected {
+				t.Errorf("expected %s, got: %s", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestStatusHandler(t *testing.T) {
+	defer resetStore()
+
+	tests := []struct {
+		description        string
+		method             string
+		setup              *time.Time
+		expectedStatusCode int
+		expectedBody       string
+	}{
+		{"missing", http.MethodGet, nil, http.StatusServiceUnavailable, "missing"},
+		{"fresh", http.MethodGet, timePtr(time.Now()), http.StatusOK, "fresh"},
+		{"warning", http.MethodGet, timePtr(time.Now().Add(-*warningAfter)), http.StatusOK, "warning"},
+		{"stale", http.MethodGet, timePtr(time.Now().Add(-time.Hour)), http.StatusServiceUnavailable, "stale"},
+		{"bad method", http.MethodPut, nil, http.StatusMethodNotAllowed, "method not allowed\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			th.Set(test.setup)
+			w := httptest.NewRecorder()
+			status(w, httptest.NewRequest(test.method, apiPrefix+statusPath, nil))
+			res := w.Result()
+			defer res.Body.Close()
+			if res.StatusCode != test.expectedStatusCode {
+				t.Errorf("expected status code to be %d, got: %d", test.expectedStatusCode, res.StatusCode)
+			}
+			data, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Errorf("could not read response body: %v", err)
+			}
+			if string(data) != test.expectedBody {
+				t.Errorf("expected %s, got %s", test.expectedBody, string(data))
+			}
+		})
+	}
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
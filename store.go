@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Store is implemented by storage backends. Set with a nil timestamp resets
+// the stored value, Get returns Unix(0, 0) while nothing is stored.
+type Store interface {
+	Set(ts *time.Time) error
+	Get() (time.Time, error)
+}
+
+// DurableStore is implemented by backends whose Set only returns once the
+// value is on stable storage
+type DurableStore interface {
+	Store
+	Durable() bool
+}
+
+// ExpiringStore is implemented by backends that persist the expiry deadline
+// of a value along with it, so a TTL still applies after a restart
+type ExpiringStore interface {
+	Store
+	// SetExpiring stores ts like Set, to be cleared at expiresAt, zero
+	// meaning never
+	SetExpiring(ts *time.Time, expiresAt time.Time) error
+	// Expiry returns the deadline of the stored value, zero for none
+	Expiry() (time.Time, error)
+}
+
+// StoreFactory creates a backend. location is where durable backends keep
+// their data, e.g. a file path; backends that don't need one ignore it.
+type StoreFactory func(location string) (Store, error)
+
+var (
+	backendsMu sync.RWMutex
+	backends   = make(map[string]StoreFactory)
+)
+
+// RegisterBackend makes a backend selectable by name. It panics if name is
+// already taken, as that is a programming error.
+func RegisterBackend(name string, factory StoreFactory) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	if factory == nil {
+		panic("RegisterBackend: nil factory for " + name)
+	}
+	if _, dup := backends[name]; dup {
+		panic("RegisterBackend: backend registered twice: " + name)
+	}
+	backends[name] = factory
+}
+
+// OpenStore creates the backend registered under name
+func OpenStore(name, location string) (Store, error) {
+	backendsMu.RLock()
+	factory, ok := backends[name]
+	backendsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown backend %q, available: %s", name, strings.Join(Backends(), ", "))
+	}
+	return factory(location)
+}
+
+// Backends returns the names of all registered backends
+func Backends() []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	RegisterBackend("memory", func(string) (Store, error) {
+		return &dataStore{}, nil
+	})
+}
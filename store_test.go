@@ -0,0 +1,95 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestOpenStore(t *testing.T) {
+	tests := []struct {
+		description string
+		name        string
+		location    string
+		expectErr   bool
+	}{
+		{"memory", "memory", "", false},
+		{"file", "file", filepath.Join(t.TempDir(), "state"), false},
+		{"file without location", "file", "", true},
+		{"wal", "wal", t.TempDir(), false},
+		{"wal without location", "wal", "", true},
+		{"bolt", "bolt", filepath.Join(t.TempDir(), "ts.db"), false},
+		{"bolt without location", "bolt", "", true},
+		{"unknown", "etcd", "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			s, err := OpenStore(test.name, test.location)
+			if test.expectErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("could not open store: %v", err)
+			}
+			ts := time.Unix(7, 0)
+			if err := s.Set(&ts); err != nil {
+				t.Fatalf("could not store: %v", err)
+			}
+			if mustGet(t, s) != ts {
+				t.Errorf("expected %d, got %d", ts.Unix(), mustGet(t, s).Unix())
+			}
+		})
+	}
+}
+
+func TestRegisterBackend(t *testing.T) {
+	defer func() {
+		backendsMu.Lock()
+		delete(backends, "test")
+		backendsMu.Unlock()
+	}()
+	RegisterBackend("test", func(string) (Store, error) { return &dataStore{}, nil })
+	names := Backends()
+	if !sort.StringsAreSorted(names) {
+		t.Errorf("backends are not sorted: %v", names)
+	}
+	found := false
+	for _, name := range names {
+		found = found || name == "test"
+	}
+	if !found {
+		t.Errorf("registered backend missing from %v", names)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a backend twice should panic")
+		}
+	}()
+	RegisterBackend("test", func(string) (Store, error) { return &dataStore{}, nil })
+}
+
+func TestInitBackend(t *testing.T) {
+	defer initDataStore()
+	path := filepath.Join(t.TempDir(), "state")
+
+	if err := initBackend("", path); err != nil {
+		t.Fatalf("could not init backend: %v", err)
+	}
+	if _, ok := th.(*fileStore); !ok {
+		t.Errorf("expected a data file to select the file backend, got: %T", th)
+	}
+	if err := initBackend("", ""); err != nil {
+		t.Fatalf("could not init backend: %v", err)
+	}
+	if _, ok := th.(*dataStore); !ok {
+		t.Errorf("expected memory backend by default, got: %T", th)
+	}
+	if err := initBackend("nope", ""); err == nil {
+		t.Error("expected an error for an unknown backend")
+	}
+}
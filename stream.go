@@ -0,0 +1,125 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	streamPath = "/stream"
+	// events a connection may fall behind before it misses some
+	streamBuffer = 16
+	// how long before the server's write timeout a long-lived response ends
+	// itself, where the timeout can't be lifted
+	responseDeadlineMargin = 500 * time.Millisecond
+)
+
+var streamHeartbeat = flag.Duration("stream-heartbeat", 15*time.Second, "how often /stream and /ws send a keepalive on idle connections")
+
+// streamHandler pushes the stored timestamp as server-sent events: the current
+// value on connect, then every change, in the format and precision of the
+// query like /retrieve. Each event carries the write ID as its id. Changes
+// smaller than ?min_delta= are left out, see deltaFilter.
+//
+// The server's write timeout is meant for single responses, so it is lifted
+// for the connection of a stream. Where that isn't possible the stream ends
+// itself shortly before the timeout instead. The client is told to
+// reconnect straight away, and as the first event is always the current
+// value, a reconnecting client can't end up with a stale one.
+func streamHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	format, err := timestampFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	unit, err := requestPrecision(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	minDelta, err := requestMinDelta(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// subscribe before reading, so no change falls between the two
+	updates, unsubscribe := events.subscribe(streamBuffer)
+	defer unsubscribe()
+	ts, err := readValue()
+	if err != nil {
+		log(os.Stderr, "could not read timestamp: %s\n", err.Error())
+		http.Error(w, "could not read timestamp", http.StatusInternalServerError)
+		return
+	}
+	filter := deltaFilter{min: minDelta, last: ts}
+
+	var deadline <-chan time.Time
+	if lifetime := responseLifetime(r); !clearWriteDeadline(w) && lifetime > 0 {
+		timer := time.NewTimer(lifetime)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	heartbeat := time.NewTicker(*streamHeartbeat)
+	defer heartbeat.Stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: 0\ndata: %s\n\n", formatTimestamp(ts, format, unit))
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-deadline:
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case e, ok := <-updates:
+			if !ok {
+				return
+			}
+			if !e.changesValue() || !filter.pass(e.Value) {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "id: %s\ndata: %s\n\n", e.ID, formatTimestamp(e.Value, format, unit)); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// clearWriteDeadline lifts the server's write timeout for the response
+// written to w. It reports false when w doesn't allow it.
+func clearWriteDeadline(w http.ResponseWriter) bool {
+	return http.NewResponseController(w).SetWriteDeadline(time.Time{}) == nil
+}
+
+// responseLifetime is how long a response to r can take before the server's
+// write timeout cuts it off, leaving a margin to finish it cleanly. It is 0
+// when there is no write timeout.
+func responseLifetime(r *http.Request) time.Duration {
+	srv, ok := r.Context().Value(http.ServerContextKey).(*http.Server)
+	if !ok || srv.WriteTimeout <= 0 {
+		return 0
+	}
+	if lifetime := srv.WriteTimeout - responseDeadlineMargin; lifetime > 0 {
+		return lifetime
+	}
+	return srv.WriteTimeout / 2
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readSSE returns the lines of the next event or comment block
+func readSSE(t *testing.T, r *bufio.Reader) []string {
+	t.Helper()
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("stream ended early: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return lines
+		}
+		lines = append(lines, line)
+	}
+}
+
+func TestStreamHandler(t *testing.T) {
+	defer resetStore()
+	defer func(d time.Duration) { *streamHeartbeat = d }(*streamHeartbeat)
+	*streamHeartbeat = 200 * time.Millisecond
+	ts := time.Unix(100, 0)
+	th.Set(&ts)
+
+	srv := httptest.NewUnstartedServer(newMux(map[string]http.HandlerFunc{streamPath: streamHandler}))
+	srv.Config.WriteTimeout = 300 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + apiPrefix + streamPath)
+	if err != nil {
+		t.Fatalf("could not open stream: %v", err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("expected an event stream, got: %s", ct)
+	}
+	r := bufio.NewReader(res.Body)
+
+	if got := strings.Join(readSSE(t, r), "|"); got != "retry: 0|data: 100" {
+		t.Errorf("expected the current value first, got: %s", got)
+	}
+	events.publish(Event{Type: EventValueChanged, ID: "01ARZ3NDEKTSV4RRFFQ69G5FAV", Value: time.Unix(200, 0)})
+	if got := strings.Join(readSSE(t, r), "|"); got != "id: 01ARZ3NDEKTSV4RRFFQ69G5FAV|data: 200" {
+		t.Errorf("unexpected update event: %s", got)
+	}
+	if got := strings.Join(readSSE(t, r), "|"); got != ": heartbeat" {
+		t.Errorf("expected a heartbeat, got: %s", got)
+	}
+
+	// the write timeout is lifted for streams
+	time.Sleep(srv.Config.WriteTimeout)
+	events.publish(Event{Type: EventValueChanged, ID: "01ARZ3NDEKTSV4RRFFQ69G5FAW", Value: time.Unix(300, 0)})
+	for {
+		got := strings.Join(readSSE(t, r), "|")
+		if got == ": heartbeat" {
+			continue
+		}
+		if got != "id: 01ARZ3NDEKTSV4RRFFQ69G5FAW|data: 300" {
+			t.Errorf("expected the stream to outlive the write timeout, got: %s", got)
+		}
+		break
+	}
+}
+
+func TestStreamHandlerFormat(t *testing.T) {
+	defer resetStore()
+	resetStore()
+	w := httptest.NewRecorder()
+	streamHandler(w, httptest.NewRequest(http.MethodGet, apiPrefix+streamPath+"?format=iso", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected %d for an unknown format, got: %d", http.StatusBadRequest, w.Code)
+	}
+}
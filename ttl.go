@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// A write can carry a TTL, in the X-TTL header or the "ttl" field of a JSON
+// body, after which the value is cleared as if it had been reset. Expiry is
+// lazy: it happens on the next read or write after the deadline. Backends
+// that restore the value after a restart persist the deadline with it, see
+// ExpiringStore; TTLs are refused with those that can't, where the value
+// would then never expire.
+const ttlHeader = "X-TTL"
+
+// valueExpiresAt is the expiry deadline in Unix nanoseconds, 0 for none
+var valueExpiresAt atomic.Int64
+
+// requestTTL returns the TTL of a write, 0 if it has none. The header wins
+// over the body.
+func requestTTL(r *http.Request, data []byte) (time.Duration, error) {
+	v := r.Header.Get(ttlHeader)
+	if v == "" && mediaType(r.Header.Get("Content-Type")) == contentTypeJSON {
+		var body timestampBody
+		if err := json.Unmarshal(data, &body); err == nil {
+			v = body.TTL
+		}
+	}
+	if v == "" {
+		return 0, nil
+	}
+	return parseDuration("ttl", v, 0)
+}
+
+// supportsTTL reports whether s keeps the deadline for as long as the value:
+// the in-memory backend loses both on restart, an ExpiringStore restores
+// both
+func supportsTTL(s Store) bool {
+	switch s.(type) {
+	case *dataStore, ExpiringStore:
+		return true
+	}
+	return false
+}
+
+// storeValue stores ts to expire after ttl, or never when ttl is 0, along
+// with its deadline when the backend persists it. It must be called with
+// storeMu held.
+func storeValue(ts *time.Time, ttl time.Duration) error {
+	var expiresAt time.Time
+	if ttl > 0 {
+		expiresAt = now().Add(ttl)
+	}
+	var err error
+	if es, ok := th.(ExpiringStore); ok {
+		err = es.SetExpiring(ts, expiresAt)
+	} else {
+		err = th.Set(ts)
+	}
+	if err != nil {
+		return err
+	}
+	setExpiry(expiresAt)
+	return nil
+}
+
+// setExpiry sets the deadline of the stored value, zero for none. It must be
+// called with storeMu held.
+func setExpiry(at time.Time) {
+	if at.IsZero() {
+		valueExpiresAt.Store(0)
+		return
+	}
+	valueExpiresAt.Store(at.UnixNano())
+}
+
+// restoreExpiry picks up the deadline the backend persisted with its value,
+// clearing the value right away if the deadline passed while the server was
+// down
+func restoreExpiry() error {
+	es, ok := th.(ExpiringStore)
+	if !ok {
+		valueExpiresAt.Store(0)
+		return nil
+	}
+	at, err := es.Expiry()
+	if err != nil {
+		return fmt.Errorf("could not read the expiry of the value: %w", err)
+	}
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	setExpiry(at)
+	return expireIfDue()
+}
+
+func expiryDue() bool {
+	at := valueExpiresAt.Load()
+	return at != 0 && now().UnixNano() >= at
+}
+
+// expireIfDue clears the value once its TTL has passed. It must be called with
+// storeMu held.
+func expireIfDue() error {
+	if !expiryDue() {
+		return nil
+	}
+	if err := th.Set(nil); err != nil {
+		return err
+	}
+	valueExpiresAt.Store(0)
+	id := newWriteID(now())
+	log(os.Stdout, "timestamp expired, cleared as write %s\n", id)
+	events.publish(Event{Type: EventExpired, ID: id, Value: time.Unix(0, 0), Writer: "ttl", At: now()})
+	history.record(historyEntry{ID: id, Writer: "ttl", At: now().Unix()})
+	return nil
+}
+
+// expireDue is expireIfDue for readers, which don't hold storeMu
+func expireDue() error {
+	if !expiryDue() {
+		return nil
+	}
+	storeMu.Lock()
+	defer storeMu.Unlock()
+	return expireIfDue()
+}
+
+// readValue returns the stored timestamp, expiring it first if it is due
+func readValue() (time.Time, error) {
+	if err := expireDue(); err != nil {
+		return time.Time{}, err
+	}
+	return th.Get()
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTTL(t *testing.T) {
+	defer resetStore()
+	defer func(v time.Duration) { *devClockSkew = v }(*devClockSkew)
+
+	tests := []struct {
+		description        string
+		contentType        string
+		body               string
+		header             string
+		expectedStatusCode int
+		// value read back before and after a minute has passed
+		before, after int64
+	}{
+		{"no ttl", contentTypeText, "100", "", http.StatusOK, 100, 100},
+		{"header", contentTypeText, "100", "30s", http.StatusOK, 100, 0},
+		{"header longer than a minute", contentTypeText, "100", "2m", http.StatusOK, 100, 100},
+		{"json", contentTypeJSON, `{"timestamp":100,"ttl":"30s"}`, "", http.StatusOK, 100, 0},
+		{"header wins over json", contentTypeJSON, `{"timestamp":100,"ttl":"30s"}`, "2m", http.StatusOK, 100, 100},
+		{"invalid", contentTypeText, "100", "soon", http.StatusBadRequest, 0, 0},
+		{"negative", contentTypeText, "100", "-1s", http.StatusBadRequest, 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			resetStore()
+			*devClockSkew = 0
+			req := httptest.NewRequest(http.MethodPut, getStorePath(), bytes.NewReader([]byte(test.body)))
+			req.Header.Set("Content-Type", test.contentType)
+			if test.header != "" {
+				req.Header.Set(ttlHeader, test.header)
+			}
+			w := httptest.NewRecorder()
+			update(w, req)
+			if w.Code != test.expectedStatusCode {
+				t.Fatalf("expected status code to be %d, got: %d", test.expectedStatusCode, w.Code)
+			}
+			for _, step := range []struct {
+				skew     time.Duration
+				expected int64
+			}{{0, test.before}, {time.Minute, test.after}} {
+				*devClockSkew = step.skew
+				ts, err := readValue()
+				if err != nil {
+					t.Fatalf("could not read: %v", err)
+				}
+				if ts.Unix() != step.expected {
+					t.Errorf("expected %d after %s, got: %d", step.expected, step.skew, ts.Unix())
+				}
+			}
+		})
+	}
+}
+
+func TestTTLReplacedByLaterWrite(t *testing.T) {
+	defer resetStore()
+	defer func(v time.Duration) { *devClockSkew = v }(*devClockSkew)
+
+	for _, ttl := range []string{"30s", ""} {
+		req := httptest.NewRequest(http.MethodPut, getStorePath(), bytes.NewReader([]byte("100")))
+		req.Header.Set("Content-Type", contentTypeText)
+		if ttl != "" {
+			req.Header.Set(ttlHeader, ttl)
+		}
+		update(httptest.NewRecorder(), req)
+	}
+	*devClockSkew = time.Minute
+	if got := mustGet(t, th).Unix(); got != 100 {
+		t.Errorf("a write without ttl should not expire, got: %d", got)
+	}
+	if ts, _ := readValue(); ts.Unix() != 100 {
+		t.Errorf("a write without ttl should not expire, got: %d", ts.Unix())
+	}
+}
+
+// TestTTLSurvivesRestart writes a value with a TTL, reopens the backend and
+// checks the value still expires, also when it expired while closed
+func TestTTLSurvivesRestart(t *testing.T) {
+	defer func(s Store) { th = s }(th)
+	defer resetStore()
+	defer func(v time.Duration) { *devClockSkew = v }(*devClockSkew)
+	tests := []struct {
+		backend  string
+		location func(dir string) string
+	}{
+		{"file", func(dir string) string { return filepath.Join(dir, "state") }},
+		{"wal", func(dir string) string { return dir }},
+		{"bolt", func(dir string) string { return filepath.Join(dir, "bolt.db") }},
+		{"sqlite", func(dir string) string { return filepath.Join(dir, "sqlite.db") }},
+	}
+	reopen := func(t *testing.T, backend, location string) {
+		t.Helper()
+		if c, ok := th.(io.Closer); ok {
+			c.Close()
+		}
+		if err := initBackend(backend, location); err != nil {
+			t.Fatalf("could not open %s: %v", backend, err)
+		}
+		t.Cleanup(func() {
+			if c, ok := th.(io.Closer); ok {
+				c.Close()
+			}
+		})
+	}
+	for _, test := range tests {
+		t.Run(test.backend, func(t *testing.T) {
+			location := test.location(t.TempDir())
+			*devClockSkew = 0
+			reopen(t, test.backend, location)
+			write := func() {
+				t.Helper()
+				req := httptest.NewRequest(http.MethodPut, getStorePath(), bytes.NewReader([]byte("100")))
+				req.Header.Set("Content-Type", contentTypeText)
+				req.Header.Set(ttlHeader, "30s")
+				w := httptest.NewRecorder()
+				update(w, req)
+				if w.Code != http.StatusOK {
+					t.Fatalf("expected the TTL write to be stored, got: %d %s", w.Code, w.Body)
+				}
+			}
+			write()
+
+			reopen(t, test.backend, location)
+			if ts, _ := readValue(); ts.Unix() != 100 {
+				t.Errorf("expected the value to be restored before its deadline, got: %d", ts.Unix())
+			}
+			*devClockSkew = time.Minute
+			if ts, _ := readValue(); ts.Unix() != 0 {
+				t.Errorf("expected the restored value to expire, got: %d", ts.Unix())
+			}
+
+			// expired while the server was down
+			*devClockSkew = 0
+			write()
+			*devClockSkew = time.Minute
+			reopen(t, test.backend, location)
+			if got := mustGet(t, th).Unix(); got != 0 {
+				t.Errorf("expected a value past its deadline to be cleared on load, got: %d", got)
+			}
+		})
+	}
+}
+
+func TestTTLRefusedWithoutExpiry(t *testing.T) {
+	defer func(s Store) { th = s }(th)
+	m, err := instantiateWASM("test", testWASMModule())
+	if err != nil {
+		t.Fatalf("could not instantiate module: %v", err)
+	}
+	s := &wasmStore{m}
+	defer s.Close()
+	th = s
+
+	req := httptest.NewRequest(http.MethodPut, getStorePath(), bytes.NewReader([]byte("100")))
+	req.Header.Set("Content-Type", contentTypeText)
+	req.Header.Set(ttlHeader, "30s")
+	w := httptest.NewRecorder()
+	update(w, req)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected a TTL write to a wasm store to be refused with %d, got: %d", http.StatusUnprocessableEntity, w.Code)
+	}
+	if got := mustGet(t, s).Unix(); got != 0 {
+		t.Errorf("expected nothing to be stored, got: %d", got)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"time"
+)
+
+const writeIDHeader = "X-Write-Id"
+
+// Crockford's base32, as used by ULIDs
+const ulidAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newWriteID returns a ULID: 48 bits of milliseconds followed by 80 random
+// bits, encoded as 26 characters that sort in the order the IDs were made
+// (within the same millisecond the order is random)
+func newWriteID(at time.Time) string {
+	var id [16]byte
+	binary.BigEndian.PutUint64(id[:8], uint64(at.UnixMilli())<<16)
+	if _, err := rand.Read(id[6:]); err != nil {
+		panic("could not read random bytes: " + err.Error())
+	}
+	return encodeULID(id)
+}
+
+// encodeULID writes the 128 bits as 26 5-bit digits, the first of which only
+// carries 3 bits
+func encodeULID(id [16]byte) string {
+	hi := binary.BigEndian.Uint64(id[:8])
+	lo := binary.BigEndian.Uint64(id[8:])
+	var out [26]byte
+	for i := 25; i >= 0; i-- {
+		out[i] = ulidAlphabet[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEncodeULID(t *testing.T) {
+	tests := []struct {
+		description string
+		id          [16]byte
+		expected    string
+	}{
+		{"zero", [16]byte{}, "00000000000000000000000000"},
+		{"max", [16]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, "7ZZZZZZZZZZZZZZZZZZZZZZZZZ"},
+		{"one", [16]byte{15: 1}, "00000000000000000000000001"},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			if got := encodeULID(test.id); got != test.expected {
+				t.Errorf("expected %s, got: %s", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestNewWriteID(t *testing.T) {
+	at := time.UnixMilli(1469918176385)
+	id := newWriteID(at)
+	// timestamp part of the example in the ULID spec
+	if id[:10] != "01ARYZ6S41" {
+		t.Errorf("expected time prefix 01ARYZ6S41, got: %s", id)
+	}
+	if other := newWriteID(at); other == id {
+		t.Errorf("expected unique IDs, got %s twice", id)
+	}
+	if later := newWriteID(at.Add(time.Millisecond)); later <= id {
+		t.Errorf("expected %s to sort after %s", later, id)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// usage export aggregates the write history per writer over daily or monthly
+// UTC windows, for chargeback without shipping raw history around
+const usagePath = "/export/usage"
+
+var usageWindows = map[string]string{
+	"daily":   "2006-01-02",
+	"monthly": "2006-01",
+}
+
+type usageRow struct {
+	Window string `json:"window"`
+	Writer string `json:"writer"`
+	Writes int    `json:"writes"`
+	First  int64  `json:"first"`
+	Last   int64  `json:"last"`
+	// longest time between two writes of the writer within the window
+	MaxGapSeconds int64 `json:"max_gap_seconds"`
+}
+
+// aggregateUsage groups writes that arrived in [from, to] by window and
+// writer, ordered by window and then writer
+func aggregateUsage(h *writeHistory, from, to time.Time, layout string) []usageRow {
+	type key struct{ window, writer string }
+	rows := map[key]*usageRow{}
+	h.each(from, to, func(e historyEntry) bool {
+		k := key{time.Unix(e.At, 0).UTC().Format(layout), e.Writer}
+		row, ok := rows[k]
+		if !ok {
+			rows[k] = &usageRow{Window: k.window, Writer: k.writer, Writes: 1, First: e.At, Last: e.At}
+			return true
+		}
+		if gap := e.At - row.Last; gap > row.MaxGapSeconds {
+			row.MaxGapSeconds = gap
+		}
+		row.Writes++
+		row.Last = e.At
+		return true
+	})
+	res := make([]usageRow, 0, len(rows))
+	for _, row := range rows {
+		res = append(res, *row)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Window != res[j].Window {
+			return res[i].Window < res[j].Window
+		}
+		return res[i].Writer < res[j].Writer
+	})
+	return res
+}
+
+// usageHandler serves GET /export/usage?window=daily|monthly&format=json|csv
+// with the same optional from and to as /history
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if history == nil {
+		http.Error(w, "history is not enabled", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	window := q.Get("window")
+	if window == "" {
+		window = "daily"
+	}
+	layout, ok := usageWindows[window]
+	if !ok {
+		http.Error(w, "window must be daily or monthly", http.StatusBadRequest)
+		return
+	}
+	format := q.Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		http.Error(w, "format must be json or csv", http.StatusBadRequest)
+		return
+	}
+	from, to, err := historyRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rows := aggregateUsage(history, from, to, layout)
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		err = writeUsageCSV(w, rows)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(rows)
+	}
+	if err != nil {
+		log(os.Stderr, "error while writing usage export: %s\n", err.Error())
+	}
+}
+
+func writeUsageCSV(w http.ResponseWriter, rows []usageRow) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"window", "writer", "writes", "first", "last", "max_gap_seconds"})
+	for _, row := range rows {
+		cw.Write([]string{
+			row.Window,
+			row.Writer,
+			strconv.Itoa(row.Writes),
+			strconv.FormatInt(row.First, 10),
+			strconv.FormatInt(row.Last, 10),
+			strconv.FormatInt(row.MaxGapSeconds, 10),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
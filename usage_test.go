@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestUsageHandler(t *testing.T) {
+	defer func(h *writeHistory) { history = h }(history)
+	history = &writeHistory{}
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC).Unix()
+	for _, e := range []struct {
+		writer string
+		at     int64
+	}{
+		{"a", day},
+		{"b", day + 60},
+		{"a", day + 600},
+		{"a", day + 700},
+		{"a", day + 86400},
+		{"a", day + 31*86400},
+	} {
+		history.record(historyEntry{Writer: e.writer, At: e.at})
+	}
+
+	tests := []struct {
+		description        string
+		query              string
+		expectedStatusCode int
+		expectedBody       string
+	}{
+		{"daily", "?format=csv", http.StatusOK, "window,writer,writes,first,last,max_gap_seconds\n" +
+			"2024-03-01,a,3,1709251200,1709251900,600\n" +
+			"2024-03-01,b,1,1709251260,1709251260,0\n" +
+			"2024-03-02,a,1,1709337600,1709337600,0\n" +
+			"2024-04-01,a,1,1711929600,1711929600,0\n"},
+		{"monthly", "?window=monthly&format=csv", http.StatusOK, "window,writer,writes,first,last,max_gap_seconds\n" +
+			"2024-03,a,4,1709251200,1709337600,85700\n" +
+			"2024-03,b,1,1709251260,1709251260,0\n" +
+			"2024-04,a,1,1711929600,1711929600,0\n"},
+		{"json in range", "?window=monthly&from=1711929600", http.StatusOK,
+			`[{"window":"2024-04","writer":"a","writes":1,"first":1711929600,"last":1711929600,"max_gap_seconds":0}]` + "\n"},
+		{"bad window", "?window=weekly", http.StatusBadRequest, "window must be daily or monthly\n"},
+		{"bad format", "?format=xml", http.StatusBadRequest, "format must be json or csv\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			usageHandler(w, httptest.NewRequest(http.MethodGet, apiPrefix+usagePath+test.query, nil))
+			if w.Code != test.expectedStatusCode {
+				t.Errorf("expected status code to be %d, got: %d", test.expectedStatusCode, w.Code)
+			}
+			if w.Body.String() != test.expectedBody {
+				t.Errorf("expected %q, got: %q", test.expectedBody, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+const defaultValidationTimeout = 500 * time.Millisecond
+
+// external validation hook: before a write is stored it is POSTed to
+// validationURL, a 2xx answer allows it and a 4xx answer denies it
+var (
+	validationURL string
+	// validationFailOpen allows writes when the hook can't be reached or
+	// errors, by default they are rejected
+	validationFailOpen bool
+	validationClient   = &http.Client{Timeout: defaultValidationTimeout}
+)
+
+func init() {
+	flag.StringVar(&validationURL, "validation-url", "", "URL every write is POSTed to before it is stored, a 4xx answer denies it, disabled if empty")
+	flag.BoolVar(&validationFailOpen, "validation-fail-open", false, "allow writes when -validation-url can't be reached or errors instead of rejecting them")
+}
+
+// checkValidationURL refuses anything but an absolute http or https URL
+func checkValidationURL(v string) error {
+	u, err := url.Parse(v)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%q is not an http or https URL", v)
+	}
+	return nil
+}
+
+var (
+	errWriteDenied           = errors.New("write denied by validation hook")
+	errValidationUnavailable = errors.New("validation hook unavailable")
+)
+
+type validationRequest struct {
+	Timestamp int64  `json:"timestamp"`
+	Nsec      int64  `json:"nsec,omitempty"`
+	Writer    string `json:"writer"`
+}
+
+// validateWrite asks the configured authority whether ts may be stored
+func validateWrite(ctx context.Context, ts time.Time, writer string) error {
+	if validationURL == "" {
+		return nil
+	}
+	body, err := json.Marshal(validationRequest{Timestamp: ts.Unix(), Nsec: int64(ts.Nanosecond()), Writer: writer})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, validationURL, bytes.NewReader(body))
+	if err != nil {
+		return validationUnavailable(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	rsp, err := validationClient.Do(req)
+	if err != nil {
+		return validationUnavailable(err)
+	}
+	defer rsp.Body.Close()
+	// drained for the connection to be reused, but only so far
+	io.Copy(io.Discard, io.LimitReader(rsp.Body, maxReqBytes))
+	switch {
+	case rsp.StatusCode >= 200 && rsp.StatusCode < 300:
+		return nil
+	case rsp.StatusCode >= 400 && rsp.StatusCode < 500:
+		return errWriteDenied
+	default:
+		return validationUnavailable(fmt.Errorf("unexpected status: %s", rsp.Status))
+	}
+}
+
+func validationUnavailable(err error) error {
+	if validationFailOpen {
+		log(os.Stderr, "validation hook failed, allowing write: %s\n", err.Error())
+		return nil
+	}
+	return fmt.Errorf("%w: %s", errValidationUnavailable, err.Error())
+}
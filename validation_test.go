@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestValidateWrite(t *testing.T) {
+	defer resetStore()
+	defer func() {
+		validationURL = ""
+		validationFailOpen = false
+		validationClient.Timeout = defaultValidationTimeout
+	}()
+
+	var (
+		mu  sync.Mutex
+		got validationRequest
+	)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req validationRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("could not decode validation request: %v", err)
+		}
+		mu.Lock()
+		got = req
+		mu.Unlock()
+		switch req.Timestamp {
+		case 100:
+			w.WriteHeader(http.StatusForbidden)
+		case 200:
+			w.WriteHeader(http.StatusInternalServerError)
+		case 300:
+			time.Sleep(200 * time.Millisecond)
+		}
+	}))
+	defer hook.Close()
+	validationClient.Timeout = 100 * time.Millisecond
+
+	type tc struct {
+		description        string
+		url                string
+		failOpen           bool
+		body               string
+		expectedStatusCode int
+	}
+	testCases := []tc{
+		{"disabled", "", false, "100", http.StatusOK},
+		{"allowed", hook.URL, false, "10", http.StatusOK},
+		{"denied", hook.URL, false, "100", http.StatusForbidden},
+		{"hook error fail closed", hook.URL, false, "200", http.StatusServiceUnavailable},
+		{"hook error fail open", hook.URL, true, "200", http.StatusOK},
+		{"hook timeout fail closed", hook.URL, false, "300", http.StatusServiceUnavailable},
+		{"denied even if fail open", hook.URL, true, "100", http.StatusForbidden},
+	}
+	for _, test := range testCases {
+		t.Run(test.description, func(t *testing.T) {
+			validationURL = test.url
+			validationFailOpen = test.failOpen
+			req := httptest.NewRequest(http.MethodPut, getStorePath(), bytes.NewReader([]byte(test.body)))
+			req.Header.Set("Content-Type", "text/plain")
+			req.Header.Set(writerIDHeader, "agent-1")
+			w := httptest.NewRecorder()
+			update(w, req)
+			if w.Code != test.expectedStatusCode {
+				t.Errorf("expected status code to be %d, got: %d", test.expectedStatusCode, w.Code)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if test.url != "" && got.Writer != "agent-1" {
+				t.Errorf("writer not passed to hook, got: %s", got.Writer)
+			}
+		})
+	}
+}
+
+func TestValidateWriteEndlessBody(t *testing.T) {
+	defer func() { validationURL = "" }()
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chunk := bytes.Repeat([]byte("x"), 4096)
+		for r.Context().Err() == nil {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	}))
+	defer hook.Close()
+	validationURL = hook.URL
+
+	// only as much as a request body may hold is read, rather than
+	// everything until the validation timeout
+	start := time.Now()
+	if err := validateWrite(context.Background(), time.Unix(10, 0), "agent-1"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if took := time.Since(start); took > defaultValidationTimeout/2 {
+		t.Errorf("expected the response body to be cut short, took %s", took)
+	}
+}
+
+func TestValidationFlags(t *testing.T) {
+	defer resetStore()
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer hook.Close()
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	tests := []struct {
+		description        string
+		args               []string
+		wantErr            bool
+		expectedStatusCode int
+	}{
+		{"disabled", nil, false, http.StatusOK},
+		{"denied", []string{"-validation-url", hook.URL}, false, http.StatusForbidden},
+		{"unreachable", []string{"-validation-url", unreachable.URL}, false, http.StatusServiceUnavailable},
+		{"unreachable fail open", []string{"-validation-url", unreachable.URL, "-validation-fail-open"}, false, http.StatusOK},
+		{"not a URL", []string{"-validation-url", "hook.example.com/validate"}, true, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			err := configureForTest(t, test.args...)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("configure(%q) = %v, want error %t", test.args, err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			req := httptest.NewRequest(http.MethodPut, apiPrefix+putPath, bytes.NewReader([]byte("10")))
+			req.Header.Set("Content-Type", "text/plain")
+			w := httptest.NewRecorder()
+			httpServer.Handler.ServeHTTP(w, req)
+			if w.Code != test.expectedStatusCode {
+				t.Errorf("expected status code to be %d, got: %d", test.expectedStatusCode, w.Code)
+			}
+		})
+	}
+}
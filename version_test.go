@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+)
+
+func TestVersionHandler(t *testing.T) {
+	defer func(v versionInfo) { build = v }(build)
+	build = versionInfo{Version: "1.4.0", Commit: "abc123", BuildDate: "2026-10-01T12:00:00Z", GoVersion: "go1.19", OS: "linux", Arch: "amd64"}
+
+	w := httptest.NewRecorder()
+	versionHandler(w, httptest.NewRequest(http.MethodGet, apiPrefix+versionPath, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d, got: %d", http.StatusOK, w.Code)
+	}
+	var got versionInfo
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatalf("could not decode version info: %v", err)
+	}
+	if got != build {
+		t.Errorf("expected %+v, got: %+v", build, got)
+	}
+
+	w = httptest.NewRecorder()
+	versionHandler(w, httptest.NewRequest(http.MethodPost, apiPrefix+versionPath, nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected %d, got: %d", http.StatusMethodNotAllowed, w.Code)
+	}
+}
+
+func TestReadVersionInfo(t *testing.T) {
+	defer func(v, c, d string) { version, commit, buildDate = v, c, d }(version, commit, buildDate)
+	version, commit, buildDate = "1.4.0", "abc123", "2026-10-01T12:00:00Z"
+	v := readVersionInfo()
+	// ldflags win over the embedded build info
+	if v.Version != "1.4.0" || v.Commit != "abc123" || v.BuildDate != "2026-10-01T12:00:00Z" {
+		t.Errorf("expected the ldflags values, got: %+v", v)
+	}
+	if v.GoVersion != runtime.Version() || v.OS != runtime.GOOS || v.Arch != runtime.GOARCH {
+		t.Errorf("expected the runtime of this binary, got: %+v", v)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	walFileName         = "wal.log"
+	walSnapshotName     = "snapshot"
+	defaultCompactEvery = 1000
+	walResetValue       = "-"
+)
+
+func init() {
+	RegisterBackend("wal", func(location string) (Store, error) {
+		if location == "" {
+			return nil, errors.New("wal backend requires a data directory")
+		}
+		return openWALStore(location)
+	})
+}
+
+// walRecord is one store() call. A nil ts records a reset.
+type walRecord struct {
+	seq uint64
+	ts  *time.Time
+	// expiresAt is the deadline of a value with a TTL, zero for none
+	expiresAt time.Time
+}
+
+// records are written as "<seq> <unix seconds or -> <crc32>\n", with the same
+// seconds format as the state file. A value with a TTL has its deadline
+// after the seconds, as in the state file.
+func encodeRecord(rec walRecord) []byte {
+	value := walResetValue
+	if rec.ts != nil {
+		value = formatStateTime(*rec.ts)
+		if !rec.expiresAt.IsZero() {
+			value += " " + formatStateTime(rec.expiresAt)
+		}
+	}
+	payload := strconv.FormatUint(rec.seq, 10) + " " + value
+	return []byte(fmt.Sprintf("%s %08x\n", payload, crc32.ChecksumIEEE([]byte(payload))))
+}
+
+func decodeRecord(line string) (walRecord, error) {
+	i := strings.LastIndexByte(line, ' ')
+	if i < 0 {
+		return walRecord{}, errors.New("malformed record")
+	}
+	payload, sum := line[:i], line[i+1:]
+	if fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(payload))) != sum {
+		return walRecord{}, errors.New("checksum mismatch")
+	}
+	seqStr, value, ok := strings.Cut(payload, " ")
+	if !ok {
+		return walRecord{}, errors.New("malformed record")
+	}
+	seq, err := strconv.ParseUint(seqStr, 10, 64)
+	if err != nil {
+		return walRecord{}, fmt.Errorf("invalid sequence number: %w", err)
+	}
+	rec := walRecord{seq: seq}
+	if value == walResetValue {
+		return rec, nil
+	}
+	value, expiry, hasExpiry := strings.Cut(value, " ")
+	ts, err := parseStateTime(value)
+	if err != nil {
+		return walRecord{}, err
+	}
+	rec.ts = &ts
+	if hasExpiry {
+		if rec.expiresAt, err = parseStateTime(expiry); err != nil {
+			return walRecord{}, fmt.Errorf("invalid expiry: %w", err)
+		}
+	}
+	return rec, nil
+}
+
+// walFile is the open log, an *os.File but for tests injecting failures
+type walFile interface {
+	io.WriteCloser
+	Sync() error
+	Truncate(size int64) error
+}
+
+// walStore appends every update to a write-ahead log and fsyncs it before
+// acknowledging the write. Every compactEvery records the current value is
+// written to a snapshot and the log is truncated. On startup the snapshot is
+// loaded and the log replayed on top of it.
+//
+// A write that fails is cut from the log again, so it can neither come back
+// on replay nor hide the records acknowledged after it behind a torn one. If
+// that fails too, the log can't be trusted and the store refuses all further
+// writes.
+type walStore struct {
+	dataStore
+	mu           sync.Mutex
+	dir          string
+	log          walFile
+	size         int64 // of the log up to the last acknowledged record
+	failed       error
+	seq          uint64
+	expiresAt    time.Time // of the current value, zero for none
+	pending      int
+	compactEvery int
+}
+
+func openWALStore(dir string) (*walStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	s := &walStore{dir: dir, compactEvery: defaultCompactEvery}
+	if err := s.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(s.logPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	// a log created just now must not vanish with the records synced to it
+	if err := syncDir(dir); err != nil {
+		f.Close()
+		return nil, err
+	}
+	s.log = f
+	return s, nil
+}
+
+func (s *walStore) logPath() string {
+	return filepath.Join(s.dir, walFileName)
+}
+
+func (s *walStore) snapshotPath() string {
+	return filepath.Join(s.dir, walSnapshotName)
+}
+
+func (s *walStore) apply(rec walRecord) {
+	s.seq = rec.seq
+	s.expiresAt = rec.expiresAt
+	s.dataStore.Set(rec.ts)
+}
+
+func (s *walStore) loadSnapshot() error {
+	data, err := os.ReadFile(s.snapshotPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	rec, err := decodeRecord(strings.TrimSuffix(string(data), "\n"))
+	if err != nil {
+		// the snapshot is replaced atomically, so this is not a torn write
+		return fmt.Errorf("corrupt snapshot %s: %w", s.snapshotPath(), err)
+	}
+	s.apply(rec)
+	return nil
+}
+
+// replay applies the logged records newer than the snapshot. The log is cut
+// at the first invalid record, which is what a crash mid-append leaves behind.
+func (s *walStore) replay() error {
+	f, err := os.OpenFile(s.logPath(), os.O_RDWR, 0o600)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	valid := scanWAL(f, func(rec walRecord) {
+		if rec.seq > s.seq {
+			s.apply(rec)
+			s.pending++
+		}
+	})
+	s.size = valid
+	return f.Truncate(valid)
+}
+
+// scanWAL calls fn for every valid record in r and returns the length of the
+// valid prefix, stopping at the first record that is torn or corrupt
+func scanWAL(r io.Reader, fn func(walRecord)) int64 {
+	var valid int64
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			// a record without its newline was never fully written
+			return valid
+		}
+		rec, err := decodeRecord(strings.TrimSuffix(line, "\n"))
+		if err != nil {
+			log(os.Stderr, "wal is invalid from offset %d: %s\n", valid, err.Error())
+			return valid
+		}
+		valid += int64(len(line))
+		fn(rec)
+	}
+}
+
+func (s *walStore) Set(ts *time.Time) error {
+	return s.SetExpiring(ts, time.Time{})
+}
+
+func (s *walStore) SetExpiring(ts *time.Time, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failed != nil {
+		return fmt.Errorf("wal unusable after a failed write: %w", s.failed)
+	}
+	rec := walRecord{seq: s.seq + 1, ts: ts, expiresAt: expiresAt}
+	data := encodeRecord(rec)
+	if _, err := s.log.Write(data); err != nil {
+		s.discardFailedWrite()
+		return fmt.Errorf("could not append to wal: %w", err)
+	}
+	if err := s.log.Sync(); err != nil {
+		s.discardFailedWrite()
+		return fmt.Errorf("could not sync wal: %w", err)
+	}
+	s.size += int64(len(data))
+	s.apply(rec)
+	s.pending++
+	if s.pending >= s.compactEvery {
+		if err := s.compact(); err != nil {
+			// the log still holds every record, compaction is retried on
+			// the next write
+			log(os.Stderr, "could not compact wal: %s\n", err.Error())
+		}
+	}
+	return nil
+}
+
+// discardFailedWrite cuts whatever a failed write left behind from the log,
+// or marks the store failed if it can't. It must be called with mu held.
+func (s *walStore) discardFailedWrite() {
+	err := s.log.Truncate(s.size)
+	if err == nil {
+		err = s.log.Sync()
+	}
+	if err != nil {
+		log(os.Stderr, "could not remove failed write from wal, refusing further writes: %s\n", err.Error())
+		s.failed = err
+	}
+}
+
+// compact must be called with mu held
+func (s *walStore) compact() error {
+	ts, err := s.dataStore.Get()
+	if err != nil {
+		return err
+	}
+	rec := walRecord{seq: s.seq}
+	if s.dataStore.ts.Load() != nil {
+		rec.ts = &ts
+		rec.expiresAt = s.expiresAt
+	}
+	// writeFileAtomic syncs the directory too, so the snapshot is in place
+	// for good before the log it replaces is cut
+	if err := writeFileAtomic(s.snapshotPath(), encodeRecord(rec)); err != nil {
+		return err
+	}
+	// records up to seq are in the snapshot now, a crash before the
+	// truncation only means replaying records the snapshot already covers
+	if err := s.log.Truncate(0); err != nil {
+		return err
+	}
+	s.size = 0
+	if err := s.log.Sync(); err != nil {
+		return err
+	}
+	s.pending = 0
+	return nil
+}
+
+func (s *walStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.log.Close()
+}
+
+func (s *walStore) Expiry() (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.expiresAt, nil
+}
+
+func (s *walStore) Durable() bool {
+	return true
+}
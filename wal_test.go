@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWALRecord(t *testing.T) {
+	ts, precise := time.Unix(1234, 0), time.Unix(1234, 5)
+	for _, rec := range []walRecord{{seq: 1, ts: &ts}, {seq: 2}, {seq: 3, ts: &precise}, {seq: 4, ts: &ts, expiresAt: precise}} {
+		line := string(encodeRecord(rec))
+		got, err := decodeRecord(line[:len(line)-1])
+		if err != nil {
+			t.Fatalf("could not decode %q: %v", line, err)
+		}
+		if got.seq != rec.seq || (got.ts == nil) != (rec.ts == nil) || (got.ts != nil && !got.ts.Equal(*rec.ts)) || !got.expiresAt.Equal(rec.expiresAt) {
+			t.Errorf("expected %+v, got: %+v", rec, got)
+		}
+	}
+	for _, line := range []string{"", "1 2", "1 2 deadbeef", "x 5 " + "00000000"} {
+		if _, err := decodeRecord(line); err == nil {
+			t.Errorf("expected %q to be rejected", line)
+		}
+	}
+}
+
+func TestWALStoreReplay(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openWALStore(dir)
+	if err != nil {
+		t.Fatalf("could not open wal: %v", err)
+	}
+	for _, sec := range []int64{10, 20, 30} {
+		ts := time.Unix(sec, 0)
+		if err := s.Set(&ts); err != nil {
+			t.Fatalf("could not store: %v", err)
+		}
+	}
+	s.Close()
+
+	reopened, err := openWALStore(dir)
+	if err != nil {
+		t.Fatalf("could not reopen wal: %v", err)
+	}
+	defer reopened.Close()
+	if got := mustGet(t, reopened).Unix(); got != 30 {
+		t.Errorf("expected 30 after replay, got: %d", got)
+	}
+	if reopened.seq != 3 {
+		t.Errorf("expected sequence 3, got: %d", reopened.seq)
+	}
+	if err := reopened.Set(nil); err != nil {
+		t.Fatalf("could not reset: %v", err)
+	}
+	reopened.Close()
+	s, err = openWALStore(dir)
+	if err != nil {
+		t.Fatalf("could not reopen wal: %v", err)
+	}
+	defer s.Close()
+	if got := mustGet(t, s).Unix(); got != 0 {
+		t.Errorf("expected reset to be replayed, got: %d", got)
+	}
+}
+
+func TestWALStoreTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	ts := time.Unix(10, 0)
+	log := append(encodeRecord(walRecord{seq: 1, ts: &ts}), []byte("2 20 ab")...)
+	if err := os.WriteFile(filepath.Join(dir, walFileName), log, 0o600); err != nil {
+		t.Fatalf("could not write wal: %v", err)
+	}
+	s, err := openWALStore(dir)
+	if err != nil {
+		t.Fatalf("could not open wal: %v", err)
+	}
+	if got := mustGet(t, s).Unix(); got != 10 {
+		t.Errorf("expected last complete record, got: %d", got)
+	}
+	// the next write must not be glued to the torn record
+	next := time.Unix(30, 0)
+	if err := s.Set(&next); err != nil {
+		t.Fatalf("could not store: %v", err)
+	}
+	s.Close()
+	s, err = openWALStore(dir)
+	if err != nil {
+		t.Fatalf("could not reopen wal: %v", err)
+	}
+	defer s.Close()
+	if got := mustGet(t, s).Unix(); got != 30 {
+		t.Errorf("expected 30, got: %d", got)
+	}
+}
+
+func TestWALStoreCompaction(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openWALStore(dir)
+	if err != nil {
+		t.Fatalf("could not open wal: %v", err)
+	}
+	s.compactEvery = 3
+	for sec := int64(1); sec <= 4; sec++ {
+		ts := time.Unix(sec, 0)
+		if err := s.Set(&ts); err != nil {
+			t.Fatalf("could not store: %v", err)
+		}
+	}
+	s.Close()
+
+	if _, err := os.Stat(filepath.Join(dir, walSnapshotName)); err != nil {
+		t.Fatalf("snapshot was not written: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, walFileName))
+	if err != nil {
+		t.Fatalf("could not read wal: %v", err)
+	}
+	ts := time.Unix(4, 0)
+	if string(data) != string(encodeRecord(walRecord{seq: 4, ts: &ts})) {
+		t.Errorf("expected only the record after compaction in the log, got: %q", string(data))
+	}
+
+	s, err = openWALStore(dir)
+	if err != nil {
+		t.Fatalf("could not reopen wal: %v", err)
+	}
+	defer s.Close()
+	if got := mustGet(t, s).Unix(); got != 4 {
+		t.Errorf("expected 4 after snapshot and replay, got: %d", got)
+	}
+}
+
+// faultyWAL fails the next write after writing half of it, or the next sync
+// or truncation
+type faultyWAL struct {
+	*os.File
+	shortWrite, failSync, failTruncate bool
+}
+
+func (f *faultyWAL) Write(p []byte) (int, error) {
+	if f.shortWrite {
+		f.shortWrite = false
+		n, _ := f.File.Write(p[:len(p)/2])
+		return n, io.ErrShortWrite
+	}
+	return f.File.Write(p)
+}
+
+func (f *faultyWAL) Sync() error {
+	if f.failSync {
+		f.failSync = false
+		return errors.New("injected sync failure")
+	}
+	return f.File.Sync()
+}
+
+func (f *faultyWAL) Truncate(size int64) error {
+	if f.failTruncate {
+		return errors.New("injected truncate failure")
+	}
+	return f.File.Truncate(size)
+}
+
+func TestWALStoreFailedWrite(t *testing.T) {
+	tests := []struct {
+		description string
+		fault       faultyWAL
+		usable      bool
+	}{
+		{"short write", faultyWAL{shortWrite: true}, true},
+		{"failed sync", faultyWAL{failSync: true}, true},
+		{"short write not removable", faultyWAL{shortWrite: true, failTruncate: true}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			dir := t.TempDir()
+			s, err := openWALStore(dir)
+			if err != nil {
+				t.Fatalf("could not open wal: %v", err)
+			}
+			first := time.Unix(10, 0)
+			if err := s.Set(&first); err != nil {
+				t.Fatalf("could not store: %v", err)
+			}
+			fault := test.fault
+			fault.File = s.log.(*os.File)
+			s.log = &fault
+
+			failed := time.Unix(20, 0)
+			if err := s.Set(&failed); err == nil {
+				t.Fatal("expected the faulty write to fail")
+			}
+			fault.failTruncate = false
+			next := time.Unix(30, 0)
+			err = s.Set(&next)
+			if test.usable != (err == nil) {
+				t.Fatalf("expected the store to be usable %t, got: %v", test.usable, err)
+			}
+			s.Close()
+
+			s, err = openWALStore(dir)
+			if err != nil {
+				t.Fatalf("could not reopen wal: %v", err)
+			}
+			defer s.Close()
+			want := int64(10)
+			if test.usable {
+				want = 30
+			}
+			if got := mustGet(t, s).Unix(); got != want {
+				t.Errorf("expected %d after replay, got: %d", want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// WASM plugins are loaded with wazero, so they need neither cgo nor a rebuild
+// of the server. Modules are instantiated as reactors: "_initialize" is run if
+// exported, "_start" is not. WASI is available without any filesystem access.
+//
+// A storage adapter exports:
+//
+//	ts_set(nsec i64) -> i32   0 on success
+//	ts_reset() -> i32         0 on success
+//	ts_get() -> i64           the stored nanoseconds, negative on error
+//
+// A notification target exports:
+//
+//	on_event(kind i32, nsec i64)
+//
+// Times are nanoseconds since the Unix epoch, so values must fall between
+// the years 1970 and 2262.
+const (
+	wasmCallTimeout    = time.Second
+	wasmNotifierBuffer = 64
+)
+
+// event kinds as passed to on_event
+var wasmEventKinds = map[EventType]uint32{
+	EventValueChanged:   1,
+	EventRepairNeeded:   2,
+	EventExpired:        3,
+	EventDeleted:        4,
+	EventConfigReloaded: 5,
+}
+
+func init() {
+	RegisterBackend("wasm", func(location string) (Store, error) {
+		if location == "" {
+			return nil, errors.New("wasm backend requires a module file")
+		}
+		return openWASMStore(location)
+	})
+}
+
+// wasmModule serializes calls into a module instance, which is not safe for
+// concurrent use. A call running past its deadline closes the instance and
+// whatever the guest kept in its memory with it. Modules that keep nothing,
+// like notifiers, are instantiated again for the next call; a storage
+// adapter keeps its value there, so it fails every call from then on rather
+// than come back empty.
+type wasmModule struct {
+	mu       sync.Mutex
+	name     string
+	rt       wazero.Runtime
+	compiled wazero.CompiledModule
+	config   wazero.ModuleConfig
+	mod      api.Module
+	timeout  time.Duration
+	// stateless modules are instantiated again after a call past its
+	// deadline
+	stateless bool
+}
+
+func loadWASMModule(path string) (*wasmModule, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return instantiateWASM(path, src)
+}
+
+func instantiateWASM(name string, src []byte) (*wasmModule, error) {
+	ctx := context.Background()
+	// a call running past its deadline closes the module instead of hanging
+	rt := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true))
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, rt); err != nil {
+		rt.Close(ctx)
+		return nil, err
+	}
+	compiled, err := rt.CompileModule(ctx, src)
+	if err != nil {
+		rt.Close(ctx)
+		return nil, fmt.Errorf("could not compile %s: %w", name, err)
+	}
+	m := &wasmModule{
+		name:     name,
+		rt:       rt,
+		compiled: compiled,
+		config:   wazero.NewModuleConfig().WithName(name).WithStartFunctions("_initialize"),
+		timeout:  wasmCallTimeout,
+	}
+	if err := m.instantiate(); err != nil {
+		rt.Close(ctx)
+		return nil, err
+	}
+	return m, nil
+}
+
+// instantiate must be called with mu held once the module is shared
+func (m *wasmModule) instantiate() error {
+	mod, err := m.rt.InstantiateModule(context.Background(), m.compiled, m.config)
+	if err != nil {
+		return fmt.Errorf("could not instantiate %s: %w", m.name, err)
+	}
+	m.mod = mod
+	return nil
+}
+
+func (m *wasmModule) require(names ...string) error {
+	for _, name := range names {
+		if m.mod.ExportedFunction(name) == nil {
+			return fmt.Errorf("module does not export %s", name)
+		}
+	}
+	return nil
+}
+
+func (m *wasmModule) call(name string, params ...uint64) ([]uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.mod.IsClosed() {
+		if !m.stateless {
+			return nil, fmt.Errorf("wasm module %s is unusable after a call past its deadline lost its state", m.name)
+		}
+		log(os.Stderr, "wasm module %s was closed by a call past its deadline, instantiating it again\n", m.name)
+		if err := m.instantiate(); err != nil {
+			return nil, err
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+	return m.mod.ExportedFunction(name).Call(ctx, params...)
+}
+
+func (m *wasmModule) Close() error {
+	return m.rt.Close(context.Background())
+}
+
+// wasmStore is a storage backend implemented by a WASM module
+type wasmStore struct {
+	*wasmModule
+}
+
+func openWASMStore(path string) (*wasmStore, error) {
+	m, err := loadWASMModule(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.require("ts_set", "ts_reset", "ts_get"); err != nil {
+		m.Close()
+		return nil, err
+	}
+	return &wasmStore{m}, nil
+}
+
+func (s *wasmStore) Set(ts *time.Time) error {
+	var (
+		res []uint64
+		err error
+	)
+	if ts == nil {
+		res, err = s.call("ts_reset")
+	} else {
+		nsec, ok := wasmTime(*ts)
+		if !ok {
+			return fmt.Errorf("wasm backend can't store %s, it only holds times between 1970 and 2262", ts.Format(time.RFC3339))
+		}
+		res, err = s.call("ts_set", api.EncodeI64(nsec))
+	}
+	if err != nil {
+		return err
+	}
+	if code := api.DecodeI32(res[0]); code != 0 {
+		return fmt.Errorf("wasm backend returned error code %d", code)
+	}
+	return nil
+}
+
+func (s *wasmStore) Get() (time.Time, error) {
+	res, err := s.call("ts_get")
+	if err != nil {
+		return time.Time{}, err
+	}
+	nsec := int64(res[0])
+	if nsec < 0 {
+		return time.Time{}, fmt.Errorf("wasm backend returned error code %d", nsec)
+	}
+	return time.Unix(0, nsec), nil
+}
+
+// wasmTime is t in nanoseconds since the epoch as the ABI passes it, false
+// if it can't be
+func wasmTime(t time.Time) (int64, bool) {
+	if t.Before(time.Unix(0, 0)) || t.After(time.Unix(0, math.MaxInt64)) {
+		return 0, false
+	}
+	return t.UnixNano(), true
+}
+
+// startWASMNotifier delivers bus events to the module at path until the
+// returned function is called
+func startWASMNotifier(path string) (func(), error) {
+	m, err := loadWASMModule(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.require("on_event"); err != nil {
+		m.Close()
+		return nil, err
+	}
+	m.stateless = true
+	stop := notifyWASM(m, path)
+	return func() {
+		stop()
+		m.Close()
+	}, nil
+}
+
+// notifyWASM calls on_event for every bus event until the returned function is
+// called, which waits for delivery of events already received
+func notifyWASM(m *wasmModule, name string) func() {
+	ch, unsubscribe := events.subscribe(wasmNotifierBuffer)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for e := range ch {
+			// times the ABI can't carry are passed as 0, like a cleared value
+			nsec, _ := wasmTime(e.Value)
+			if _, err := m.call("on_event", api.EncodeU32(wasmEventKinds[e.Type]), api.EncodeI64(nsec)); err != nil {
+				log(os.Stderr, "wasm notifier %s failed: %s\n", name, err.Error())
+			}
+		}
+	}()
+	return func() {
+		unsubscribe()
+		<-done
+	}
+}
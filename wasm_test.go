@@ -0,0 +1,179 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testWASMModule assembles a module implementing both plugin interfaces: the
+// stored value lives in global 0 and on_event counts calls in the exported
+// global "events"
+func testWASMModule() []byte {
+	section := func(id byte, content ...byte) []byte {
+		return append([]byte{id, byte(len(content))}, content...)
+	}
+	name := func(s string) []byte {
+		return append([]byte{byte(len(s))}, s...)
+	}
+	const (
+		i32, i64   = 0x7f, 0x7e
+		localGet   = 0x20
+		globalGet  = 0x23
+		globalSet  = 0x24
+		i32Const   = 0x41
+		i64Const   = 0x42
+		i64Add     = 0x7c
+		end        = 0x0b
+		funcExport = 0x00
+		globExport = 0x03
+	)
+	body := func(code ...byte) []byte {
+		// no locals
+		return append([]byte{byte(len(code) + 1), 0x00}, code...)
+	}
+
+	m := []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+	m = append(m, section(1,
+		4,
+		0x60, 1, i64, 1, i32, // ts_set
+		0x60, 0, 1, i32, // ts_reset
+		0x60, 0, 1, i64, // ts_get
+		0x60, 2, i32, i64, 0, // on_event
+	)...)
+	m = append(m, section(3, 4, 0, 1, 2, 3)...)
+	m = append(m, section(6,
+		2,
+		i64, 1, i64Const, 0, end,
+		i64, 1, i64Const, 0, end,
+	)...)
+	var exports []byte
+	exports = append(exports, 5)
+	for i, fn := range []string{"ts_set", "ts_reset", "ts_get", "on_event"} {
+		exports = append(exports, name(fn)...)
+		exports = append(exports, funcExport, byte(i))
+	}
+	exports = append(exports, name("events")...)
+	exports = append(exports, globExport, 1)
+	m = append(m, section(7, exports...)...)
+	var code []byte
+	code = append(code, 4)
+	code = append(code, body(localGet, 0, globalSet, 0, i32Const, 0, end)...)
+	code = append(code, body(i64Const, 0, globalSet, 0, i32Const, 0, end)...)
+	code = append(code, body(globalGet, 0, end)...)
+	code = append(code, body(globalGet, 1, i64Const, 1, i64Add, globalSet, 1, end)...)
+	return append(m, section(10, code...)...)
+}
+
+func TestWASMStore(t *testing.T) {
+	m, err := instantiateWASM("test", testWASMModule())
+	if err != nil {
+		t.Fatalf("could not instantiate module: %v", err)
+	}
+	s := &wasmStore{m}
+	defer s.Close()
+
+	ts := time.Unix(1234, 567)
+	if err := s.Set(&ts); err != nil {
+		t.Fatalf("could not store: %v", err)
+	}
+	if got := mustGet(t, s); !got.Equal(ts) {
+		t.Errorf("expected %s, got: %s", ts, got)
+	}
+	for _, out := range []time.Time{time.Unix(-1, 0), time.Date(2300, 1, 1, 0, 0, 0, 0, time.UTC)} {
+		if err := s.Set(&out); err == nil {
+			t.Errorf("expected %s to be refused", out)
+		}
+	}
+	if err := s.Set(nil); err != nil {
+		t.Fatalf("could not reset: %v", err)
+	}
+	if got := mustGet(t, s).Unix(); got != 0 {
+		t.Errorf("expected reset value, got: %d", got)
+	}
+}
+
+func TestWASMModuleExports(t *testing.T) {
+	m, err := instantiateWASM("test", testWASMModule())
+	if err != nil {
+		t.Fatalf("could not instantiate module: %v", err)
+	}
+	defer m.Close()
+	if err := m.require("ts_get", "on_event"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := m.require("ts_scan"); err == nil {
+		t.Error("expected missing export to be reported")
+	}
+	if _, err := instantiateWASM("garbage", []byte("not wasm")); err == nil {
+		t.Error("expected invalid module to be rejected")
+	}
+}
+
+func TestWASMNotifier(t *testing.T) {
+	m, err := instantiateWASM("test", testWASMModule())
+	if err != nil {
+		t.Fatalf("could not instantiate module: %v", err)
+	}
+	defer m.Close()
+
+	stop := notifyWASM(m, "test")
+	for i := 0; i < 3; i++ {
+		events.publish(Event{Type: EventValueChanged, Value: time.Unix(int64(i), 0)})
+	}
+	stop()
+	if got := m.mod.ExportedGlobal("events").Get(); got != 3 {
+		t.Errorf("expected 3 events to be delivered, got: %d", got)
+	}
+
+	path := filepath.Join(t.TempDir(), "notifier.wasm")
+	if err := writeFileAtomic(path, testWASMModule()); err != nil {
+		t.Fatalf("could not write module: %v", err)
+	}
+	stopFile, err := startWASMNotifier(path)
+	if err != nil {
+		t.Fatalf("could not start notifier from file: %v", err)
+	}
+	stopFile()
+}
+
+// spinWASMModule exports "spin", which never returns, and "noop"
+func spinWASMModule() []byte {
+	m := []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+	m = append(m, 1, 4, 1, 0x60, 0, 0) // type () -> ()
+	m = append(m, 3, 3, 2, 0, 0)       // two functions of that type
+	m = append(m, 7, 15, 2, 4, 's', 'p', 'i', 'n', 0x00, 0, 4, 'n', 'o', 'o', 'p', 0x00, 1)
+	m = append(m, 10, 12, 2,
+		7, 0x00, 0x03, 0x40, 0x0c, 0x00, 0x0b, // loop br 0 end
+		0x0b,
+		2, 0x00, 0x0b,
+	)
+	return m
+}
+
+func TestWASMModuleDeadline(t *testing.T) {
+	m, err := instantiateWASM("spin", spinWASMModule())
+	if err != nil {
+		t.Fatalf("could not instantiate module: %v", err)
+	}
+	defer m.Close()
+	m.timeout = 50 * time.Millisecond
+
+	// the instance and its state are gone, so a module holding state fails
+	if _, err := m.call("spin"); err == nil {
+		t.Fatal("expected the call past its deadline to fail")
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := m.call("noop"); err == nil {
+			t.Fatal("expected a module that lost its state to stay failed")
+		}
+	}
+
+	// a stateless one starts over
+	m.stateless = true
+	for i := 0; i < 2; i++ {
+		if _, err := m.call("noop"); err != nil {
+			t.Fatalf("expected a stateless module to be usable after a timed out call, got: %v", err)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	watchPath           = "/watch"
+	defaultWatchTimeout = 30 * time.Second
+	maxWatchTimeout     = 5 * time.Minute
+	// changes a watch may fall behind before it misses some
+	watchBuffer = 4
+)
+
+// watch long-polls for a change: it answers as soon as the stored value
+// differs from ?since=, an epoch value in the request's precision, or with
+// 304 once ?timeout= has passed. Without since it waits for the next change.
+// With ?min_delta= only a value at least that far from since, or without since
+// from the value stored when the watch started, is an answer.
+// The server's write timeout is lifted for the wait. Where that isn't
+// possible the wait is cut short to fit in it, see responseLifetime.
+func watch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	unit, err := requestPrecision(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var since *time.Time
+	if v := r.URL.Query().Get("since"); v != "" {
+		ts, err := timestamp(v).toTime(unit)
+		if err != nil {
+			http.Error(w, "invalid since: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		since = &ts
+	}
+	timeout := defaultWatchTimeout
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		timeout, err = parseDuration("timeout", v, maxWatchTimeout)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	minDelta, err := requestMinDelta(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if lifetime := responseLifetime(r); !clearWriteDeadline(w) && lifetime > 0 && lifetime < timeout {
+		timeout = lifetime
+	}
+
+	// subscribe before reading, so no change falls between the two
+	updates, unsubscribe := events.subscribe(watchBuffer)
+	defer unsubscribe()
+	filter := deltaFilter{min: minDelta}
+	if since != nil || minDelta > 0 {
+		ts, err := readValue()
+		if err != nil {
+			log(os.Stderr, "could not read timestamp: %s\n", err.Error())
+			http.Error(w, "could not read timestamp", http.StatusInternalServerError)
+			return
+		}
+		if since == nil {
+			filter.last = ts
+		} else {
+			filter.last = *since
+			if !truncate(ts, unit).Equal(*since) && filter.pass(ts) {
+				writeTimestamp(w, r, http.StatusOK, ts)
+				return
+			}
+		}
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-timer.C:
+			w.WriteHeader(http.StatusNotModified)
+			return
+		case e := <-updates:
+			if !e.changesValue() || (since != nil && truncate(e.Value, unit).Equal(*since)) || !filter.pass(e.Value) {
+				continue
+			}
+			w.Header().Set(writeIDHeader, e.ID)
+			writeTimestamp(w, r, http.StatusOK, e.Value)
+			return
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	defer resetStore()
+
+	tests := []struct {
+		description        string
+		query              string
+		publish            int64 // published while watching, 0 for nothing
+		expectedStatusCode int
+		expectedBody       string
+	}{
+		{"already changed", "?since=50", 0, http.StatusOK, "100"},
+		{"changes while watching", "?since=100", 200, http.StatusOK, "200"},
+		{"any change", "", 100, http.StatusOK, "100"},
+		{"no change", "?since=100&timeout=50ms", 0, http.StatusNotModified, ""},
+		{"same value republished", "?since=100&timeout=100ms", 100, http.StatusNotModified, ""},
+		{"millisecond precision", "?since=100000&precision=ms&timeout=50ms", 0, http.StatusNotModified, ""},
+		{"small change already made", "?since=90&min_delta=1m&timeout=50ms", 0, http.StatusNotModified, ""},
+		{"large change already made", "?since=10&min_delta=1m", 0, http.StatusOK, "100"},
+		{"small change while watching", "?min_delta=1m&timeout=100ms", 130, http.StatusNotModified, ""},
+		{"large change while watching", "?min_delta=1m", 160, http.StatusOK, "160"},
+		{"invalid since", "?since=x", 0, http.StatusBadRequest, ""},
+		{"invalid min delta", "?min_delta=-1s", 0, http.StatusBadRequest, ""},
+		{"invalid timeout", "?timeout=1h", 0, http.StatusBadRequest, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			ts := time.Unix(100, 0)
+			th.Set(&ts)
+			if test.publish != 0 {
+				go func() {
+					// give the watch time to subscribe
+					time.Sleep(20 * time.Millisecond)
+					events.publish(Event{Type: EventValueChanged, ID: "id", Value: time.Unix(test.publish, 0)})
+				}()
+			}
+			w := httptest.NewRecorder()
+			watch(w, httptest.NewRequest(http.MethodGet, apiPrefix+watchPath+test.query, nil))
+			if w.Code != test.expectedStatusCode {
+				t.Fatalf("expected %d, got: %d %s", test.expectedStatusCode, w.Code, w.Body.String())
+			}
+			if test.expectedStatusCode == http.StatusOK && w.Body.String() != test.expectedBody {
+				t.Errorf("expected %q, got: %q", test.expectedBody, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestWatchOutlivesWriteTimeout(t *testing.T) {
+	defer resetStore()
+	srv := httptest.NewUnstartedServer(newMux(map[string]http.HandlerFunc{watchPath: watch}))
+	srv.Config.WriteTimeout = 200 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+
+	start := time.Now()
+	res, err := http.Get(srv.URL + apiPrefix + watchPath + "?timeout=500ms")
+	if err != nil {
+		t.Fatalf("watch failed: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotModified {
+		t.Errorf("expected the watch to end with %d, got: %d", http.StatusNotModified, res.StatusCode)
+	}
+	if waited := time.Since(start); waited < 500*time.Millisecond {
+		t.Errorf("expected the watch to wait for its timeout past the write timeout, it ended after %s", waited)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// The watchdog turns the store into a dead man's switch: when the timestamp
+// hasn't been updated for longer than -watchdog-max-staleness it POSTs an
+// alert to -watchdog-url, and once more when updates resume. A value that
+// was never written counts as last updated when the watchdog started.
+const watchdogTimeout = 5 * time.Second
+
+var (
+	watchdogURL          = flag.String("watchdog-url", "", "webhook notified when the timestamp goes stale and when it recovers")
+	watchdogMaxStaleness = flag.Duration("watchdog-max-staleness", 0, "how long the timestamp may go without an update before the watchdog alerts, 0 to disable")
+	watchdogInterval     = flag.Duration("watchdog-interval", 30*time.Second, "how often the watchdog checks the timestamp")
+)
+
+const (
+	watchdogStale     = "stale"
+	watchdogRecovered = "recovered"
+)
+
+type watchdogAlert struct {
+	Event        string `json:"event"`
+	Timestamp    int64  `json:"timestamp"`
+	MaxStaleness int64  `json:"max_staleness_seconds"`
+	At           int64  `json:"at"`
+}
+
+// watchdog alerts once per stale period rather than on every check
+type watchdog struct {
+	url          string
+	maxStaleness time.Duration
+	started      time.Time
+	client       *http.Client
+
+	mu      sync.Mutex
+	alerted bool
+}
+
+func newWatchdog(url string, maxStaleness time.Duration, started time.Time) *watchdog {
+	return &watchdog{
+		url:          url,
+		maxStaleness: maxStaleness,
+		started:      started,
+		client:       &http.Client{Timeout: watchdogTimeout},
+	}
+}
+
+// check compares the stored timestamp against at and notifies the webhook if
+// it went stale or recovered since the last check. A failed notification is
+// retried on the next check.
+func (d *watchdog) check(ctx context.Context, at time.Time) error {
+	ts, err := readValue()
+	if err != nil {
+		return fmt.Errorf("could not read timestamp: %w", err)
+	}
+	last := ts
+	if ts.Unix() == 0 || ts.Before(d.started) {
+		last = d.started
+	}
+	isStale := at.Sub(last) > d.maxStaleness
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if isStale == d.alerted {
+		return nil
+	}
+	alert := watchdogAlert{
+		Event:        watchdogRecovered,
+		Timestamp:    ts.Unix(),
+		MaxStaleness: int64(d.maxStaleness / time.Second),
+		At:           at.Unix(),
+	}
+	if isStale {
+		alert.Event = watchdogStale
+	}
+	if err := d.notify(ctx, alert); err != nil {
+		return err
+	}
+	d.alerted = isStale
+	log(os.Stdout, "watchdog reported timestamp %s\n", alert.Event)
+	return nil
+}
+
+func (d *watchdog) notify(ctx context.Context, alert watchdogAlert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentTypeJSON)
+	rsp, err := d.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not notify watchdog webhook: %w", err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode/100 != 2 {
+		return fmt.Errorf("watchdog webhook returned %s", rsp.Status)
+	}
+	return nil
+}
+
+// run checks every interval until ctx is done
+func (d *watchdog) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := d.check(ctx, now()); err != nil {
+				log(os.Stderr, "watchdog check failed: %s\n", err.Error())
+			}
+		}
+	}
+}
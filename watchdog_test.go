@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWatchdog(t *testing.T) {
+	defer resetStore()
+	resetStore()
+
+	var alerts []watchdogAlert
+	failing := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var a watchdogAlert
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+			t.Errorf("invalid alert body: %s", err)
+		}
+		alerts = append(alerts, a)
+	}))
+	defer srv.Close()
+
+	started := time.Unix(1000, 0)
+	d := newWatchdog(srv.URL, time.Minute, started)
+
+	steps := []struct {
+		description    string
+		write          int64
+		at             int64
+		failing        bool
+		expectErr      bool
+		expectedEvents []string
+	}{
+		{"missing within window", 0, 1030, false, false, nil},
+		{"missing past window", 0, 1061, false, false, []string{watchdogStale}},
+		{"still stale", 0, 1200, false, false, nil},
+		{"written", 1190, 1200, false, false, []string{watchdogRecovered}},
+		{"webhook failing", 0, 1300, true, true, nil},
+		{"retried", 0, 1310, false, false, []string{watchdogStale}},
+	}
+	for _, step := range steps {
+		t.Run(step.description, func(t *testing.T) {
+			alerts = nil
+			failing = step.failing
+			if step.write != 0 {
+				ts := time.Unix(step.write, 0)
+				th.Set(&ts)
+			}
+			err := d.check(context.Background(), time.Unix(step.at, 0))
+			if (err != nil) != step.expectErr {
+				t.Fatalf("expected error %v, got: %v", step.expectErr, err)
+			}
+			if len(alerts) != len(step.expectedEvents) {
+				t.Fatalf("expected alerts %v, got: %+v", step.expectedEvents, alerts)
+			}
+			for i, a := range alerts {
+				if a.Event != step.expectedEvents[i] {
+					t.Errorf("expected alert %q, got: %q", step.expectedEvents[i], a.Event)
+				}
+				if a.At != step.at || a.MaxStaleness != 60 {
+					t.Errorf("unexpected alert: %+v", a)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Webhooks receive a POST for every change of the value. Deliveries to a
+// webhook are made in order by its own worker, which retries failures with
+// exponential backoff, so a slow receiver doesn't hold up writes or other
+// receivers. With a webhook secret every delivery is signed: the
+// X-Signature-256 header is "sha256=" and the hex HMAC-SHA256 of the
+// X-Webhook-Timestamp header, a dot and the body.
+//
+// Webhooks come from -webhook and can be added and removed at runtime with
+// POST and DELETE /webhooks; runtime changes are not persisted.
+const (
+	webhooksPath           = "/webhooks"
+	webhookSignatureHeader = "X-Signature-256"
+	webhookTimestampHeader = "X-Webhook-Timestamp"
+	// deliveries a webhook may fall behind before new ones are dropped
+	webhookBuffer         = 64
+	webhookTimeout        = 5 * time.Second
+	webhookMaxAttempts    = 5
+	webhookInitialBackoff = time.Second
+	webhookMaxBackoff     = time.Minute
+)
+
+// stringList is a flag that can be given several times
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// the signing key is read like the write secret, from a file or the
+// environment, so it doesn't show up in the process list
+const webhookSecretEnv = "TS_STORE_WEBHOOK_SECRET"
+
+var (
+	webhookURLs       stringList
+	webhookSecretFile = flag.String("webhook-secret-file", "", "file holding the key signing webhook deliveries with HMAC-SHA256, "+webhookSecretEnv+" can hold the key instead")
+
+	// webhookSecret signs deliveries when set
+	webhookSecret []byte
+)
+
+func init() {
+	flag.Var(&webhookURLs, "webhook", "URL receiving a POST for every change of the value, can be repeated")
+}
+
+// webhookPayload has the value in Unix seconds and the nanoseconds within
+// them, like history entries
+type webhookPayload struct {
+	Event     EventType `json:"event"`
+	ID        string    `json:"id"`
+	Timestamp int64     `json:"timestamp"`
+	Nsec      int64     `json:"nsec,omitempty"`
+	Writer    string    `json:"writer"`
+	At        int64     `json:"at"`
+}
+
+type webhookRegistry struct {
+	secret  []byte
+	client  *http.Client
+	backoff time.Duration
+
+	mu    sync.Mutex
+	hooks map[string]*webhook
+}
+
+type webhook struct {
+	url   string
+	queue chan []byte
+	// cancel stops the worker and aborts a delivery in flight
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+var webhooks = newWebhookRegistry(nil, webhookInitialBackoff)
+
+func newWebhookRegistry(secret []byte, backoff time.Duration) *webhookRegistry {
+	return &webhookRegistry{
+		secret:  secret,
+		client:  &http.Client{Timeout: webhookTimeout},
+		backoff: backoff,
+		hooks:   make(map[string]*webhook),
+	}
+}
+
+// start delivers bus events to the registered webhooks until the returned
+// function is called, which also stops the webhook workers
+func (reg *webhookRegistry) start() func() {
+	ch, unsubscribe := events.subscribe(webhookBuffer)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for e := range ch {
+			if e.changesValue() {
+				reg.dispatch(e)
+			}
+		}
+	}()
+	return func() {
+		unsubscribe()
+		<-done
+		reg.mu.Lock()
+		defer reg.mu.Unlock()
+		for u, h := range reg.hooks {
+			h.close()
+			delete(reg.hooks, u)
+		}
+	}
+}
+
+func (reg *webhookRegistry) dispatch(e Event) {
+	body, err := json.Marshal(webhookPayload{Event: e.Type, ID: e.ID, Timestamp: e.Value.Unix(), Nsec: int64(e.Value.Nanosecond()), Writer: e.Writer, At: e.At.Unix()})
+	if err != nil {
+		log(os.Stderr, "could not encode webhook payload: %s\n", err.Error())
+		return
+	}
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	for _, h := range reg.hooks {
+		select {
+		case h.queue <- body:
+		default:
+			log(os.Stderr, "webhook %s is too slow, dropping delivery of write %s\n", h.url, e.ID)
+		}
+	}
+}
+
+var errWebhookExists = errors.New("webhook already registered")
+
+func validWebhookURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid webhook URL %q", rawURL)
+	}
+	return nil
+}
+
+func (reg *webhookRegistry) add(rawURL string) error {
+	if err := validWebhookURL(rawURL); err != nil {
+		return err
+	}
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if _, ok := reg.hooks[rawURL]; ok {
+		return errWebhookExists
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	h := &webhook{url: rawURL, queue: make(chan []byte, webhookBuffer), ctx: ctx, cancel: cancel, done: make(chan struct{})}
+	reg.hooks[rawURL] = h
+	go reg.deliver(h)
+	return nil
+}
+
+// remove reports whether rawURL was registered
+func (reg *webhookRegistry) remove(rawURL string) bool {
+	reg.mu.Lock()
+	h, ok := reg.hooks[rawURL]
+	delete(reg.hooks, rawURL)
+	reg.mu.Unlock()
+	if ok {
+		h.close()
+	}
+	return ok
+}
+
+func (reg *webhookRegistry) has(rawURL string) bool {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	_, ok := reg.hooks[rawURL]
+	return ok
+}
+
+func (reg *webhookRegistry) urls() []string {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	urls := make([]string, 0, len(reg.hooks))
+	for u := range reg.hooks {
+		urls = append(urls, u)
+	}
+	sort.Strings(urls)
+	return urls
+}
+
+// close stops the worker, abandoning deliveries still queued, retrying or
+// in flight
+func (h *webhook) close() {
+	h.cancel()
+	<-h.done
+}
+
+func (reg *webhookRegistry) deliver(h *webhook) {
+	defer close(h.done)
+	for {
+		select {
+		case <-h.ctx.Done():
+			return
+		case body := <-h.queue:
+			backoff := reg.backoff
+			for attempt := 1; ; attempt++ {
+				err := reg.post(h.ctx, h.url, body)
+				if err == nil {
+					break
+				}
+				if h.ctx.Err() != nil {
+					return
+				}
+				if attempt == webhookMaxAttempts {
+					log(os.Stderr, "giving up on webhook %s after %d attempts: %s\n", h.url, attempt, err.Error())
+					break
+				}
+				log(os.Stderr, "webhook %s failed, retrying in %s: %s\n", h.url, backoff, err.Error())
+				select {
+				case <-h.ctx.Done():
+					return
+				case <-time.After(backoff):
+				}
+				if backoff *= 2; backoff > webhookMaxBackoff {
+					backoff = webhookMaxBackoff
+				}
+			}
+		}
+	}
+}
+
+func (reg *webhookRegistry) post(ctx context.Context, rawURL string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, rawURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentTypeJSON)
+	if len(reg.secret) > 0 {
+		ts := strconv.FormatInt(now().Unix(), 10)
+		req.Header.Set(webhookTimestampHeader, ts)
+		req.Header.Set(webhookSignatureHeader, "sha256="+signWebhook(reg.secret, ts, body))
+	}
+	rsp, err := reg.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(rsp.Body, maxReqBytes))
+	if rsp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", rsp.Status)
+	}
+	return nil
+}
+
+func signWebhook(secret []byte, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+type webhookRequest struct {
+	URL string `json:"url"`
+}
+
+// webhooksHandler lists (GET), registers (POST {"url":...}) and removes
+// (DELETE ?url=) webhooks
+func webhooksHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", contentTypeJSON)
+		json.NewEncoder(w).Encode(map[string][]string{"webhooks": webhooks.urls()})
+	case http.MethodPost:
+		var body webhookRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxReqBytes)).Decode(&body); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		err := webhooks.add(body.URL)
+		if errors.Is(err, errWebhookExists) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log(os.Stdout, "webhook %s registered by writer %q\n", body.URL, writer(r))
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		u := r.URL.Query().Get("url")
+		if !webhooks.has(u) {
+			http.Error(w, "webhook not registered", http.StatusNotFound)
+			return
+		}
+		if !confirmDestructive(w, r, "remove webhook "+u) {
+			return
+		}
+		if !webhooks.remove(u) {
+			http.Error(w, "webhook not registered", http.StatusNotFound)
+			return
+		}
+		log(os.Stdout, "webhook %s removed by writer %q\n", u, writer(r))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookDelivery(t *testing.T) {
+	secret := []byte("secret")
+	var (
+		mu        sync.Mutex
+		attempts  int
+		delivered = make(chan webhookPayload, 1)
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		attempts++
+		first := attempts == 1
+		mu.Unlock()
+		// the first attempt fails to exercise the retry
+		if first {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		expected := "sha256=" + signWebhook(secret, r.Header.Get(webhookTimestampHeader), body)
+		if got := r.Header.Get(webhookSignatureHeader); got != expected {
+			t.Errorf("expected signature %s, got: %s", expected, got)
+		}
+		var p webhookPayload
+		if err := json.Unmarshal(body, &p); err != nil {
+			t.Errorf("invalid payload %q: %v", body, err)
+		}
+		delivered <- p
+	}))
+	defer srv.Close()
+
+	reg := newWebhookRegistry(secret, time.Millisecond)
+	if err := reg.add(srv.URL); err != nil {
+		t.Fatalf("could not add webhook: %v", err)
+	}
+	if err := reg.add(srv.URL); err != errWebhookExists {
+		t.Errorf("expected a duplicate to be refused, got: %v", err)
+	}
+	stop := reg.start()
+	defer stop()
+
+	events.publish(Event{Type: EventValueChanged, ID: "write-1", Value: time.Unix(42, 5), Writer: "w", At: time.Unix(50, 0)})
+	select {
+	case p := <-delivered:
+		if p != (webhookPayload{Event: EventValueChanged, ID: "write-1", Timestamp: 42, Nsec: 5, Writer: "w", At: 50}) {
+			t.Errorf("unexpected payload: %+v", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not delivered")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts != 2 {
+		t.Errorf("expected delivery on the second attempt, got %d attempts", attempts)
+	}
+}
+
+func TestWebhookSecretFlag(t *testing.T) {
+	secretFile := filepath.Join(t.TempDir(), "webhook-secret")
+	if err := os.WriteFile(secretFile, []byte("file-key\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		description string
+		env         string
+		args        []string
+		wantErr     bool
+		expected    string
+	}{
+		{"none", "", nil, false, ""},
+		{"env", "env-key", nil, false, "env-key"},
+		{"file", "", []string{"-webhook-secret-file", secretFile}, false, "file-key"},
+		{"missing file", "", []string{"-webhook-secret-file", secretFile + ".missing"}, true, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			t.Setenv(webhookSecretEnv, test.env)
+			if test.env == "" {
+				os.Unsetenv(webhookSecretEnv)
+			}
+			err := configureForTest(t, test.args...)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("configure(%q) = %v, want error %t", test.args, err, test.wantErr)
+			}
+			if err == nil && string(webhookSecret) != test.expected {
+				t.Errorf("expected webhook secret %q, got %q", test.expected, webhookSecret)
+			}
+		})
+	}
+}
+
+func TestWebhooksHandler(t *testing.T) {
+	defer func(reg *webhookRegistry) { webhooks = reg }(webhooks)
+	webhooks = newWebhookRegistry(nil, time.Millisecond)
+	defer webhooks.start()()
+
+	tests := []struct {
+		description        string
+		method             string
+		target             string
+		body               string
+		expectedStatusCode int
+		expectedList       string
+	}{
+		{"register", http.MethodPost, "", `{"url":"http://example.com/hook"}`, http.StatusCreated, `["http://example.com/hook"]`},
+		{"register twice", http.MethodPost, "", `{"url":"http://example.com/hook"}`, http.StatusConflict, `["http://example.com/hook"]`},
+		{"invalid URL", http.MethodPost, "", `{"url":"ftp://example.com"}`, http.StatusBadRequest, `["http://example.com/hook"]`},
+		{"invalid body", http.MethodPost, "", `{`, http.StatusBadRequest, `["http://example.com/hook"]`},
+		{"remove unknown", http.MethodDelete, "?url=http://other.example.com", "", http.StatusNotFound, `["http://example.com/hook"]`},
+		{"remove", http.MethodDelete, "?url=http://example.com/hook", "", http.StatusNoContent, `[]`},
+		{"method", http.MethodPut, "", "", http.StatusMethodNotAllowed, `[]`},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			webhooksHandler(w, httptest.NewRequest(test.method, apiPrefix+webhooksPath+test.target, strings.NewReader(test.body)))
+			if w.Code != test.expectedStatusCode {
+				t.Errorf("expected %d, got: %d %s", test.expectedStatusCode, w.Code, w.Body.String())
+			}
+			w = httptest.NewRecorder()
+			webhooksHandler(w, httptest.NewRequest(http.MethodGet, apiPrefix+webhooksPath, nil))
+			expected := `{"webhooks":` + test.expectedList + "}\n"
+			if got := w.Body.String(); got != expected {
+				t.Errorf("expected %s, got: %s", expected, got)
+			}
+		})
+	}
+}
+
+func TestWebhooksRequireToken(t *testing.T) {
+	defer func(s []byte) { writeSecret = s }(writeSecret)
+	writeSecret = []byte("secret")
+	h := newMux(map[string]http.HandlerFunc{webhooksPath: webhooksHandler})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, apiPrefix+webhooksPath, bytes.NewReader([]byte(`{"url":"http://example.com"}`))))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected %d, got: %d", http.StatusUnauthorized, w.Code)
+	}
+}
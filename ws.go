@@ -0,0 +1,496 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// /ws speaks a small JSON protocol over WebSocket (RFC 6455), one message per
+// text frame. Clients send
+//
+//	{"type":"subscribe","min_delta":"1m"}  current value, then every change,
+//	                                       min_delta being optional
+//	{"type":"unsubscribe"}
+//	{"type":"update","timestamp":123,"ttl":"30s","monotonic":true,"fence":"7"}
+//	{"type":"reset"}
+//
+// and receive {"type":"value","id":...,"timestamp":...} for changes,
+// {"type":"ack","id":...} for their writes and {"type":"error","error":...}.
+// Timestamps are epoch values in the precision given by ?precision= on the
+// upgrade request. Writes go through the same core as PUT /update and need
+// the same authorization and freshness: the TOTP code of the upgrade request,
+// or the one in the message's "token", must still be valid when the write
+// arrives, and with -max-request-age the message's "sent_at" (RFC 3339)
+// stands in for X-Sent-At.
+const (
+	wsPath = "/ws"
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	// events a subscription may fall behind before it misses some
+	wsBuffer       = 16
+	wsWriteTimeout = 5 * time.Second
+)
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+)
+
+var errWSMessageTooLarge = errors.New("websocket message too large")
+
+// Browsers let any page open a WebSocket to any site, sending the page's
+// origin along, so upgrades from pages of other hosts are refused unless
+// their origin is allowed with -ws-allowed-origin. Clients other than
+// browsers send no Origin and are not affected.
+var wsAllowedOrigins stringList
+
+func init() {
+	flag.Var(&wsAllowedOrigins, "ws-allowed-origin", "origin like https://app.example.com whose pages may open "+wsPath+" besides those of the same host, can be repeated")
+}
+
+// checkAllowedOrigins refuses -ws-allowed-origin values that aren't a bare
+// scheme and host, which would never match
+func checkAllowedOrigins(origins []string) error {
+	for _, o := range origins {
+		u, err := url.Parse(o)
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+			return fmt.Errorf("%q is not an origin like https://app.example.com", o)
+		}
+	}
+	return nil
+}
+
+// wsOriginAllowed reports whether the page that opened the upgrade request,
+// if any, may use the WebSocket
+func wsOriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range wsAllowedOrigins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+type wsMessage struct {
+	Type      string      `json:"type"`
+	ID        string      `json:"id,omitempty"`
+	Timestamp json.Number `json:"timestamp,omitempty"`
+	TTL       string      `json:"ttl,omitempty"`
+	Monotonic bool        `json:"monotonic,omitempty"`
+	Fence     string      `json:"fence,omitempty"`
+	MinDelta  string      `json:"min_delta,omitempty"`
+	Token     string      `json:"token,omitempty"`
+	SentAt    string      `json:"sent_at,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// wsAccept is the Sec-WebSocket-Accept answer to a client's key
+func wsAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func wsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") || key == "" {
+		http.Error(w, "websocket upgrade required", http.StatusUpgradeRequired)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return
+	}
+	if !wsOriginAllowed(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	unit, err := requestPrecision(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket is not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		log(os.Stderr, "could not upgrade to websocket: %s\n", err.Error())
+		return
+	}
+	// the server's timeouts were meant for a single response
+	conn.SetDeadline(time.Time{})
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", wsAccept(key))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+	c := &wsConn{
+		conn:      conn,
+		br:        rw.Reader,
+		unit:      unit,
+		heartbeat: *streamHeartbeat,
+		writer:    writer(r),
+		token:     requestTOTP(r),
+	}
+	c.serve()
+}
+
+// wsConn is one client connection. Reads happen on the serving goroutine,
+// frames are written from any goroutine under writeMu.
+type wsConn struct {
+	conn      net.Conn
+	br        *bufio.Reader
+	unit      time.Duration
+	heartbeat time.Duration
+	writer    string
+	// token is the TOTP code of the upgrade request, checked again on
+	// every write as it expires like any other
+	token   string
+	writeMu sync.Mutex
+
+	mu          sync.Mutex
+	unsubscribe func()
+}
+
+func (c *wsConn) serve() {
+	defer c.conn.Close()
+	defer c.stopSubscription()
+	stopPing := make(chan struct{})
+	defer close(stopPing)
+	go c.ping(c.heartbeat, stopPing)
+	for {
+		op, payload, err := c.readMessage()
+		if err != nil {
+			if errors.Is(err, errWSMessageTooLarge) {
+				c.close(1009, err.Error())
+			}
+			return
+		}
+		switch op {
+		case wsOpClose:
+			c.close(1000, "")
+			return
+		case wsOpText:
+			c.handle(payload)
+		default:
+			c.close(1003, "only text messages are supported")
+			return
+		}
+	}
+}
+
+func (c *wsConn) handle(payload []byte) {
+	var msg wsMessage
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		c.send(wsMessage{Type: "error", Error: "invalid JSON message"})
+		return
+	}
+	switch msg.Type {
+	case "subscribe":
+		minDelta, err := parseMinDelta(msg.MinDelta)
+		if err != nil {
+			c.send(wsMessage{Type: "error", Error: err.Error()})
+			return
+		}
+		c.subscribe(minDelta)
+	case "unsubscribe":
+		c.stopSubscription()
+	case "update", "reset":
+		c.write(msg)
+	default:
+		c.send(wsMessage{Type: "error", Error: fmt.Sprintf("unknown message type %q", msg.Type)})
+	}
+}
+
+// authorized reports whether msg may write, with its own token or the one
+// the connection was opened with
+func (c *wsConn) authorized(msg wsMessage) bool {
+	if authFor(putPath) != authToken || len(writeSecret) == 0 {
+		return true
+	}
+	token := msg.Token
+	if token == "" {
+		token = c.token
+	}
+	return validTOTP(writeSecret, token, now())
+}
+
+func (c *wsConn) write(msg wsMessage) {
+	if !c.authorized(msg) {
+		metrics.reject(rejectUnauthorized)
+		c.send(wsMessage{Type: "error", Error: "unauthorized"})
+		return
+	}
+	var sentAt time.Time
+	if msg.SentAt != "" {
+		// a malformed time counts as none
+		sentAt, _ = time.Parse(time.RFC3339Nano, msg.SentAt)
+	}
+	if err := checkRequestAge(sentAt); err != nil {
+		c.send(wsMessage{Type: "error", Error: err.Error()})
+		return
+	}
+	var (
+		id  string
+		err error
+	)
+	if msg.Type == "reset" {
+		// there is no dry run over the socket
+		if *requireConfirm {
+			c.send(wsMessage{Type: "error", Error: "resets must be confirmed with DELETE " + apiPrefix + putPath})
+			return
+		}
+		id, err = storeReset(context.Background(), c.writer, msg.Fence)
+	} else {
+		op := writeOp{Writer: c.writer, Fence: msg.Fence, Monotonic: *monotonic || msg.Monotonic}
+		if op.Value, err = timestamp(msg.Timestamp).toTime(c.unit); err != nil {
+			metrics.reject(rejectParse)
+			c.send(wsMessage{Type: "error", Error: "invalid timestamp"})
+			return
+		}
+		if msg.TTL != "" {
+			if op.TTL, err = parseDuration("ttl", msg.TTL, 0); err != nil {
+				metrics.reject(rejectInvalid)
+				c.send(wsMessage{Type: "error", Error: err.Error()})
+				return
+			}
+		}
+		id, err = storeWrite(context.Background(), op)
+	}
+	if err != nil {
+		reply := wsMessage{Type: "error", Error: err.Error()}
+		var we *writeError
+		if errors.As(err, &we) && we.kind == writeOutdated {
+			reply.Timestamp = json.Number(epochValue(we.current, c.unit))
+		}
+		c.send(reply)
+		return
+	}
+	c.send(wsMessage{Type: "ack", ID: id})
+}
+
+// subscribe sends the current value and then every change of at least
+// minDelta until the subscription is stopped
+func (c *wsConn) subscribe(minDelta time.Duration) {
+	c.mu.Lock()
+	if c.unsubscribe != nil {
+		c.mu.Unlock()
+		return
+	}
+	// subscribe before reading, so no change falls between the two
+	updates, unsubscribe := events.subscribe(wsBuffer)
+	c.unsubscribe = unsubscribe
+	c.mu.Unlock()
+
+	ts, err := readValue()
+	if err != nil {
+		log(os.Stderr, "could not read timestamp: %s\n", err.Error())
+		c.send(wsMessage{Type: "error", Error: "could not read timestamp"})
+		c.stopSubscription()
+		return
+	}
+	c.send(wsMessage{Type: "value", Timestamp: json.Number(epochValue(ts, c.unit))})
+	filter := deltaFilter{min: minDelta, last: ts}
+	go func() {
+		for e := range updates {
+			if !e.changesValue() || !filter.pass(e.Value) {
+				continue
+			}
+			if err := c.send(wsMessage{Type: "value", ID: e.ID, Timestamp: json.Number(epochValue(e.Value, c.unit))}); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func (c *wsConn) stopSubscription() {
+	c.mu.Lock()
+	unsubscribe := c.unsubscribe
+	c.unsubscribe = nil
+	c.mu.Unlock()
+	if unsubscribe != nil {
+		unsubscribe()
+	}
+}
+
+func (c *wsConn) ping(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := c.writeFrame(wsOpPing, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *wsConn) send(msg wsMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return c.writeFrame(wsOpText, data)
+}
+
+func (c *wsConn) close(code uint16, reason string) {
+	c.writeFrame(wsOpClose, append(binary.BigEndian.AppendUint16(nil, code), reason...))
+}
+
+// writeFrame writes a single unmasked frame, as servers must
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	header := []byte{0x80 | op}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xffff:
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	_, err := c.conn.Write(append(header, payload...))
+	return err
+}
+
+// readMessage returns the next data or close message, answering pings and
+// reassembling fragmented messages on the way
+func (c *wsConn) readMessage() (byte, []byte, error) {
+	var (
+		op      byte
+		message []byte
+		started bool
+	)
+	for {
+		// a client that sends nothing, not even the pongs to two pings, is gone
+		c.conn.SetReadDeadline(time.Now().Add(2 * c.heartbeat))
+		fin, frameOp, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch frameOp {
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			return wsOpClose, payload, nil
+		case wsOpContinuation:
+			if !started {
+				return 0, nil, errors.New("unexpected continuation frame")
+			}
+		default:
+			if started {
+				return 0, nil, errors.New("expected a continuation frame")
+			}
+			op, started = frameOp, true
+		}
+		message = append(message, payload...)
+		if int64(len(message)) > maxReqBytes {
+			return 0, nil, errWSMessageTooLarge
+		}
+		if fin {
+			return op, message, nil
+		}
+	}
+}
+
+// readFrame reads one frame, which clients must mask
+func (c *wsConn) readFrame() (fin bool, op byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin = head[0]&0x80 != 0
+	op = head[0] & 0x0f
+	if head[1]&0x80 == 0 {
+		return false, 0, nil, errors.New("unmasked client frame")
+	}
+	n := uint64(head[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if n > uint64(maxReqBytes) {
+		return false, 0, nil, errWSMessageTooLarge
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload = make([]byte, n)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, op, payload, nil
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWSAccept(t *testing.T) {
+	// the example from RFC 6455 section 1.3
+	if got := wsAccept("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("unexpected accept value: %s", got)
+	}
+}
+
+// wsTestClient is just enough of a client to talk to wsHandler
+type wsTestClient struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+// wsHandshake sends an upgrade request for host test with the extra header
+// lines in header
+func wsHandshake(t *testing.T, srv *httptest.Server, header string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	req := "GET " + apiPrefix + wsPath + " HTTP/1.1\r\nHost: test\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n" +
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n" + header + "\r\n"
+	if _, err := io.WriteString(conn, req); err != nil {
+		t.Fatalf("could not send handshake: %v", err)
+	}
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("could not read handshake: %v", err)
+	}
+	return conn, br, res
+}
+
+func dialWS(t *testing.T, srv *httptest.Server, header string) *wsTestClient {
+	t.Helper()
+	conn, br, res := wsHandshake(t, srv, header)
+	if res.StatusCode != http.StatusSwitchingProtocols || res.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("unexpected handshake response: %s %v", res.Status, res.Header)
+	}
+	return &wsTestClient{t: t, conn: conn, br: br}
+}
+
+func (c *wsTestClient) sendFrame(op byte, fin bool, payload []byte) {
+	c.t.Helper()
+	b0 := op
+	if fin {
+		b0 |= 0x80
+	}
+	mask := [4]byte{1, 2, 3, 4}
+	frame := []byte{b0, 0x80 | byte(len(payload))}
+	frame = append(frame, mask[:]...)
+	for i, v := range payload {
+		frame = append(frame, v^mask[i%4])
+	}
+	if _, err := c.conn.Write(frame); err != nil {
+		c.t.Fatalf("could not send frame: %v", err)
+	}
+}
+
+func (c *wsTestClient) send(msg string) {
+	c.sendFrame(wsOpText, true, []byte(msg))
+}
+
+// next returns the next text message, skipping pings
+func (c *wsTestClient) next() wsMessage {
+	c.t.Helper()
+	for {
+		var head [2]byte
+		if _, err := io.ReadFull(c.br, head[:]); err != nil {
+			c.t.Fatalf("could not read frame: %v", err)
+		}
+		n := int(head[1] & 0x7f)
+		if n == 126 {
+			var ext [2]byte
+			io.ReadFull(c.br, ext[:])
+			n = int(binary.BigEndian.Uint16(ext[:]))
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(c.br, payload); err != nil {
+			c.t.Fatalf("could not read frame: %v", err)
+		}
+		switch head[0] & 0x0f {
+		case wsOpPing:
+			continue
+		case wsOpText:
+			var msg wsMessage
+			if err := json.Unmarshal(payload, &msg); err != nil {
+				c.t.Fatalf("invalid message %q: %v", payload, err)
+			}
+			return msg
+		default:
+			c.t.Fatalf("unexpected frame %x: %q", head[0], payload)
+		}
+	}
+}
+
+func TestWSHandler(t *testing.T) {
+	defer resetStore()
+	resetStore()
+	srv := httptest.NewServer(newMux(map[string]http.HandlerFunc{wsPath: wsHandler}))
+	defer srv.Close()
+
+	c := dialWS(t, srv, "")
+	defer c.conn.Close()
+	c.send(`{"type":"subscribe"}`)
+	if msg := c.next(); msg.Type != "value" || msg.Timestamp != "0" {
+		t.Errorf("expected the current value, got: %+v", msg)
+	}
+
+	// a fragmented update
+	c.sendFrame(wsOpText, false, []byte(`{"type":"update",`))
+	c.sendFrame(wsOpPing, true, nil)
+	c.sendFrame(wsOpContinuation, true, []byte(`"timestamp":42}`))
+	// the pong for the interleaved ping comes first
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil || head[0]&0x0f != wsOpPong {
+		t.Fatalf("expected a pong, got %x: %v", head[0], err)
+	}
+	var id string
+	for i := 0; i < 2; i++ {
+		switch msg := c.next(); msg.Type {
+		case "ack":
+			id = msg.ID
+		case "value":
+			if msg.Timestamp != "42" {
+				t.Errorf("unexpected value: %+v", msg)
+			}
+		default:
+			t.Errorf("unexpected message: %+v", msg)
+		}
+	}
+	if len(id) != 26 {
+		t.Errorf("expected a write ID, got: %q", id)
+	}
+	if ts := mustGet(t, th); ts.Unix() != 42 {
+		t.Errorf("expected 42 to be stored, got: %d", ts.Unix())
+	}
+
+	c.send(`{"type":"unsubscribe"}`)
+	c.send(`{"type":"update","timestamp":7,"monotonic":true}`)
+	if msg := c.next(); msg.Type != "error" || msg.Timestamp != "42" {
+		t.Errorf("expected an outdated write to get the stored value, got: %+v", msg)
+	}
+	c.send(`{"type":"update","timestamp":-1}`)
+	if msg := c.next(); msg.Type != "error" || !strings.Contains(msg.Error, "invalid timestamp") {
+		t.Errorf("expected an invalid timestamp error, got: %+v", msg)
+	}
+	c.send(`{"type":"nope"}`)
+	if msg := c.next(); msg.Type != "error" {
+		t.Errorf("expected an unknown type error, got: %+v", msg)
+	}
+}
+
+func TestWSHandlerAuth(t *testing.T) {
+	defer resetStore()
+	defer func(s []byte) { writeSecret = s }(writeSecret)
+	resetStore()
+	writeSecret = []byte("secret")
+	srv := httptest.NewServer(newMux(map[string]http.HandlerFunc{wsPath: wsHandler}))
+	defer srv.Close()
+
+	anonymous := dialWS(t, srv, "")
+	defer anonymous.conn.Close()
+	anonymous.send(`{"type":"update","timestamp":42}`)
+	if msg := anonymous.next(); msg.Type != "error" || msg.Error != "unauthorized" {
+		t.Errorf("expected an anonymous write to be refused, got: %+v", msg)
+	}
+
+	authorized := dialWS(t, srv, "Authorization: "+totpScheme+" "+totp(writeSecret, now())+"\r\n")
+	defer authorized.conn.Close()
+	authorized.send(`{"type":"update","timestamp":42}`)
+	if msg := authorized.next(); msg.Type != "ack" {
+		t.Errorf("expected an authorized write to be stored, got: %+v", msg)
+	}
+
+	// once the code of the upgrade request expires, writes need a fresh one
+	defer func(d time.Duration) { *devClockSkew = d }(*devClockSkew)
+	*devClockSkew = 5 * totpStep
+	authorized.send(`{"type":"update","timestamp":43}`)
+	if msg := authorized.next(); msg.Type != "error" || msg.Error != "unauthorized" {
+		t.Errorf("expected a write after the code expired to be refused, got: %+v", msg)
+	}
+	authorized.send(`{"type":"update","timestamp":43,"token":"` + totp(writeSecret, now()) + `"}`)
+	if msg := authorized.next(); msg.Type != "ack" {
+		t.Errorf("expected a write with a fresh code to be stored, got: %+v", msg)
+	}
+}
+
+func TestWSHandlerRequestAge(t *testing.T) {
+	defer resetStore()
+	defer func(d time.Duration) { maxRequestAge = d }(maxRequestAge)
+	resetStore()
+	maxRequestAge = time.Minute
+	srv := httptest.NewServer(newMux(map[string]http.HandlerFunc{wsPath: wsHandler}))
+	defer srv.Close()
+
+	c := dialWS(t, srv, "")
+	defer c.conn.Close()
+	tests := []struct {
+		description string
+		sentAt      string
+		expected    string
+	}{
+		{"no send time", "", "error"},
+		{"malformed send time", "yesterday", "error"},
+		{"stale", time.Now().Add(-time.Hour).Format(time.RFC3339Nano), "error"},
+		{"fresh", time.Now().Format(time.RFC3339Nano), "ack"},
+	}
+	for _, test := range tests {
+		c.send(`{"type":"update","timestamp":42,"sent_at":"` + test.sentAt + `"}`)
+		if msg := c.next(); msg.Type != test.expected {
+			t.Errorf("%s: expected %s, got: %+v", test.description, test.expected, msg)
+		}
+	}
+}
+
+// TestWSHandlerIdle keeps a client that answers pings but sends nothing else
+// over several heartbeats
+func TestWSHandlerIdle(t *testing.T) {
+	defer resetStore()
+	defer func(d time.Duration) { *streamHeartbeat = d }(*streamHeartbeat)
+	resetStore()
+	*streamHeartbeat = 50 * time.Millisecond
+	srv := httptest.NewServer(newMux(map[string]http.HandlerFunc{wsPath: wsHandler}))
+	defer srv.Close()
+
+	c := dialWS(t, srv, "")
+	defer c.conn.Close()
+	for pings := 0; pings < 6; {
+		var head [2]byte
+		if _, err := io.ReadFull(c.br, head[:]); err != nil {
+			t.Fatalf("connection dropped after %d pings: %v", pings, err)
+		}
+		payload := make([]byte, head[1]&0x7f)
+		if _, err := io.ReadFull(c.br, payload); err != nil {
+			t.Fatalf("could not read frame: %v", err)
+		}
+		if op := head[0] & 0x0f; op != wsOpPing {
+			t.Fatalf("expected a ping, got frame %x: %q", head[0], payload)
+		}
+		c.sendFrame(wsOpPong, true, payload)
+		pings++
+	}
+	c.send(`{"type":"update","timestamp":42}`)
+	if msg := c.next(); msg.Type != "ack" {
+		t.Errorf("expected the write to be stored, got: %+v", msg)
+	}
+}
+
+func TestWSHandlerOrigin(t *testing.T) {
+	defer func(l stringList) { wsAllowedOrigins = l }(wsAllowedOrigins)
+	wsAllowedOrigins = stringList{"https://app.example.com"}
+	srv := httptest.NewServer(newMux(map[string]http.HandlerFunc{wsPath: wsHandler}))
+	defer srv.Close()
+
+	tests := []struct {
+		description        string
+		origin             string
+		expectedStatusCode int
+	}{
+		{"no origin", "", http.StatusSwitchingProtocols},
+		{"same host", "http://test", http.StatusSwitchingProtocols},
+		{"allowed origin", "https://APP.example.com", http.StatusSwitchingProtocols},
+		{"other origin", "https://evil.example.com", http.StatusForbidden},
+		{"allowed host with another scheme", "http://app.example.com", http.StatusForbidden},
+		{"opaque origin", "null", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			header := ""
+			if test.origin != "" {
+				header = "Origin: " + test.origin + "\r\n"
+			}
+			conn, _, res := wsHandshake(t, srv, header)
+			conn.Close()
+			if res.StatusCode != test.expectedStatusCode {
+				t.Errorf("expected %d, got: %d", test.expectedStatusCode, res.StatusCode)
+			}
+		})
+	}
+}
+
+func TestCheckAllowedOrigins(t *testing.T) {
+	tests := []struct {
+		origin  string
+		wantErr bool
+	}{
+		{"https://app.example.com", false},
+		{"http://localhost:3000/", false},
+		{"app.example.com", true},
+		{"https://app.example.com/path", true},
+	}
+	for _, test := range tests {
+		if err := checkAllowedOrigins([]string{test.origin}); (err != nil) != test.wantErr {
+			t.Errorf("checkAllowedOrigins(%q) = %v, want error %t", test.origin, err, test.wantErr)
+		}
+	}
+}
+
+func TestWSHandlerRequiresUpgrade(t *testing.T) {
+	w := httptest.NewRecorder()
+	wsHandler(w, httptest.NewRequest(http.MethodGet, apiPrefix+wsPath, nil))
+	if w.Code != http.StatusUpgradeRequired {
+		t.Errorf("expected %d, got: %d", http.StatusUpgradeRequired, w.Code)
+	}
+}